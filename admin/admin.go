@@ -0,0 +1,214 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/justenwalker/squiggly/metrics"
+	"github.com/justenwalker/squiggly/proxy"
+)
+
+// Controller is the running proxy, as seen by the admin API
+type Controller interface {
+	// Status returns the current configuration and routing state
+	Status() Status
+	// Upstreams returns the health of the upstream proxies
+	Upstreams() []proxy.UpstreamStatus
+	// Throughput returns the current throughput, globally, for each client and each host rate limit
+	Throughput() proxy.ThroughputStatus
+	// RefreshPAC fetches the PAC file again
+	RefreshPAC() error
+	// SetMode switches the routing mode, using the arg as the PAC or proxy url where it applies
+	SetMode(mode proxy.Mode, arg string) error
+	// ReloadCredentials reads the upstream proxy credentials from the keyring again
+	ReloadCredentials() error
+	// Reload reads the configuration and the keyring again, and applies them to new connections.
+	// An invalid configuration is rejected, and the current one kept.
+	Reload() error
+}
+
+// Config is the configuration the proxy was started with
+type Config struct {
+	File        string   `json:"file,omitempty"`
+	Listen      []string `json:"listen"`
+	SOCKS       []string `json:"socks,omitempty"`
+	Transparent []string `json:"transparent,omitempty"`
+	Admin       []string `json:"admin,omitempty"`
+	Service     string   `json:"service,omitempty"`
+	User        string   `json:"user,omitempty"`
+	Realm       string   `json:"realm,omitempty"`
+	Krb5Conf    string   `json:"krb5conf,omitempty"`
+}
+
+// Status is the current state of the proxy
+type Status struct {
+	PID     int                `json:"pid"`
+	Started time.Time          `json:"started"`
+	Config  Config             `json:"config"`
+	Routing proxy.RouterStatus `json:"routing"`
+}
+
+// ModeRequest is the body of a request to switch the routing mode
+type ModeRequest struct {
+	Mode proxy.Mode `json:"mode"`
+	// URL of the PAC file or upstream proxy, for the pac and proxy modes.
+	// If empty, the previously configured url is used.
+	URL string `json:"url,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler creates the admin API handler. It also serves the metrics on /metrics.
+// If token is not empty, every request must send it in an "Authorization: Bearer" header,
+// except on unix sockets, whose file permissions already restrict who can connect.
+// Requests from web pages, which carry an Origin header, are refused, and POST requests must have a JSON
+// content type, which a cross-origin form or no-cors fetch can not send.
+//
+//	GET  /api/status               current configuration and routing state
+//	GET  /api/upstreams            upstream proxy health
+//	GET  /api/throughput           current throughput in bytes per second
+//	POST /api/pac/refresh          fetch the PAC file again
+//	POST /api/mode                 switch between the pac, proxy, env and direct modes
+//	POST /api/credentials/reload   read the credentials from the keyring again
+//	POST /api/reload               read the config file and the keyring again
+func NewHandler(c Controller, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/api/status", method(http.MethodGet, func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, c.Status())
+	}))
+	mux.HandleFunc("/api/upstreams", method(http.MethodGet, func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, c.Upstreams())
+	}))
+	mux.HandleFunc("/api/throughput", method(http.MethodGet, func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, c.Throughput())
+	}))
+	mux.HandleFunc("/api/pac/refresh", method(http.MethodPost, func(w http.ResponseWriter, req *http.Request) {
+		if err := c.RefreshPAC(); err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.Status().Routing)
+	}))
+	mux.HandleFunc("/api/mode", method(http.MethodPost, func(w http.ResponseWriter, req *http.Request) {
+		var mr ModeRequest
+		if err := json.NewDecoder(req.Body).Decode(&mr); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+		if err := c.SetMode(mr.Mode, mr.URL); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.Status().Routing)
+	}))
+	mux.HandleFunc("/api/credentials/reload", method(http.MethodPost, func(w http.ResponseWriter, req *http.Request) {
+		if err := c.ReloadCredentials(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("/api/reload", method(http.MethodPost, func(w http.ResponseWriter, req *http.Request) {
+		if err := c.Reload(); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.Status())
+	}))
+	return protect(token, mux)
+}
+
+// protect refuses requests from web pages, without the token, or posting anything but JSON.
+// Without a token, TCP requests must also be addressed to this host, so that a web page can not reach the API
+// by rebinding its own DNS name to a loopback address.
+func protect(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Origin") != "" {
+			writeError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+			return
+		}
+		if token == "" && !unixSocket(req) && !localHost(req) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host '%s' is not allowed", req.Host))
+			return
+		}
+		if token != "" && !unixSocket(req) && !validToken(req, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="squiggly"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		if req.Method == http.MethodPost {
+			if mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+				return
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// unixSocket reports whether the request was received on a unix socket
+func unixSocket(req *http.Request) bool {
+	_, ok := req.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return ok
+}
+
+// localHost reports whether the Host header names localhost, a loopback address or the address the request was received on
+func localHost(req *http.Request) bool {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return false
+	}
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	return ip.IsLoopback() || (ok && addr.IP.Equal(ip))
+}
+
+// validToken reports whether the request carries the token as a bearer token
+func validToken(req *http.Request, token string) bool {
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
+
+func method(m string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != m {
+			w.Header().Set("Allow", m)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+			return
+		}
+		h(w, req)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
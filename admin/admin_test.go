@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/justenwalker/squiggly/proxy"
+)
+
+// fakeController records the mode it is switched to
+type fakeController struct {
+	mode proxy.Mode
+	url  string
+}
+
+func (c *fakeController) Status() Status {
+	return Status{PID: 1, Routing: proxy.RouterStatus{Mode: c.mode, Proxy: c.url}}
+}
+func (c *fakeController) Upstreams() []proxy.UpstreamStatus  { return nil }
+func (c *fakeController) Throughput() proxy.ThroughputStatus { return proxy.ThroughputStatus{} }
+func (c *fakeController) RefreshPAC() error                  { return nil }
+func (c *fakeController) ReloadCredentials() error           { return nil }
+func (c *fakeController) Reload() error                      { return nil }
+func (c *fakeController) SetMode(mode proxy.Mode, arg string) error {
+	c.mode, c.url = mode, arg
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	const body = `{"mode":"proxy","url":"http://proxy.example.com:8080"}`
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		header map[string]string
+		// host is the Host header, localhost:8801 if empty
+		host   string
+		status int
+	}{
+		{name: "status", method: http.MethodGet, path: "/api/status", status: http.StatusOK},
+		{name: "metrics", method: http.MethodGet, path: "/metrics", status: http.StatusOK},
+		{name: "mode", method: http.MethodPost, path: "/api/mode", header: map[string]string{"Content-Type": "application/json"}, status: http.StatusOK},
+		{name: "mode charset", method: http.MethodPost, path: "/api/mode", header: map[string]string{"Content-Type": "application/json; charset=utf-8"}, status: http.StatusOK},
+		{name: "wrong method", method: http.MethodGet, path: "/api/mode", status: http.StatusMethodNotAllowed},
+		{name: "text/plain", method: http.MethodPost, path: "/api/mode", header: map[string]string{"Content-Type": "text/plain"}, status: http.StatusUnsupportedMediaType},
+		{name: "form", method: http.MethodPost, path: "/api/reload", header: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, status: http.StatusUnsupportedMediaType},
+		{name: "no content type", method: http.MethodPost, path: "/api/pac/refresh", status: http.StatusUnsupportedMediaType},
+		{name: "origin", method: http.MethodPost, path: "/api/mode", header: map[string]string{"Content-Type": "application/json", "Origin": "http://attacker.example.com"}, status: http.StatusForbidden},
+		{name: "origin get", method: http.MethodGet, path: "/api/status", header: map[string]string{"Origin": "http://localhost:8801"}, status: http.StatusForbidden},
+		{name: "token", token: "s3cret", method: http.MethodGet, path: "/api/status", header: map[string]string{"Authorization": "Bearer s3cret"}, status: http.StatusOK},
+		{name: "token scheme case", token: "s3cret", method: http.MethodGet, path: "/metrics", header: map[string]string{"Authorization": "bearer s3cret"}, status: http.StatusOK},
+		{name: "token missing", token: "s3cret", method: http.MethodGet, path: "/api/status", status: http.StatusUnauthorized},
+		{name: "token wrong", token: "s3cret", method: http.MethodGet, path: "/metrics", header: map[string]string{"Authorization": "Bearer s3cre"}, status: http.StatusUnauthorized},
+		{name: "token basic", token: "s3cret", method: http.MethodGet, path: "/api/status", header: map[string]string{"Authorization": "Basic czNjcmV0"}, status: http.StatusUnauthorized},
+		{name: "loopback address", method: http.MethodGet, path: "/api/status", host: "127.0.0.1:8801", status: http.StatusOK},
+		{name: "ipv6 loopback address", method: http.MethodGet, path: "/api/status", host: "[::1]:8801", status: http.StatusOK},
+		{name: "rebound host name", method: http.MethodGet, path: "/api/status", host: "attacker.example.com:8801", status: http.StatusForbidden},
+		{name: "rebound host name post", method: http.MethodPost, path: "/api/mode", header: map[string]string{"Content-Type": "application/json"}, host: "attacker.example.com", status: http.StatusForbidden},
+		{name: "token with host name", token: "s3cret", method: http.MethodGet, path: "/api/status", header: map[string]string{"Authorization": "Bearer s3cret"}, host: "proxy.example.com:8801", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fakeController{mode: proxy.ModeDirect}
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			req.Host = "localhost:8801"
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			NewHandler(c, tt.token).ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+			if tt.path == "/api/mode" && tt.status != http.StatusOK && c.mode != proxy.ModeDirect {
+				t.Errorf("refused request switched the mode to %s", c.mode)
+			}
+		})
+	}
+}
+
+func TestHandlerSetMode(t *testing.T) {
+	c := &fakeController{mode: proxy.ModeDirect}
+	req := httptest.NewRequest(http.MethodPost, "/api/mode", strings.NewReader(`{"mode":"proxy","url":"http://proxy.example.com:8080"}`))
+	req.Host = "localhost:8801"
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	NewHandler(c, "").ServeHTTP(rec, req)
+	var routing proxy.RouterStatus
+	if err := json.NewDecoder(rec.Body).Decode(&routing); err != nil {
+		t.Fatal(err)
+	}
+	if routing.Mode != proxy.ModeProxy || routing.Proxy != "http://proxy.example.com:8080" {
+		t.Errorf("routing = %+v", routing)
+	}
+}
+
+func TestHandlerUnixSocketWithoutToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets not supported: %v", err)
+	}
+	srv := &http.Server{Handler: NewHandler(&fakeController{}, "s3cret")}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://squiggly/api/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
@@ -3,14 +3,15 @@ package auth
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/justenwalker/squiggly/logging"
 )
 
 type Auth struct {
-	Logger  logging.Logger
-	cs      CredentialStore
-	spnego  *SPNEGO
+	Logger *logging.EventLogger
+	cs     CredentialStore
+	spnego *SPNEGO
 }
 
 func NewAuth(cs CredentialStore, spnego *SPNEGO) *Auth {
@@ -20,33 +21,44 @@ func NewAuth(cs CredentialStore, spnego *SPNEGO) *Auth {
 	}
 }
 
-func (a Auth) log(msg string) {
-	if a.Logger == nil {
-		return
+func (a Auth) Authorize(resp *http.Response, pc ProxyConnection) error {
+	start := time.Now()
+	scheme, err := a.authorize(resp, pc)
+	logger := a.Logger.Ctx(connContext(pc))
+	fields := []logging.Field{
+		logging.F(logging.KeyScheme, scheme),
+		logging.F(logging.KeyUpstream, pc.Proxy().Host),
+		logging.F(logging.KeyDuration, time.Since(start)),
+	}
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+		logger.Warn("proxy auth failed", append(fields, logging.Err(err))...)
+	} else {
+		logger.Debug("proxy auth", fields...)
 	}
-	a.Logger.Log(msg)
+	authHandshakes.With(scheme, outcome).Inc()
+	return err
 }
 
-func (a Auth) Authorize(resp *http.Response, pc ProxyConnection) error {
+func (a Auth) authorize(resp *http.Response, pc ProxyConnection) (string, error) {
 	ah := GetHeader(resp)
 	switch {
 	case ah.IsBasic():
-		a.log("basic proxy-auth")
-		return BasicAuth{
+		return "basic", BasicAuth{
 			CredentialStore: a.cs,
 		}.Authorize(resp, pc)
 	case ah.IsNTLM():
-		a.log("NTLM proxy-auth")
 		cred, err := a.cs.Credentials(getHost(pc.Proxy()))
 		if err != nil {
-			return err
+			return "ntlm", err
 		}
-		return NTLM{Credentials: cred}.Authorize(resp, pc)
+		return "ntlm", NTLM{Credentials: cred, Logger: a.Logger}.Authorize(resp, pc)
 	case ah.IsNegotiate():
 		if a.spnego != nil {
-			a.log("Negotiate proxy-auth")
-			return a.spnego.Authorize(resp, pc)
+			return "negotiate", a.spnego.authorize(a.Logger, resp, pc)
 		}
+		return "negotiate", fmt.Errorf("unsupported proxy auth type: %v", ah)
 	}
-	return fmt.Errorf("unsupported proxy auth type: %v", ah)
+	return "unknown", fmt.Errorf("unsupported proxy auth type: %v", ah)
 }
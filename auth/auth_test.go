@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// fakeConnection records the Proxy-Authorization it is connected with
+type fakeConnection struct {
+	auth string
+}
+
+func (c *fakeConnection) Proxy() *url.URL {
+	return &url.URL{Scheme: "http", Host: "proxy.example.com:8080"}
+}
+
+func (c *fakeConnection) Connect(auth string) (*http.Response, error) {
+	c.auth = auth
+	return &http.Response{StatusCode: http.StatusOK}, nil
+}
+
+// contextConnection is a fakeConnection made for a request
+type contextConnection struct {
+	fakeConnection
+	ctx context.Context
+}
+
+func (c *contextConnection) Context() context.Context {
+	return c.ctx
+}
+
+func basicChallenge() *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		Header:     http.Header{"Proxy-Authenticate": []string{`Basic realm="proxy"`}},
+	}
+}
+
+func TestAuthorizeBasic(t *testing.T) {
+	a := NewAuth(Credentials{Username: "alice", Password: "secret"}, nil)
+	pc := &fakeConnection{}
+	if err := a.Authorize(basicChallenge(), pc); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")); pc.auth != want {
+		t.Errorf("Proxy-Authorization = %q, want %q", pc.auth, want)
+	}
+}
+
+func TestAuthorizeLogsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	a := NewAuth(Credentials{Username: "alice", Password: "secret"}, nil)
+	a.Logger = logging.NewEventLogger(&buf, logging.LevelDebug, logging.JSONEncoder{})
+	pc := &contextConnection{ctx: logging.WithRequestID(context.Background(), "9f86d081884c7d65")}
+	if err := a.Authorize(basicChallenge(), pc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"request_id":"9f86d081884c7d65"`) {
+		t.Errorf("auth log %q does not carry the request ID", buf.String())
+	}
+
+	// Connections without a context are still authorized, and logged without a request ID
+	buf.Reset()
+	if err := a.Authorize(basicChallenge(), &fakeConnection{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"msg":"proxy auth"`) || strings.Contains(buf.String(), "request_id") {
+		t.Errorf("auth log = %q", buf.String())
+	}
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
@@ -14,6 +15,21 @@ type ProxyConnection interface {
 	Connect(auth string) (*http.Response, error)
 }
 
+// ContextConnection is a ProxyConnection made for a request.
+// Its context carries the request ID, which is added to the auth logs.
+type ContextConnection interface {
+	ProxyConnection
+	Context() context.Context
+}
+
+// connContext returns the context of the connection, or the background context if it has none
+func connContext(pc ProxyConnection) context.Context {
+	if cc, ok := pc.(ContextConnection); ok {
+		return cc.Context()
+	}
+	return context.Background()
+}
+
 func mustConnect(auth string, pc ProxyConnection) error {
 	if _, err := pc.Connect(auth); err != nil {
 		return err
@@ -17,6 +17,19 @@ func GetHeader(resp *http.Response) Header {
 	return Header(vs[0])
 }
 
+// Scheme returns the lower case name of the authentication scheme: basic, ntlm, negotiate or unknown
+func (h Header) Scheme() string {
+	switch {
+	case h.IsBasic():
+		return "basic"
+	case h.IsNTLM():
+		return "ntlm"
+	case h.IsNegotiate():
+		return "negotiate"
+	}
+	return "unknown"
+}
+
 func (h Header) IsBasic() bool {
 	return strings.HasPrefix(string(h), "Basic ")
 }
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdCacheTTL is how long a successful check is remembered, so that bcrypt does not run for every request
+const htpasswdCacheTTL = 5 * time.Minute
+
+// htpasswdCacheSweep is the number of cached checks above which expired ones are removed
+const htpasswdCacheSweep = 1024
+
+// Htpasswd verifies user names and passwords against an htpasswd file.
+// Passwords may be hashed with bcrypt ($2y$), Apache MD5 ($apr1$) or SHA1 ({SHA}).
+// Successful checks are cached for a few minutes, keyed by a SHA-256 of the user name and password.
+type Htpasswd struct {
+	users map[string]string
+	now   func() time.Time
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+// LoadHtpasswd reads an htpasswd file
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, err := ParseHtpasswd(f)
+	if err != nil {
+		return nil, fmt.Errorf("htpasswd '%s': %w", path, err)
+	}
+	return h, nil
+}
+
+// ParseHtpasswd parses htpasswd formatted "user:hash" lines. Blank lines and lines starting with '#' are ignored.
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{
+		users:    make(map[string]string),
+		now:      time.Now,
+		verified: make(map[[sha256.Size]byte]time.Time),
+	}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: expected 'user:hash'", n)
+		}
+		if !supportedHash(parts[1]) {
+			return nil, fmt.Errorf("line %d: unsupported hash for user '%s'", n, parts[0])
+		}
+		h.users[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func supportedHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return true
+	case strings.HasPrefix(hash, "$apr1$"):
+		return true
+	case strings.HasPrefix(hash, "{SHA}"):
+		return true
+	}
+	return false
+}
+
+// Verify returns true if the password matches the one stored for the user
+func (h *Htpasswd) Verify(username, password string) bool {
+	hash, ok := h.users[username]
+	if !ok {
+		return false
+	}
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	now := h.now()
+	h.mu.Lock()
+	expires, cached := h.verified[key]
+	h.mu.Unlock()
+	if cached && now.Before(expires) {
+		return true
+	}
+	if !verifyHash(hash, password) {
+		return false
+	}
+	h.mu.Lock()
+	if len(h.verified) >= htpasswdCacheSweep {
+		for k, exp := range h.verified {
+			if !now.Before(exp) {
+				delete(h.verified, k)
+			}
+		}
+	}
+	h.verified[key] = now.Add(htpasswdCacheTTL)
+	h.mu.Unlock()
+	return true
+}
+
+// verifyHash returns true if the password matches the hash
+func verifyHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		return subtle.ConstantTimeCompare([]byte(apr1(password, hash)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 computes the Apache MD5 crypt of the password, using the salt from the existing hash
+func apr1(password, hash string) string {
+	const magic = "$apr1$"
+	salt := strings.TrimPrefix(hash, magic)
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		n := i
+		if n > 16 {
+			n = 16
+		}
+		ctx.Write(alt[:n])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+	out := &strings.Builder{}
+	out.WriteString(magic + salt + "$")
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+	return out.String()
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testHtpasswd(t *testing.T) *Htpasswd {
+	t.Helper()
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := strings.Join([]string{
+		"# users",
+		"",
+		"apr1:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0",
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"bcrypt:" + string(bcryptHash),
+		"bcrypt2y:" + strings.Replace(string(bcryptHash), "$2a$", "$2y$", 1),
+	}, "\n")
+	h, err := ParseHtpasswd(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHtpasswdVerify(t *testing.T) {
+	h := testHtpasswd(t)
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{username: "apr1", password: "secret", want: true},
+		{username: "apr1", password: "Secret", want: false},
+		{username: "sha", password: "secret", want: true},
+		{username: "sha", password: "secret ", want: false},
+		{username: "bcrypt", password: "secret", want: true},
+		{username: "bcrypt", password: "", want: false},
+		{username: "bcrypt2y", password: "secret", want: true},
+		{username: "nobody", password: "secret", want: false},
+		{username: "", password: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username+":"+tt.password, func(t *testing.T) {
+			if got := h.Verify(tt.username, tt.password); got != tt.want {
+				t.Errorf("Verify(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHtpasswdVerifyCache(t *testing.T) {
+	h := testHtpasswd(t)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+	if !h.Verify("bcrypt", "secret") {
+		t.Fatal("Verify failed")
+	}
+	// the hash is not checked again while the result is cached
+	h.users["bcrypt"] = "{SHA}changed"
+	if !h.Verify("bcrypt", "secret") {
+		t.Error("successful check was not cached")
+	}
+	if h.Verify("bcrypt", "other") {
+		t.Error("another password was accepted from the cache")
+	}
+	now = now.Add(htpasswdCacheTTL)
+	if h.Verify("bcrypt", "secret") {
+		t.Error("expired check was still cached")
+	}
+}
+
+func TestParseHtpasswdInvalid(t *testing.T) {
+	tests := []string{
+		"missing-hash",
+		":$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0",
+		"plain:secret",
+		"crypt:rl0uLPH6GMdaQ",
+	}
+	for _, line := range tests {
+		if _, err := ParseHtpasswd(strings.NewReader(line)); err == nil {
+			t.Errorf("ParseHtpasswd(%q) succeeded", line)
+		}
+	}
+}
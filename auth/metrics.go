@@ -0,0 +1,9 @@
+package auth
+
+import "github.com/justenwalker/squiggly/metrics"
+
+var authHandshakes = metrics.NewCounterVec(
+	"squiggly_auth_handshakes_total",
+	"Upstream proxy authentication handshakes by scheme and outcome.",
+	"scheme", "outcome",
+)
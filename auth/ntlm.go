@@ -7,14 +7,17 @@ import (
 	"strings"
 
 	"github.com/Azure/go-ntlmssp"
+	"github.com/justenwalker/squiggly/logging"
 )
 
 type NTLM struct {
 	Credentials
+	Logger *logging.EventLogger
 }
 
 // Authorize a proxy connection using NTLM
 func (n NTLM) Authorize(resp *http.Response, pc ProxyConnection) error {
+	logger := n.Logger.Ctx(connContext(pc)).With(logging.F(logging.KeyUpstream, pc.Proxy().Host))
 	header := &strings.Builder{}
 	negotiateMessage, err := ntlmssp.NewNegotiateMessage(n.Realm, "")
 	if err != nil {
@@ -29,6 +32,7 @@ func (n NTLM) Authorize(resp *http.Response, pc ProxyConnection) error {
 	}
 	header.WriteString(base64.StdEncoding.EncodeToString(negotiateMessage))
 
+	logger.Debug("ntlm negotiate")
 	resp, err = pc.Connect(header.String())
 	if err == nil || resp == nil {
 		return nil
@@ -44,6 +48,7 @@ func (n NTLM) Authorize(resp *http.Response, pc ProxyConnection) error {
 	if len(challengeMessage) == 0 {
 		return fmt.Errorf("NTLM challenge data is blank")
 	}
+	logger.Debug("ntlm challenge received")
 	header = &strings.Builder{}
 	authenticateMessage, err := ntlmssp.ProcessChallenge(challengeMessage, n.Username, n.Password)
 	if err != nil {
@@ -56,5 +61,6 @@ func (n NTLM) Authorize(resp *http.Response, pc ProxyConnection) error {
 		header.WriteString("Negotiate ")
 	}
 	header.WriteString(base64.StdEncoding.EncodeToString(authenticateMessage))
+	logger.Debug("ntlm authenticate")
 	return mustConnect(header.String(), pc)
 }
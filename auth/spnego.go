@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync/atomic"
 
+	"github.com/justenwalker/squiggly/logging"
 	"gopkg.in/jcmturner/gokrb5.v7/gssapi"
 
 	"gopkg.in/jcmturner/gokrb5.v7/client"
@@ -51,10 +52,16 @@ func NewSPNEGO(c Credentials, krbconf string) (*SPNEGO, error) {
 }
 
 func (c *SPNEGO) Authorize(resp *http.Response, pc ProxyConnection) error {
+	return c.authorize(nil, resp, pc)
+}
+
+func (c *SPNEGO) authorize(logger *logging.EventLogger, resp *http.Response, pc ProxyConnection) error {
+	logger = logger.Ctx(connContext(pc)).With(logging.F(logging.KeyUpstream, pc.Proxy().Host))
 	header, err := c.Header(pc.Proxy())
 	if err != nil {
 		return err
 	}
+	logger.Debug("negotiate token acquired")
 	return mustConnect(header, pc)
 }
 
@@ -111,7 +118,7 @@ func (c *SPNEGO) Header(proxy *url.URL) (string, error) {
 }
 
 func getHost(url *url.URL) string {
-	return strings.TrimSuffix(strings.SplitN(url.Host, ":", 2)[0], ".")
+	return strings.TrimSuffix(url.Hostname(), ".")
 }
 
 func getSPN(url *url.URL) string {
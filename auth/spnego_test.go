@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestGetHost(t *testing.T) {
+	tests := []struct {
+		proxy string
+		want  string
+	}{
+		{proxy: "http://proxy.example.com", want: "proxy.example.com"},
+		{proxy: "http://proxy.example.com:8080", want: "proxy.example.com"},
+		{proxy: "http://proxy.example.com.:8080", want: "proxy.example.com"},
+		{proxy: "http://192.0.2.1:3128", want: "192.0.2.1"},
+		{proxy: "http://[2001:db8::1]:8080", want: "2001:db8::1"},
+		{proxy: "https://[2001:db8::1]", want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proxy, func(t *testing.T) {
+			u, err := url.Parse(tt.proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := getHost(u); got != tt.want {
+				t.Errorf("getHost(%q) = %q, want %q", tt.proxy, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/justenwalker/squiggly/admin"
+	"github.com/justenwalker/squiggly/logging"
+	"github.com/justenwalker/squiggly/proxy"
+)
+
+// readAdminToken reads the admin API token from the file, or returns an empty token if there is no file
+func readAdminToken(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read admin token file '%s': %w", path, err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("admin token file '%s' is empty", path)
+	}
+	return token, nil
+}
+
+// controller implements the admin API for the running proxy
+type controller struct {
+	reloader  *reloader
+	listeners *proxyListeners
+	started   time.Time
+}
+
+func (c *controller) Status() admin.Status {
+	inst := c.reloader.instance()
+	return admin.Status{
+		PID:     os.Getpid(),
+		Started: c.started,
+		Config: admin.Config{
+			File:        inst.config,
+			Listen:      listenerStrings(c.listeners.http),
+			SOCKS:       listenerStrings(c.listeners.socks),
+			Transparent: listenerStrings(c.listeners.transparent),
+			Admin:       listenerStrings(c.listeners.admin),
+			Service:     inst.auth.service,
+			User:        inst.auth.username,
+			Realm:       inst.auth.realm,
+			Krb5Conf:    inst.auth.krb5conf,
+		},
+		Routing: inst.router.Status(),
+	}
+}
+
+func (c *controller) Upstreams() []proxy.UpstreamStatus {
+	return c.reloader.instance().server.Upstreams()
+}
+
+func (c *controller) Throughput() proxy.ThroughputStatus {
+	return c.reloader.instance().server.Throughput()
+}
+
+func (c *controller) RefreshPAC() error {
+	return c.reloader.instance().router.RefreshPAC()
+}
+
+func (c *controller) SetMode(mode proxy.Mode, arg string) error {
+	inst := c.reloader.instance()
+	if err := inst.router.SetMode(mode, arg); err != nil {
+		return err
+	}
+	inst.logger.Info("routing mode changed", logging.F("mode", mode))
+	return nil
+}
+
+func (c *controller) ReloadCredentials() error {
+	inst := c.reloader.instance()
+	pauth, err := loadProxyAuth(inst.logger, inst.auth)
+	if err != nil {
+		return err
+	}
+	inst.server.SetProxyAuth(pauth)
+	return nil
+}
+
+func (c *controller) Reload() error {
+	return c.reloader.Reload()
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadAdminToken(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	if token, err := readAdminToken(""); err != nil || token != "" {
+		t.Errorf("readAdminToken(\"\") = %q, %v", token, err)
+	}
+	if token, err := readAdminToken(write("token", "s3cret\n")); err != nil || token != "s3cret" {
+		t.Errorf("readAdminToken = %q, %v, want s3cret", token, err)
+	}
+	if _, err := readAdminToken(write("empty", " \n")); err == nil {
+		t.Error("readAdminToken accepted an empty file")
+	}
+	if _, err := readAdminToken(filepath.Join(dir, "missing")); err == nil {
+		t.Error("readAdminToken accepted a missing file")
+	}
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/justenwalker/squiggly/mitm"
+	"github.com/spf13/cobra"
+)
+
+var (
+	caDir    string
+	caForce  bool
+	caOutput string
+)
+
+// caCmd represents the ca command
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manage the local CA used for TLS interception",
+}
+
+var caInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Generate the local CA",
+	Long:  `Generates a local CA used to sign certificates for the hosts given to 'squiggly proxy --intercept'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, err := resolveCADir(caDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ca, err := mitm.InitCA(dir, caForce)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Created CA '%s' in %s\n", ca.Cert.Subject.CommonName, dir)
+		fmt.Println("Run 'squiggly ca export' and add the certificate to your trust store")
+	},
+}
+
+var caExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Print the local CA certificate in PEM format",
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, err := resolveCADir(caDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ca, err := mitm.LoadCA(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if caOutput == "" {
+			os.Stdout.Write(ca.CertPEM())
+			return
+		}
+		if err := ioutil.WriteFile(caOutput, ca.CertPEM(), 0644); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(caCmd)
+	caCmd.AddCommand(caInitCmd)
+	caCmd.AddCommand(caExportCmd)
+	caCmd.PersistentFlags().StringVar(&caDir, "dir", "", "directory the CA is stored in (default is the user config directory)")
+	caInitCmd.Flags().BoolVarP(&caForce, "force", "f", false, "replace an existing CA")
+	caExportCmd.Flags().StringVarP(&caOutput, "output", "o", "", "write the certificate to a file instead of stdout")
+}
+
+// resolveCADir returns the CA directory given, or the default directory if it is empty
+func resolveCADir(dir string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	return mitm.DefaultDir()
+}
@@ -0,0 +1,408 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/justenwalker/squiggly/admin"
+	"github.com/justenwalker/squiggly/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	lockFileName   = "squiggly.lock"
+	socketFileName = "squiggly.sock"
+	logFileName    = "squiggly.log"
+	argsFileName   = "squiggly.args"
+
+	// startTimeout allows for fetching the PAC file before the proxy starts listening
+	startTimeout = time.Minute
+	stopTimeout  = 10 * time.Second
+)
+
+var (
+	stateDir string
+	logFile  string
+)
+
+// errNotRunning is returned when there is no background proxy
+var errNotRunning = errors.New("squiggly is not running")
+
+var startCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Start the proxy server in the background",
+	Long: `Starts the proxy server in the background, with the same flags and config file as 'squiggly proxy'.
+Its output is written to the log file. Only one background proxy runs for each state directory.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := startDaemon(cmd, ""); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var stopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the proxy server running in the background",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := stopDaemon(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var restartCmd = &cobra.Command{
+	Use:   "restart",
+	Short: "Restart the proxy server running in the background",
+	Long: `Stops the background proxy server, if it is running, and starts it again with the flags given to restart.
+Without any flags other than --state-dir, it is started again with the flags it was last started with.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, err := resolveStateDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		workDir, err := restartArgs(cmd.Flags(), dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := stopDaemon(); err != nil {
+			log.Fatal(err)
+		}
+		if err := startDaemon(cmd, workDir); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the status of the proxy server running in the background",
+	Long:  `Shows the status of the background proxy server, from its admin API. Exits with status 3 if it is not running.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := daemonStatus()
+		if errors.Is(err, errNotRunning) {
+			fmt.Println(err)
+			os.Exit(3)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(startCmd, stopCmd, restartCmd, statusCmd)
+	for _, c := range []*cobra.Command{startCmd, stopCmd, restartCmd, statusCmd} {
+		c.Flags().StringVar(&stateDir, "state-dir", "", "directory of the lock file and admin socket of the background proxy (default is $XDG_STATE_HOME/squiggly)")
+	}
+	for _, c := range []*cobra.Command{startCmd, restartCmd} {
+		c.Flags().StringVar(&logFile, "log-file", "", "file the background proxy writes its log to (default is squiggly.log in the state directory)")
+		proxyFlags(c.Flags(), opts)
+	}
+}
+
+// resolveStateDir returns the state directory, $XDG_STATE_HOME/squiggly or ~/.local/state/squiggly by default
+func resolveStateDir() (string, error) {
+	if stateDir != "" {
+		return filepath.Abs(stateDir)
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "squiggly"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "squiggly"), nil
+}
+
+// lockDaemon locks the state directory for the running proxy, and records its pid in the lock file.
+// The lock is held until the process exits, so it can not be left behind by a crash.
+func lockDaemon(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := lockFile(filepath.Join(dir, lockFileName))
+	if errors.Is(err, errLocked) {
+		pid, _ := readPID(dir)
+		return nil, fmt.Errorf("squiggly is already running (pid %d)", pid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// daemonSocket returns the admin API address served by the background proxy
+func daemonSocket(dir string) string {
+	return "unix://" + filepath.Join(dir, socketFileName)
+}
+
+// runningPID returns the pid of the background proxy, or errNotRunning
+func runningPID(dir string) (int, error) {
+	locked, err := isLocked(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, errNotRunning
+	}
+	return readPID(dir)
+}
+
+func readPID(dir string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid lock file '%s': %w", filepath.Join(dir, lockFileName), err)
+	}
+	return pid, nil
+}
+
+// daemonArgs are the flags the background proxy was started with, and the directory it was started from,
+// which relative paths in the flags are resolved against. They are saved in the state directory for restart.
+type daemonArgs struct {
+	Dir  string      `json:"dir"`
+	Args config.Args `json:"args"`
+}
+
+func readDaemonArgs(dir string) (*daemonArgs, error) {
+	path := filepath.Join(dir, argsFileName)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var saved daemonArgs
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("invalid arguments file '%s': %w", path, err)
+	}
+	return &saved, nil
+}
+
+func writeDaemonArgs(dir string, saved *daemonArgs) error {
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, argsFileName), b, 0600)
+}
+
+// restartArgs sets the flags the background proxy was last started with, if none were given other than --state-dir,
+// and returns the directory it was started from. The directory is empty if the flags were given.
+func restartArgs(fs *pflag.FlagSet, dir string) (string, error) {
+	given := config.CommandLine(fs)
+	delete(given, "state-dir")
+	if len(given) > 0 {
+		return "", nil
+	}
+	saved, err := readDaemonArgs(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return saved.Dir, saved.Args.Set(fs)
+}
+
+// startDaemon starts 'squiggly proxy' in a new session, detached from the terminal, and waits until it serves the admin API.
+// It is started in workDir, or the current directory if workDir is empty.
+func startDaemon(cmd *cobra.Command, workDir string) error {
+	dir, err := resolveStateDir()
+	if err != nil {
+		return err
+	}
+	if pid, err := runningPID(dir); err == nil {
+		return fmt.Errorf("squiggly is already running (pid %d)", pid)
+	} else if !errors.Is(err, errNotRunning) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if workDir == "" {
+		if workDir, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	logPath := logFile
+	if logPath == "" {
+		logPath = filepath.Join(dir, logFileName)
+	} else if !filepath.IsAbs(logPath) {
+		logPath = filepath.Join(workDir, logPath)
+	}
+	out, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("could not open log file '%s': %w", logPath, err)
+	}
+	defer out.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := config.CommandLine(cmd.Flags())
+	delete(args, "state-dir")
+	saved := &daemonArgs{Dir: workDir, Args: make(config.Args, len(args))}
+	for name, values := range args {
+		saved.Args[name] = values
+	}
+	delete(args, "log-file")
+	proc := exec.Command(exe, append([]string{"proxy", "--state-dir", dir}, args.Strings()...)...)
+	proc.Dir = workDir
+	proc.Stdout, proc.Stderr = out, out
+	proc.SysProcAttr = detachedProcess()
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- proc.Wait()
+	}()
+	client := adminClient(dir)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(startTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("squiggly exited while starting (%v), see %s", err, logPath)
+		case <-timeout:
+			return fmt.Errorf("squiggly did not start within %s, see %s", startTimeout, logPath)
+		case <-ticker.C:
+			st, err := getStatus(client)
+			if err != nil {
+				continue
+			}
+			fmt.Printf("squiggly started (pid %d), logging to %s\n", st.PID, logPath)
+			return writeDaemonArgs(dir, saved)
+		}
+	}
+}
+
+// stopDaemon stops the background proxy, if it is running, and waits for it to exit
+func stopDaemon() error {
+	dir, err := resolveStateDir()
+	if err != nil {
+		return err
+	}
+	pid, err := runningPID(dir)
+	if errors.Is(err, errNotRunning) {
+		fmt.Println(err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		return fmt.Errorf("could not stop squiggly (pid %d): %w", pid, err)
+	}
+	for deadline := time.Now().Add(stopTimeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if _, err := runningPID(dir); errors.Is(err, errNotRunning) {
+			fmt.Printf("squiggly stopped (pid %d)\n", pid)
+			return nil
+		}
+	}
+	return fmt.Errorf("squiggly (pid %d) did not stop within %s", pid, stopTimeout)
+}
+
+// daemonStatus prints the status reported by the admin API of the background proxy
+func daemonStatus() error {
+	dir, err := resolveStateDir()
+	if err != nil {
+		return err
+	}
+	pid, err := runningPID(dir)
+	if err != nil {
+		return err
+	}
+	st, err := getStatus(adminClient(dir))
+	if err != nil {
+		return fmt.Errorf("squiggly is running (pid %d), but its admin API did not respond: %w", pid, err)
+	}
+	fmt.Printf("squiggly is running (pid %d, up %s)\n", st.PID, time.Since(st.Started).Round(time.Second))
+	if st.Config.File != "" {
+		fmt.Printf("config:   %s\n", st.Config.File)
+	}
+	fmt.Printf("listen:   %s\n", strings.Join(st.Config.Listen, ", "))
+	if len(st.Config.SOCKS) > 0 {
+		fmt.Printf("socks:    %s\n", strings.Join(st.Config.SOCKS, ", "))
+	}
+	if len(st.Config.Transparent) > 0 {
+		fmt.Printf("transparent: %s\n", strings.Join(st.Config.Transparent, ", "))
+	}
+	fmt.Printf("admin:    %s\n", strings.Join(st.Config.Admin, ", "))
+	routing := string(st.Routing.Mode)
+	switch {
+	case st.Routing.PAC != nil:
+		routing += " " + st.Routing.PAC.URL
+		if st.Routing.PAC.LastError != "" {
+			routing += " (error: " + st.Routing.PAC.LastError + ")"
+		}
+	case st.Routing.Proxy != "":
+		routing += " " + st.Routing.Proxy
+	}
+	fmt.Printf("routing:  %s\n", routing)
+	if st.Config.User != "" {
+		fmt.Printf("user:     %s\n", st.Config.User)
+	}
+	return nil
+}
+
+// adminClient returns a client of the admin API of the background proxy, which is served on a unix socket in the state directory
+func adminClient(dir string) *http.Client {
+	socket := filepath.Join(dir, socketFileName)
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Proxy: nil,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+func getStatus(client *http.Client) (*admin.Status, error) {
+	resp, err := client.Get("http://squiggly/api/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	var st admin.Status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/justenwalker/squiggly/config"
+	"github.com/spf13/pflag"
+)
+
+func TestRestartArgs(t *testing.T) {
+	dir := t.TempDir()
+	saved := &daemonArgs{Dir: "/work", Args: config.Args{"listen": {":8080", ":8081"}, "log-file": {"proxy.log"}}}
+	if err := writeDaemonArgs(dir, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		workDir string
+		listen  []string
+		logFile string
+	}{
+		{"no flags", nil, "/work", []string{":8080", ":8081"}, "proxy.log"},
+		{"only the state directory", []string{"--state-dir", dir}, "/work", []string{":8080", ":8081"}, "proxy.log"},
+		{"flags given", []string{"--listen", ":9090"}, "", []string{":9090"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stateDir, logFile string
+			var listen []string
+			fs := pflag.NewFlagSet("restart", pflag.ContinueOnError)
+			fs.StringVar(&stateDir, "state-dir", "", "")
+			fs.StringVar(&logFile, "log-file", "", "")
+			fs.StringSliceVar(&listen, "listen", nil, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			workDir, err := restartArgs(fs, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if workDir != tt.workDir {
+				t.Errorf("work dir = %q, want %q", workDir, tt.workDir)
+			}
+			if !reflect.DeepEqual(listen, tt.listen) || logFile != tt.logFile {
+				t.Errorf("listen = %q, log file = %q, want %q, %q", listen, logFile, tt.listen, tt.logFile)
+			}
+		})
+	}
+
+	t.Run("never started", func(t *testing.T) {
+		fs := pflag.NewFlagSet("restart", pflag.ContinueOnError)
+		workDir, err := restartArgs(fs, t.TempDir())
+		if err != nil || workDir != "" {
+			t.Errorf("restartArgs = %q, %v, want no saved flags", workDir, err)
+		}
+	})
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockDaemon(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	if _, err := runningPID(dir); !errors.Is(err, errNotRunning) {
+		t.Fatalf("runningPID before lock = %v, want errNotRunning", err)
+	}
+	f, err := lockDaemon(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := runningPID(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("pid = %d, want %d", pid, os.Getpid())
+	}
+
+	// Locks are held by the open file, so a second open in the same process is refused
+	if _, err := lockFile(filepath.Join(dir, lockFileName)); !errors.Is(err, errLocked) {
+		t.Errorf("second lockFile = %v, want errLocked", err)
+	}
+	if _, err := lockDaemon(dir); err == nil {
+		t.Error("second lockDaemon succeeded")
+	}
+
+	f.Close()
+	if locked, err := isLocked(filepath.Join(dir, lockFileName)); err != nil || locked {
+		t.Errorf("isLocked after unlock = %v, %v", locked, err)
+	}
+	if _, err := runningPID(dir); !errors.Is(err, errNotRunning) {
+		t.Errorf("runningPID after unlock = %v, want errNotRunning", err)
+	}
+}
@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errLocked = errors.New("locked")
+
+var errDaemonUnsupported = errors.New("running in the background is not supported on windows, use 'squiggly proxy'")
+
+func lockFile(path string) (*os.File, error) {
+	return nil, errDaemonUnsupported
+}
+
+func isLocked(path string) (bool, error) {
+	return false, errDaemonUnsupported
+}
+
+func detachedProcess() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/justenwalker/squiggly/listener"
+	"github.com/justenwalker/squiggly/pac"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	envShell string
+	envUnset bool
+)
+
+// proxyEnvNames are the environment variables set by 'squiggly env'
+var proxyEnvNames = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "ALL_PROXY"}
+
+// envFlags are the proxy flags used by 'squiggly env'
+var envFlags = []string{"address", "listen", "socks", "bypass", "proxy", "pac", "pac-timeout", "pac-dial-timeout"}
+
+var envCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Print the commands that point the shell at the proxy",
+	Long: `Prints the commands setting HTTP_PROXY, HTTPS_PROXY and NO_PROXY for the listen address of the proxy,
+and ALL_PROXY when a SOCKS5 listener is configured. It reads the same flags and config file as 'squiggly proxy'.
+NO_PROXY holds the loopback addresses, the host name, the --bypass hosts and the hosts the PAC file connects to directly.
+
+  eval "$(squiggly env)"                          # bash, zsh
+  squiggly env --shell fish | source              # fish
+  squiggly env --shell powershell | Invoke-Expression`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runEnv(cmd, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(envCmd)
+	envCmd.Flags().StringVar(&envShell, "shell", "", "shell syntax to print: bash, zsh, fish, powershell or json (default is the shell in $SHELL)")
+	envCmd.Flags().BoolVar(&envUnset, "unset", false, "print the commands that remove the proxy environment variables")
+	flags := pflag.NewFlagSet("proxy", pflag.ContinueOnError)
+	proxyFlags(flags, opts)
+	for _, name := range envFlags {
+		envCmd.Flags().AddFlag(flags.Lookup(name))
+	}
+}
+
+// envVar is an environment variable
+type envVar struct {
+	name  string
+	value string
+}
+
+func runEnv(cmd *cobra.Command, w io.Writer) error {
+	shell := envShell
+	if shell == "" {
+		shell = defaultShell()
+	}
+	if envUnset {
+		return printUnset(w, shell)
+	}
+	if _, err := loadConfig(cmd.Flags()); err != nil {
+		return err
+	}
+	httpAddr, socksAddr, err := opts.clientAddresses()
+	if err != nil {
+		return err
+	}
+	var p *pac.PAC
+	if opts.proxyURL == "" && opts.pacURL != "" {
+		p = &pac.PAC{URL: opts.pacURL, DialTimeout: opts.pacDialTimeout, FetchTimeout: opts.pacFetchTimeout}
+		if _, err := p.Refresh(); err != nil {
+			log.Printf("unable to load PAC '%s', NO_PROXY does not include its DIRECT rules: %v", opts.pacURL, err)
+		}
+	}
+	return printEnv(w, shell, proxyEnv(httpAddr, socksAddr, opts.noProxy(p)))
+}
+
+// defaultShell returns the name of the shell in $SHELL, or powershell on windows
+func defaultShell() string {
+	if runtime.GOOS == "windows" {
+		return "powershell"
+	}
+	if sh := filepath.Base(os.Getenv("SHELL")); sh == "fish" || sh == "zsh" {
+		return sh
+	}
+	return "bash"
+}
+
+// clientAddresses returns the host:port clients connect to for the HTTP proxy, and for the SOCKS5 server if there is one
+func (o *proxyOptions) clientAddresses() (httpAddr, socksAddr string, err error) {
+	specs := o.listen
+	if len(specs) == 0 {
+		specs = []string{o.address}
+	}
+	if httpAddr = clientAddress(specs); httpAddr == "" {
+		return "", "", fmt.Errorf("no TCP listen address in %v", specs)
+	}
+	return httpAddr, clientAddress(o.socks), nil
+}
+
+// clientAddress returns the address clients connect to for the first TCP listen spec, or an empty string.
+// Wildcard addresses are replaced by localhost.
+func clientAddress(specs []string) string {
+	for _, spec := range specs {
+		network, addr, err := listener.Parse(spec)
+		if err != nil || !strings.HasPrefix(network, "tcp") {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "localhost"
+		}
+		return net.JoinHostPort(host, port)
+	}
+	return ""
+}
+
+// proxyEnv returns the proxy environment variables for the HTTP proxy, and the SOCKS5 server if socksAddr is not empty
+func proxyEnv(httpAddr, socksAddr string, noProxy []string) []envVar {
+	env := []envVar{
+		{name: "HTTP_PROXY", value: "http://" + httpAddr},
+		{name: "HTTPS_PROXY", value: "http://" + httpAddr},
+		{name: "NO_PROXY", value: strings.Join(noProxy, ",")},
+	}
+	if socksAddr != "" {
+		env = append(env, envVar{name: "ALL_PROXY", value: "socks5h://" + socksAddr})
+	}
+	return env
+}
+
+// noProxy returns the hosts that clients should connect to directly: the loopback addresses, the host name,
+// the --bypass hosts, and the DIRECT rules of the PAC file or the NO_PROXY environment variable that the proxy routes with
+func (o *proxyOptions) noProxy(p *pac.PAC) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		hosts = append(hosts, name)
+	}
+	for _, b := range o.bypass {
+		if strings.HasPrefix(b, "*.") {
+			b = b[1:]
+		}
+		if !strings.ContainsAny(b, "*?[") {
+			hosts = append(hosts, b)
+		}
+	}
+	switch {
+	case o.proxyURL != "":
+	case p != nil:
+		hosts = append(hosts, p.DirectHosts()...)
+	default:
+		env := os.Getenv("NO_PROXY")
+		if env == "" {
+			env = os.Getenv("no_proxy")
+		}
+		for _, h := range strings.Split(env, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	unique := hosts[:0]
+	for _, h := range hosts {
+		if !seen[h] {
+			seen[h] = true
+			unique = append(unique, h)
+		}
+	}
+	return unique
+}
+
+// withLowercase adds the lower case variant of every variable, which some programs read instead
+func withLowercase(env []envVar) []envVar {
+	all := make([]envVar, 0, 2*len(env))
+	for _, v := range env {
+		all = append(all, v, envVar{name: strings.ToLower(v.name), value: v.value})
+	}
+	return all
+}
+
+func printEnv(w io.Writer, shell string, env []envVar) error {
+	switch shell {
+	case "bash", "zsh", "sh":
+		for _, v := range withLowercase(env) {
+			fmt.Fprintf(w, "export %s='%s'\n", v.name, strings.ReplaceAll(v.value, "'", `'\''`))
+		}
+	case "fish":
+		for _, v := range withLowercase(env) {
+			fmt.Fprintf(w, "set -gx %s '%s'\n", v.name, strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(v.value))
+		}
+	case "powershell", "pwsh":
+		for _, v := range env {
+			fmt.Fprintf(w, "$env:%s = '%s'\n", v.name, strings.ReplaceAll(v.value, "'", "''"))
+		}
+	case "json":
+		vars := make(map[string]string, len(env))
+		for _, v := range env {
+			vars[v.name] = v.value
+		}
+		return printJSON(w, vars)
+	default:
+		return fmt.Errorf("unknown shell '%s', must be one of bash, zsh, fish, powershell or json", shell)
+	}
+	return nil
+}
+
+func printUnset(w io.Writer, shell string) error {
+	var env []envVar
+	for _, name := range proxyEnvNames {
+		env = append(env, envVar{name: name})
+	}
+	switch shell {
+	case "bash", "zsh", "sh":
+		var names []string
+		for _, v := range withLowercase(env) {
+			names = append(names, v.name)
+		}
+		fmt.Fprintf(w, "unset %s\n", strings.Join(names, " "))
+	case "fish":
+		for _, v := range withLowercase(env) {
+			fmt.Fprintf(w, "set -e %s\n", v.name)
+		}
+	case "powershell", "pwsh":
+		for _, v := range env {
+			fmt.Fprintf(w, "Remove-Item Env:%s -ErrorAction SilentlyContinue\n", v.name)
+		}
+	case "json":
+		vars := make(map[string]*string, len(env))
+		for _, v := range env {
+			vars[v.name] = nil
+		}
+		return printJSON(w, vars)
+	default:
+		return fmt.Errorf("unknown shell '%s', must be one of bash, zsh, fish, powershell or json", shell)
+	}
+	return nil
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
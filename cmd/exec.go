@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/justenwalker/squiggly/logging"
+	"github.com/spf13/cobra"
+)
+
+// execLogLevel is the default log level of 'squiggly exec', which shares the terminal with the command
+const execLogLevel = "warn"
+
+var execCmd = &cobra.Command{
+	Use:   "exec [flags] -- command [args...]",
+	Short: "Run a command behind a proxy server that lives as long as the command",
+	Long: `Starts the proxy server on a random loopback port, and runs the command with HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+pointing at it. It reads the same flags, config file and credentials as 'squiggly proxy', except for the listeners,
+and the client access and interception settings, which are meant for other clients.
+SIGTERM and SIGHUP are passed on to the command. Ctrl-C already reaches the command from the terminal, so squiggly
+only ignores it. squiggly exits with the exit code of the command once the proxy is shut down.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		code, err := runExec(cmd, args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(code)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(execCmd)
+	proxyFlags(execCmd.Flags(), opts)
+	// Flags after the command name belong to the command
+	execCmd.Flags().SetInterspersed(false)
+	execCmd.Flags().Lookup("log-level").DefValue = execLogLevel
+	for _, name := range []string{"address", "listen", "socks", "transparent", "admin", "allow", "deny", "htpasswd", "intercept"} {
+		execCmd.Flags().MarkHidden(name)
+	}
+}
+
+// runExec runs the command behind an ephemeral proxy, and returns its exit code
+func runExec(cmd *cobra.Command, args []string) (int, error) {
+	if !cmd.Flags().Changed("log-level") {
+		opts.logLevel = execLogLevel
+	}
+	configPath, err := loadConfig(cmd.Flags())
+	if err != nil {
+		return 0, err
+	}
+	ignored := opts.dropClientSettings()
+	inst, err := newInstance(opts, cmd.Flags(), configPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer inst.close()
+	if len(ignored) > 0 {
+		inst.logger.Debug("ignoring client settings", logging.F("settings", strings.Join(ignored, ",")))
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	srv := &http.Server{
+		Handler: inst.server,
+	}
+	defer srv.Close()
+	go func() {
+		if err := srv.Serve(l); !isClosed(err) {
+			inst.logger.Error("proxy server failed", logging.Err(err))
+		}
+	}()
+	inst.logger.Debug("listening", logging.F("listener", "http"), logging.F("address", l.Addr().String()))
+
+	child := exec.Command(args[0], args[1:]...)
+	child.Stdin, child.Stdout, child.Stderr = os.Stdin, os.Stdout, os.Stderr
+	child.Env = childEnv(os.Environ(), proxyEnv(l.Addr().String(), "", opts.noProxy(inst.router.PAC())))
+
+	// Pass signals on to the command, and leave it to decide when to exit.
+	// The terminal sends SIGINT to the whole foreground process group, the command included,
+	// so it is caught to keep the proxy running for the command, but not sent a second time.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	if err := child.Start(); err != nil {
+		return 0, err
+	}
+	go func() {
+		for s := range sig {
+			_ = child.Process.Signal(s)
+		}
+	}()
+	err = child.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitCode(exitErr.ProcessState), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("running '%s': %w", args[0], err)
+	}
+	return 0, nil
+}
+
+// dropClientSettings clears the client access and interception settings, and returns the flags that were set.
+// The command is the only client of the loopback listener: it has no credentials to send,
+// and does not trust the squiggly CA.
+func (o *proxyOptions) dropClientSettings() []string {
+	var ignored []string
+	if len(o.allow) > 0 {
+		ignored, o.allow = append(ignored, "allow"), nil
+	}
+	if len(o.deny) > 0 {
+		ignored, o.deny = append(ignored, "deny"), nil
+	}
+	if o.htpasswd != "" {
+		ignored, o.htpasswd = append(ignored, "htpasswd"), ""
+	}
+	if len(o.intercept) > 0 {
+		ignored, o.intercept = append(ignored, "intercept"), nil
+	}
+	return ignored
+}
+
+// childEnv replaces the proxy variables of the environment, in either case, with the variables given
+func childEnv(environ []string, proxy []envVar) []string {
+	env := make([]string, 0, len(environ)+2*len(proxy))
+	for _, kv := range environ {
+		name := strings.ToUpper(strings.SplitN(kv, "=", 2)[0])
+		replaced := false
+		for _, p := range proxyEnvNames {
+			replaced = replaced || name == p
+		}
+		if !replaced {
+			env = append(env, kv)
+		}
+	}
+	for _, v := range withLowercase(proxy) {
+		env = append(env, v.name+"="+v.value)
+	}
+	return env
+}
+
+// exitCode returns the exit code of the process, or 128 plus the signal that killed it, as shells do
+func exitCode(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"os/exec"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestChildEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"http_proxy=http://old:3128",
+		"Https_Proxy=http://old:3128",
+		"NO_PROXY=old.example.com",
+		"all_proxy=socks5h://old:1080",
+		"PROXY_USER=me",
+	}
+	env := childEnv(environ, proxyEnv("127.0.0.1:8800", "", []string{"localhost", "127.0.0.1"}))
+	sort.Strings(env)
+	want := []string{
+		"HTTPS_PROXY=http://127.0.0.1:8800",
+		"HTTP_PROXY=http://127.0.0.1:8800",
+		"NO_PROXY=localhost,127.0.0.1",
+		"PATH=/usr/bin",
+		"PROXY_USER=me",
+		"http_proxy=http://127.0.0.1:8800",
+		"https_proxy=http://127.0.0.1:8800",
+		"no_proxy=localhost,127.0.0.1",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("childEnv =\n%q\nwant\n%q", env, want)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		code   int
+	}{
+		{"success", "exit 0", 0},
+		{"failure", "exit 3", 3},
+		{"killed", "kill -TERM $$", 128 + 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command("/bin/sh", "-c", tt.script)
+			_ = cmd.Run()
+			if code := exitCode(cmd.ProcessState); code != tt.code {
+				t.Errorf("exit code = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestDropClientSettings(t *testing.T) {
+	o := &proxyOptions{
+		allow:     []string{"10.0.0.0/8"},
+		htpasswd:  "/etc/squiggly/htpasswd",
+		intercept: []string{"api.example.com"},
+		proxyURL:  "http://proxy.example.com:8080",
+	}
+	ignored := o.dropClientSettings()
+	if want := []string{"allow", "htpasswd", "intercept"}; !reflect.DeepEqual(ignored, want) {
+		t.Errorf("dropClientSettings() = %v, want %v", ignored, want)
+	}
+	if o.allow != nil || o.htpasswd != "" || o.intercept != nil {
+		t.Errorf("client settings were kept: %+v", o)
+	}
+	if o.proxyURL != "http://proxy.example.com:8080" {
+		t.Errorf("proxyURL = %q, want it kept", o.proxyURL)
+	}
+}
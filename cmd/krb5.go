@@ -29,5 +29,5 @@ var krb5confCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(krb5confCmd)
-	krb5confCmd.Flags().StringVarP(&krb5confRealm, "realm", "r", realm, "kerberos realm")
+	krb5confCmd.Flags().StringVarP(&krb5confRealm, "realm", "r", "", "kerberos realm")
 }
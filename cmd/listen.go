@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/justenwalker/squiggly/listener"
+	"github.com/justenwalker/squiggly/logging"
+	"github.com/justenwalker/squiggly/proxy"
+)
+
+// FileDescriptorName= values that mark systemd sockets as SOCKS5 or transparent listeners
+const (
+	systemdSOCKSName       = "socks"
+	systemdTransparentName = "transparent"
+)
+
+// proxyListeners are the listeners served by the proxy command
+type proxyListeners struct {
+	http        []net.Listener
+	socks       []net.Listener
+	transparent []net.Listener
+	admin       []net.Listener
+}
+
+// openListeners opens every --listen, --socks, --transparent and --admin address, and the extra admin addresses,
+// and adopts systemd activated sockets. The --address flag is only used if no HTTP listeners are given any other way.
+func (o *proxyOptions) openListeners(extraAdmin ...string) (*proxyListeners, error) {
+	activated, err := listener.Systemd()
+	if err != nil {
+		return nil, err
+	}
+	ls := &proxyListeners{}
+	for _, a := range activated {
+		switch a.Name {
+		case systemdSOCKSName:
+			ls.socks = append(ls.socks, a.Listener)
+		case systemdTransparentName:
+			ls.transparent = append(ls.transparent, a.Listener)
+		default:
+			ls.http = append(ls.http, a.Listener)
+		}
+	}
+	specs := o.listen
+	if len(specs) == 0 && len(ls.http) == 0 {
+		specs = []string{o.address}
+	}
+	if ls.http, err = listenAll(ls.http, specs); err != nil {
+		ls.Close()
+		return nil, err
+	}
+	if ls.socks, err = listenAll(ls.socks, o.socks); err != nil {
+		ls.Close()
+		return nil, err
+	}
+	if ls.transparent, err = listenAll(ls.transparent, o.tproxy); err != nil {
+		ls.Close()
+		return nil, err
+	}
+	if ls.admin, err = listenAll(ls.admin, append(o.adminAddress[:len(o.adminAddress):len(o.adminAddress)], extraAdmin...)); err != nil {
+		ls.Close()
+		return nil, err
+	}
+	return ls, nil
+}
+
+func listenAll(listeners []net.Listener, specs []string) ([]net.Listener, error) {
+	for _, spec := range specs {
+		l, err := listener.Listen(spec)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// checkLoopback returns an error if a TCP listener is not bound to a loopback address.
+// The admin API must only be reachable from this host unless it requires a token.
+func checkLoopback(listeners []net.Listener) error {
+	for _, l := range listeners {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+			return fmt.Errorf("admin address '%s' is not a loopback address; use --admin-token-file to require a token", listener.String(l))
+		}
+	}
+	return nil
+}
+
+// Close all listeners
+func (ls *proxyListeners) Close() {
+	for _, l := range ls.http {
+		l.Close()
+	}
+	for _, l := range ls.socks {
+		l.Close()
+	}
+	for _, l := range ls.transparent {
+		l.Close()
+	}
+	for _, l := range ls.admin {
+		l.Close()
+	}
+}
+
+// Serve all listeners until one of them fails or all of them are closed.
+func (ls *proxyListeners) Serve(srv *http.Server, adminSrv *http.Server, prx *proxy.Reloadable, logger *logging.EventLogger) error {
+	n := len(ls.http) + len(ls.socks) + len(ls.transparent) + len(ls.admin)
+	errs := make(chan error, n)
+	for _, l := range ls.http {
+		logger.Info("listening", logging.F("listener", "http"), logging.F("address", listener.String(l)))
+		go func(l net.Listener) {
+			errs <- srv.Serve(l)
+		}(l)
+	}
+	for _, l := range ls.socks {
+		logger.Info("listening", logging.F("listener", "socks5"), logging.F("address", listener.String(l)))
+		go func(l net.Listener) {
+			errs <- prx.ServeSOCKS(l)
+		}(l)
+	}
+	for _, l := range ls.transparent {
+		logger.Info("listening", logging.F("listener", "transparent"), logging.F("address", listener.String(l)))
+		go func(l net.Listener) {
+			errs <- prx.ServeTransparent(l)
+		}(l)
+	}
+	for _, l := range ls.admin {
+		logger.Info("listening", logging.F("listener", "admin"), logging.F("address", listener.String(l)))
+		go func(l net.Listener) {
+			errs <- adminSrv.Serve(l)
+		}(l)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; !isClosed(err) {
+			srv.Close()
+			adminSrv.Close()
+			ls.Close()
+			return err
+		}
+	}
+	return http.ErrServerClosed
+}
+
+func isClosed(err error) bool {
+	return errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed)
+}
+
+func listenerStrings(listeners []net.Listener) []string {
+	specs := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		specs = append(specs, listener.String(l))
+	}
+	return specs
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckLoopback(t *testing.T) {
+	listen := func(network, addr string) net.Listener {
+		t.Helper()
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			t.Skipf("listen %s %s: %v", network, addr, err)
+		}
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+	tests := []struct {
+		name    string
+		network string
+		addr    string
+		ok      bool
+	}{
+		{name: "ipv4 loopback", network: "tcp", addr: "127.0.0.1:0", ok: true},
+		{name: "ipv6 loopback", network: "tcp", addr: "[::1]:0", ok: true},
+		{name: "unix", network: "unix", addr: filepath.Join(t.TempDir(), "admin.sock"), ok: true},
+		{name: "unspecified", network: "tcp", addr: ":0", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkLoopback([]net.Listener{listen(tt.network, tt.addr)})
+			if tt.ok && err != nil {
+				t.Errorf("checkLoopback: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("checkLoopback accepted a non-loopback address")
+			}
+		})
+	}
+}
@@ -1,19 +1,29 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"github.com/justenwalker/squiggly/pac"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/justenwalker/squiggly/admin"
 	"github.com/justenwalker/squiggly/auth"
+	"github.com/justenwalker/squiggly/config"
 
 	"github.com/justenwalker/squiggly/logging"
+	"github.com/justenwalker/squiggly/mitm"
+	"github.com/justenwalker/squiggly/pac"
 	"github.com/justenwalker/squiggly/proxy"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 const (
@@ -21,17 +31,69 @@ const (
 	defaultAddress = "localhost:8800"
 )
 
-var (
-	service  string
-	username string
-	password string
-	realm    string
-	krb5conf string
-	pacURL   string
-	proxyURL string
-	address  string
-	verbose  bool
-)
+// proxyOptions are the values of the proxy flags. The command line is parsed into opts,
+// and a reload parses the command line and the config file again into options of its own.
+type proxyOptions struct {
+	service   string
+	username  string
+	realm     string
+	krb5conf  string
+	pacURL    string
+	proxyURL  string
+	bypass    []string
+	address   string
+	listen    []string
+	socks     []string
+	tproxy    []string
+	allow     []string
+	deny      []string
+	htpasswd  string
+	intercept []string
+
+	adminAddress   []string
+	adminTokenFile string
+	verbose        bool
+	logLevel       string
+	logFormat      string
+
+	accessLogPath   string
+	accessLogFormat string
+	requestIDHeader bool
+
+	proxyCA         string
+	proxyCert       string
+	proxyKey        string
+	proxyServerName string
+
+	race         bool
+	raceDelay    time.Duration
+	raceRemember time.Duration
+
+	fallback    map[string]string
+	headerRules []string
+
+	blocklists       []string
+	blocklistRefresh time.Duration
+	blockPage        string
+	blockFormat      string
+
+	cacheDir       string
+	cacheMaxSize   string
+	cacheMaxObject string
+
+	timeouts        proxy.Timeouts
+	hostTimeouts    []string
+	pacDialTimeout  time.Duration
+	pacFetchTimeout time.Duration
+
+	rateLimit       string
+	clientRateLimit string
+	hostRateLimits  []string
+	caDir           string
+}
+
+// opts are the proxy flags of the command line
+var opts = &proxyOptions{}
 
 // proxyCmd represents the proxy command
 var proxyCmd = &cobra.Command{
@@ -39,7 +101,7 @@ var proxyCmd = &cobra.Command{
 	Short: "Start the proxy server",
 	Long:  `Starts the proxy server.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := runProxy(); err != nil {
+		if err := runProxy(cmd); err != nil {
 			log.Fatal(err)
 		}
 	},
@@ -47,81 +109,369 @@ var proxyCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(proxyCmd)
-	proxyCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose logging")
-	proxyCmd.Flags().StringVarP(&proxyURL, "proxy", "p", "", "the upstream HTTP Proxy")
-	proxyCmd.Flags().StringVar(&pacURL, "pac", "", "url to the proxy auto config (PAC) file")
-	proxyCmd.Flags().StringVarP(&address, "address", "a", "localhost:8800", "listen address for the proxy server")
-	proxyCmd.Flags().StringVarP(&service, "service", "s", defaultService, "service name, used to distinguish between auth configurations")
-	proxyCmd.Flags().StringVarP(&username, "user", "u", "", "user name, used to log into proxy servers. Omit to use an unauthenticated proxy.")
-	proxyCmd.Flags().StringVarP(&realm, "realm", "r", "", "realm for kerberos/negotiate authentication")
-	proxyCmd.Flags().StringVarP(&krb5conf, "krb5conf", "k", "", "kerberos config")
-}
-
-func runProxy() error {
-	var proxyFunc func(req *http.Request) (*url.URL, error)
-	switch {
-	case proxyURL != "":
-		purl, err := url.Parse(proxyURL)
+	proxyFlags(proxyCmd.Flags(), opts)
+	// Set by 'squiggly start' for the background proxy
+	proxyCmd.Flags().StringVar(&stateDir, "state-dir", "", "lock this state directory and serve the admin API on a unix socket in it")
+	proxyCmd.Flags().MarkHidden("state-dir")
+}
+
+// proxyFlags defines the flags of the proxy on the flag set, and resets them to their defaults
+func proxyFlags(flags *pflag.FlagSet, o *proxyOptions) {
+	flags.BoolVarP(&o.verbose, "verbose", "v", false, "enable verbose logging, same as --log-level=debug")
+	flags.StringVar(&o.logLevel, "log-level", "info", "minimum level of log events (trace, debug, info, warn, error)")
+	flags.StringVar(&o.logFormat, "log-format", "text", "format of log events (text, json)")
+	flags.StringVar(&o.accessLogPath, "access-log", "", "write a line for every request and tunnel to this file, or - for stdout. Reopened on SIGHUP")
+	flags.StringVar(&o.accessLogFormat, "access-log-format", "combined", "format of the access log (common, combined, json)")
+	flags.BoolVar(&o.requestIDHeader, "request-id-header", false, "return the request ID to clients in the X-Squiggly-Request-Id header")
+	flags.StringVarP(&o.proxyURL, "proxy", "p", "", "the upstream HTTP Proxy")
+	flags.StringVar(&o.pacURL, "pac", "", "url to the proxy auto config (PAC) file")
+	flags.StringSliceVar(&o.bypass, "bypass", nil, "connect directly to these hosts (api.example.com, *.example.com, .example.com) in every routing mode")
+	flags.StringVar(&o.proxyCA, "proxy-ca", "", "PEM file of CA certificates trusted for https:// upstream proxies, in addition to the system roots")
+	flags.StringVar(&o.proxyCert, "proxy-cert", "", "PEM client certificate presented to https:// upstream proxies")
+	flags.StringVar(&o.proxyKey, "proxy-key", "", "PEM private key of the --proxy-cert client certificate")
+	flags.StringToStringVar(&o.fallback, "fallback", nil, "action when the upstream proxy fails, for each error class (unreachable, auth, refused, timeout, tls): direct, next or fail. e.g. 'unreachable=next,timeout=direct'")
+	defaults := proxy.DefaultTimeouts()
+	flags.DurationVar(&o.timeouts.Dial, "dial-timeout", defaults.Dial, "timeout connecting to destinations and upstream proxies, 0 for none")
+	flags.DurationVar(&o.timeouts.Handshake, "handshake-timeout", defaults.Handshake, "timeout of TLS handshakes and of the upstream proxy responding to CONNECT, 0 for none")
+	flags.DurationVar(&o.timeouts.Auth, "auth-timeout", defaults.Auth, "timeout of the upstream proxy authentication handshake, 0 for none")
+	flags.DurationVar(&o.timeouts.ResponseHeader, "response-header-timeout", defaults.ResponseHeader, "timeout waiting for the response headers of plain HTTP requests, 0 for none")
+	flags.DurationVar(&o.timeouts.Idle, "idle-timeout", defaults.Idle, "close tunnels without traffic for this long, 0 for none")
+	flags.StringArrayVar(&o.hostTimeouts, "host-timeout", nil, "override timeouts for matching hosts, may be repeated (e.g. '*.artifacts.example.com:response-header=10m,idle=1h')")
+	flags.DurationVar(&o.pacDialTimeout, "pac-dial-timeout", pac.DefaultDialTimeout, "timeout connecting to the PAC server")
+	flags.DurationVar(&o.pacFetchTimeout, "pac-timeout", 30*time.Second, "timeout fetching the PAC file, 0 for none")
+	flags.StringVar(&o.rateLimit, "rate-limit", "", "limit the traffic of all clients together, in bytes per second with an optional burst: RATE[:BURST] (e.g. 10M or 512k:4M)")
+	flags.StringVar(&o.clientRateLimit, "client-rate-limit", "", "limit the traffic of each client IP address, in bytes per second: RATE[:BURST]")
+	flags.StringArrayVar(&o.hostRateLimits, "host-rate-limit", nil, "limit the traffic to all hosts matching a pattern together, may be repeated: PATTERN=RATE[:BURST] (e.g. '.docker.io=5M')")
+	flags.StringArrayVar(&o.headerRules, "header-rule", nil, "rewrite a header, may be repeated: DIRECTION[@PATTERN]:ACTION:NAME[=VALUE] where DIRECTION is request, response or connect and ACTION is set, add or remove (e.g. 'connect:set:User-Agent=Mozilla/5.0')")
+	flags.StringArrayVar(&o.blocklists, "blocklist", nil, "block the domains in a hosts file or domain list, given as a path or http(s) URL, may be repeated")
+	flags.DurationVar(&o.blocklistRefresh, "blocklist-refresh", time.Hour, "how often the blocklists are loaded again, 0 for never")
+	flags.StringVar(&o.blockPage, "block-page", "", "template of the response to blocked plain HTTP requests (default is a short page)")
+	flags.StringVar(&o.blockFormat, "block-format", "html", "format of the block page: html or json")
+	flags.StringVar(&o.cacheDir, "cache-dir", "", "cache the responses to plain HTTP requests in this directory")
+	flags.StringVar(&o.cacheMaxSize, "cache-max-size", "1G", "total size of the cached responses, with --cache-dir")
+	flags.StringVar(&o.cacheMaxObject, "cache-max-object", "256M", "largest response that is cached, with --cache-dir")
+	flags.BoolVar(&o.race, "race", false, "dial directly in parallel with the upstream proxy, and use whichever connects first")
+	flags.DurationVar(&o.raceDelay, "race-delay", 300*time.Millisecond, "how long the upstream proxy is given before the direct dial starts, with --race")
+	flags.DurationVar(&o.raceRemember, "race-remember", 10*time.Minute, "how long the winner of a race is used for the same host without racing, with --race")
+	flags.StringVar(&o.proxyServerName, "proxy-server-name", "", "server name (SNI) sent to https:// upstream proxies, instead of their host name")
+	flags.StringVarP(&o.address, "address", "a", defaultAddress, "listen address for the proxy server, used when no --listen or systemd sockets are given")
+	flags.StringArrayVarP(&o.listen, "listen", "l", nil, "listen address for the proxy server, may be repeated (host:port, tcp://host:port, unix:///path)")
+	flags.StringArrayVar(&o.socks, "socks", nil, "listen address for a SOCKS5 server sharing the proxy routing, may be repeated")
+	flags.StringArrayVar(&o.tproxy, "transparent", nil, "listen address for connections redirected by iptables/nftables REDIRECT (host:port) or TPROXY (tproxy://host:port), may be repeated. Linux only")
+	flags.StringSliceVar(&o.allow, "allow", nil, "only allow clients from these addresses or CIDR blocks")
+	flags.StringSliceVar(&o.deny, "deny", nil, "deny clients from these addresses or CIDR blocks")
+	flags.StringVar(&o.htpasswd, "htpasswd", "", "require clients to authenticate with Basic credentials from this htpasswd file")
+	flags.StringSliceVar(&o.intercept, "intercept", nil, "decrypt HTTPS traffic to these hosts (api.example.com, *.example.com, .example.com) using the CA from 'squiggly ca init'")
+	flags.StringVar(&o.caDir, "ca-dir", "", "directory the CA is stored in (default is the user config directory)")
+	flags.StringArrayVar(&o.adminAddress, "admin", nil, "listen address for the admin API and /metrics endpoint, may be repeated (host:port, unix:///path)")
+	flags.StringVar(&o.adminTokenFile, "admin-token-file", "", "require this file's token as a bearer token on the admin API, which may then listen on non-loopback addresses")
+	flags.StringVarP(&o.service, "service", "s", defaultService, "service name, used to distinguish between auth configurations")
+	flags.StringVarP(&o.username, "user", "u", "", "user name, used to log into proxy servers. Omit to use an unauthenticated proxy.")
+	flags.StringVarP(&o.realm, "realm", "r", "", "realm for kerberos/negotiate authentication")
+	flags.StringVarP(&o.krb5conf, "krb5conf", "k", "", "kerberos config")
+}
+
+func runProxy(cmd *cobra.Command) error {
+	var extraAdmin []string
+	if stateDir != "" {
+		lock, err := lockDaemon(stateDir)
 		if err != nil {
-			return fmt.Errorf("could not parse proxy url '%s': %w", proxyURL, err)
-		}
-		proxyFunc = http.ProxyURL(purl)
-	case pacURL != "":
-		proxyPAC := &pac.PAC{URL: pacURL}
-		if _, err := proxyPAC.Refresh(); err != nil {
-			log.Println("Unable to parse PAC:", err)
+			return err
 		}
-		proxyFunc = proxyPAC.Proxy
-	default:
-		log.Println("using proxy from environment variables")
-		proxyFunc = http.ProxyFromEnvironment
+		defer lock.Close()
+		extraAdmin = append(extraAdmin, daemonSocket(stateDir))
 	}
-	if proxyURL != "" {
-		proxyFunc = proxyFunc
+	r := &reloader{args: config.CommandLine(cmd.Flags())}
+	configPath, err := loadConfig(cmd.Flags())
+	if err != nil {
+		return err
 	}
-	options := []proxy.Option{
-		proxy.Proxy(proxyFunc),
+	inst, err := newInstance(opts, cmd.Flags(), configPath, nil)
+	if err != nil {
+		return err
 	}
-	logger := &logging.StandardLogger{}
-	if username != "" {
-		cred, err := proxyAuth(service, username)
-		if err != nil {
+	r.inst, r.proxy = inst, proxy.NewReloadable(inst.server)
+	r.proxy.ReportThroughput()
+	defer func() { r.instance().close() }()
+	adminToken, err := readAdminToken(opts.adminTokenFile)
+	if err != nil {
+		return err
+	}
+	listeners, err := opts.openListeners(extraAdmin...)
+	if err != nil {
+		return err
+	}
+	if adminToken == "" {
+		if err := checkLoopback(listeners.admin); err != nil {
+			listeners.Close()
 			return err
 		}
-		var sp *auth.SPNEGO
-		if realm != "" {
-			cred.Realm = realm
-			sp, err = auth.NewSPNEGO(cred, krb5conf)
-			if err != nil {
-				return err
-			}
-		}
-		pauth := auth.NewAuth(cred, sp)
-		options = append(options, proxy.ProxyAuth(pauth))
-		if verbose {
-			pauth.Logger = logger
-		}
 	}
-	if verbose {
-		options = append(options, proxy.Log(logger))
+	if err := opts.check(listeners); err != nil {
+		listeners.Close()
+		return err
 	}
-	prx := proxy.New(options...)
+	r.listeners = listeners
 	srv := &http.Server{
-		Addr:    address,
-		Handler: prx,
+		Handler: r.proxy,
+	}
+	adminSrv := &http.Server{
+		Handler: admin.NewHandler(&controller{
+			reloader:  r,
+			listeners: listeners,
+			started:   time.Now(),
+		}, adminToken),
 	}
-	defer prx.Close()
-	// Listen for Interrupt
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
+	// Listen for Interrupt, and SIGTERM from 'squiggly stop'
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	// Reload the configuration on SIGHUP. The access log is reopened, after it has been rotated,
+	// even if the new configuration is rejected.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := r.Reload(); err != nil {
+				inst := r.instance()
+				inst.logger.Error("reload failed, keeping the current configuration", logging.Err(err))
+				if err := inst.accessLog.Reopen(); err != nil {
+					inst.logger.Error("unable to reopen access log", logging.Err(err))
+				}
+			}
+		}
+	}()
 
 	// Shut Down on Signal
 	go func() {
 		<-sig
 		srv.Close()
+		adminSrv.Close()
+		listeners.Close()
 	}()
 
 	// Run Proxy
-	log.Println("LISTEN", address)
-	return srv.ListenAndServe()
+	return listeners.Serve(srv, adminSrv, r.proxy, inst.logger)
+}
+
+// check returns an error if the options can not be served on the listeners.
+// It is checked at startup and on every reload, which keeps the listeners.
+func (o *proxyOptions) check(listeners *proxyListeners) error {
+	// Redirected connections carry no credentials, so they would bypass the htpasswd file
+	if o.htpasswd != "" && len(listeners.transparent) > 0 {
+		return fmt.Errorf("--htpasswd can not be used with transparent listeners, whose clients can not authenticate; use --allow instead")
+	}
+	return nil
+}
+
+// newLogger creates the logger for the log flags.
+// --verbose lowers the level to debug, unless --log-level is given explicitly.
+func (o *proxyOptions) newLogger(flags *pflag.FlagSet) (*logging.EventLogger, error) {
+	name := o.logLevel
+	if o.verbose && !flags.Changed("log-level") {
+		name = "debug"
+	}
+	level, err := logging.ParseLevel(name)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := logging.ParseEncoder(o.logFormat)
+	if err != nil {
+		return nil, err
+	}
+	return logging.NewEventLogger(os.Stderr, level, enc), nil
+}
+
+// openAccessLog opens the access log file, if one is configured
+func (o *proxyOptions) openAccessLog() (*logging.AccessLog, error) {
+	if o.accessLogPath == "" {
+		return nil, nil
+	}
+	format, err := logging.ParseAccessFormat(o.accessLogFormat)
+	if err != nil {
+		return nil, err
+	}
+	return logging.OpenAccessLog(o.accessLogPath, format)
+}
+
+// newRouter creates the router for the upstream proxy flags
+func (o *proxyOptions) newRouter(logger *logging.EventLogger) (*proxy.Router, error) {
+	router := proxy.NewRouter()
+	router.Logger = logger
+	router.PACDialTimeout = o.pacDialTimeout
+	router.PACFetchTimeout = o.pacFetchTimeout
+	router.Bypass = proxy.HostPatterns(o.bypass)
+	switch {
+	case o.proxyURL != "":
+		if err := router.UseProxy(o.proxyURL); err != nil {
+			return nil, err
+		}
+		logger.Info("using upstream proxy", logging.F(logging.KeyUpstream, router.Status().Proxy))
+	case o.pacURL != "":
+		if err := router.UsePAC(o.pacURL); err != nil {
+			logger.Error("unable to load PAC", logging.F(logging.KeyURL, o.pacURL), logging.Err(err))
+		}
+	default:
+		logger.Info("using proxy from environment variables")
+		router.UseEnv()
+	}
+	return router, nil
+}
+
+// authConfig is the upstream proxy authentication given by the flags
+type authConfig struct {
+	service  string
+	username string
+	realm    string
+	krb5conf string
+}
+
+// loadProxyAuth reads the upstream proxy credentials from the keyring.
+// It returns nil if no user name is configured.
+func loadProxyAuth(logger *logging.EventLogger, a authConfig) (*auth.Auth, error) {
+	if a.username == "" {
+		return nil, nil
+	}
+	cred, err := proxyAuth(a.service, a.username)
+	if err != nil {
+		return nil, err
+	}
+	var sp *auth.SPNEGO
+	if a.realm != "" {
+		cred.Realm = a.realm
+		sp, err = auth.NewSPNEGO(cred, a.krb5conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pauth := auth.NewAuth(cred, sp)
+	pauth.Logger = logger
+	return pauth, nil
+}
+
+// upstreamTLSConfig creates the TLS configuration for https upstream proxies from the flags
+func (o *proxyOptions) upstreamTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: o.proxyServerName,
+	}
+	if o.proxyCA != "" {
+		pem, err := ioutil.ReadFile(o.proxyCA)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", o.proxyCA)
+		}
+		cfg.RootCAs = pool
+	}
+	if o.proxyCert != "" || o.proxyKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.proxyCert, o.proxyKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load proxy client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (o *proxyOptions) clientAccessOptions() ([]proxy.Option, error) {
+	var options []proxy.Option
+	allowNets, err := proxy.ParseCIDRs(o.allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := proxy.ParseCIDRs(o.deny)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, proxy.AllowClients(allowNets), proxy.DenyClients(denyNets))
+	if o.htpasswd != "" {
+		users, err := auth.LoadHtpasswd(o.htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, proxy.ClientAuth(users))
+	}
+	return options, nil
+}
+
+func (o *proxyOptions) interceptOption(logger *logging.EventLogger) (proxy.Option, error) {
+	dir, err := resolveCADir(o.caDir)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := mitm.LoadCA(dir)
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := mitm.NewIssuer(ca)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("intercepting TLS", logging.F("hosts", strings.Join(o.intercept, ",")))
+	return proxy.Intercept(issuer, o.intercept), nil
+}
+
+// blockOption loads the blocklists, and refreshes them in the background
+func (o *proxyOptions) blockOption(ctx context.Context, logger *logging.EventLogger) (proxy.Option, error) {
+	page, err := proxy.NewBlockPage(o.blockFormat, o.blockPage)
+	if err != nil {
+		return nil, err
+	}
+	list := &proxy.Blocklist{Logger: logger, Sources: o.blocklists, FetchTimeout: time.Minute}
+	// A list that can not be loaded yet is retried on the next refresh
+	_ = list.Refresh()
+	if o.blocklistRefresh > 0 {
+		go list.Watch(ctx, o.blocklistRefresh)
+	}
+	return proxy.Block(list, page), nil
+}
+
+// openCache opens the HTTP response cache
+func (o *proxyOptions) openCache(logger *logging.EventLogger) (*proxy.ResponseCache, error) {
+	maxSize, err := proxy.ParseSize(o.cacheMaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --cache-max-size: %w", err)
+	}
+	maxObject, err := proxy.ParseSize(o.cacheMaxObject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --cache-max-object: %w", err)
+	}
+	cache, err := proxy.OpenResponseCache(proxy.CacheConfig{Dir: o.cacheDir, MaxSize: maxSize, MaxObjectSize: maxObject})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("caching plain HTTP responses", logging.F("dir", o.cacheDir), logging.F("size", cache.Size()))
+	return cache, nil
+}
+
+// rateLimitOptions returns the options for the global, client and host rate limits
+func (o *proxyOptions) rateLimitOptions() ([]proxy.Option, error) {
+	var options []proxy.Option
+	if o.rateLimit != "" {
+		l, err := proxy.ParseRateLimit(o.rateLimit)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, proxy.GlobalRateLimit(l))
+	}
+	if o.clientRateLimit != "" {
+		l, err := proxy.ParseRateLimit(o.clientRateLimit)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, proxy.ClientRateLimit(l))
+	}
+	for _, hrl := range o.hostRateLimits {
+		hosts, l, err := proxy.ParseHostRateLimit(hrl)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, proxy.HostRateLimit(hosts, l))
+	}
+	return options, nil
 }
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	dir := t.TempDir()
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caPath := write("ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := write("client-key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "squiggly client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := write("client.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+
+	o := &proxyOptions{proxyCA: caPath, proxyCert: certPath, proxyKey: keyPath, proxyServerName: "example.com"}
+	cfg, err := o.upstreamTLSConfig()
+	if err != nil {
+		t.Fatalf("upstreamTLSConfig: %v", err)
+	}
+	if cfg.ServerName != "example.com" {
+		t.Errorf("ServerName = %q", cfg.ServerName)
+	}
+	if len(cfg.Certificates) != 1 {
+		t.Errorf("%d client certificates, want 1", len(cfg.Certificates))
+	}
+	if _, err := srv.Certificate().Verify(x509.VerifyOptions{Roots: cfg.RootCAs, DNSName: "example.com"}); err != nil {
+		t.Errorf("proxy certificate does not verify with --proxy-ca: %v", err)
+	}
+
+	o = &proxyOptions{proxyCA: write("empty.pem", []byte("not a certificate\n"))}
+	if _, err := o.upstreamTLSConfig(); err == nil {
+		t.Error("upstreamTLSConfig accepted a CA file without certificates")
+	}
+	o = &proxyOptions{proxyCert: certPath}
+	if _, err := o.upstreamTLSConfig(); err == nil {
+		t.Error("upstreamTLSConfig accepted a client certificate without its key")
+	}
+}
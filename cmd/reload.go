@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/justenwalker/squiggly/config"
+	"github.com/justenwalker/squiggly/logging"
+	"github.com/justenwalker/squiggly/proxy"
+	"github.com/spf13/pflag"
+)
+
+// instance is the proxy server built from the flags, with the router, logger and access log it uses.
+// A reload builds a new instance and swaps it in.
+type instance struct {
+	server *proxy.Server
+	router *proxy.Router
+	logger *logging.EventLogger
+	auth   authConfig
+	// config is the path of the config file, if there is one
+	config string
+	// listen describes the listener flags, which only change on restart
+	listen string
+
+	accessLog       *logging.AccessLog
+	accessLogConfig string
+	// accessLogRefs counts the instances using the access log, which is closed when the last is released
+	accessLogRefs *int32
+	cache         *proxy.ResponseCache
+	cacheDir      string
+	// stop ends the background refresh of the blocklists
+	stop context.CancelFunc
+}
+
+// newInstance builds the proxy server from the flags. The access log and the response cache
+// are taken over from the previous instance, if there is one and they have not changed.
+func newInstance(o *proxyOptions, flags *pflag.FlagSet, configPath string, prev *instance) (_ *instance, err error) {
+	logger, err := o.newLogger(flags)
+	if err != nil {
+		return nil, err
+	}
+	if configPath != "" {
+		logger.Info("loaded config", logging.F("file", configPath))
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	inst := &instance{
+		logger: logger,
+		auth:   authConfig{service: o.service, username: o.username, realm: o.realm, krb5conf: o.krb5conf},
+		config: configPath,
+		listen: fmt.Sprint(o.address, o.listen, o.socks, o.tproxy, o.adminAddress),
+		stop:   stop,
+	}
+	defer func() {
+		if err != nil {
+			inst.release()
+		}
+	}()
+	inst.router, err = o.newRouter(logger)
+	if err != nil {
+		return nil, err
+	}
+	upstreamTLS, err := o.upstreamTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	policy := proxy.DefaultFallbackPolicy()
+	for class, action := range o.fallback {
+		if err := policy.Set(class, action); err != nil {
+			return nil, err
+		}
+	}
+	options := []proxy.Option{
+		proxy.Proxies(inst.router.Proxies),
+		proxy.UpstreamTLS(upstreamTLS),
+		proxy.Fallback(policy),
+		proxy.Timeout(o.timeouts),
+	}
+	rateOptions, err := o.rateLimitOptions()
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, rateOptions...)
+	for _, hr := range o.headerRules {
+		rule, err := proxy.ParseHeaderRule(hr)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, proxy.HeaderRules(rule))
+	}
+	if len(o.blocklists) > 0 {
+		opt, err := o.blockOption(ctx, logger)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, opt)
+	}
+	if o.cacheDir != "" {
+		if err := inst.openCache(o, prev); err != nil {
+			return nil, err
+		}
+		options = append(options, proxy.Cache(inst.cache))
+	}
+	for _, ht := range o.hostTimeouts {
+		hosts, t, err := proxy.ParseHostTimeouts(ht)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, proxy.HostTimeout(hosts, t))
+	}
+	accessOptions, err := o.clientAccessOptions()
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, accessOptions...)
+	if o.race {
+		options = append(options, proxy.Race(o.raceDelay, o.raceRemember))
+	}
+	if len(o.intercept) > 0 {
+		opt, err := o.interceptOption(logger)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, opt)
+	}
+	if err := inst.openAccessLog(o, prev); err != nil {
+		return nil, err
+	}
+	options = append(options, proxy.AccessLog(inst.accessLog), proxy.ReturnRequestID(o.requestIDHeader))
+	pauth, err := loadProxyAuth(logger, inst.auth)
+	if err != nil {
+		return nil, err
+	}
+	if pauth != nil {
+		options = append(options, proxy.ProxyAuth(pauth))
+	}
+	options = append(options, proxy.Log(logger))
+	if prev != nil {
+		options = append(options, proxy.Replaces(prev.server))
+	}
+	inst.server = proxy.New(options...)
+	return inst, nil
+}
+
+// openCache opens the response cache, or takes over the cache of the previous instance if it uses the same directory.
+// A directory can only be opened once, so changes to the size limits of a cache in use apply on restart.
+func (inst *instance) openCache(o *proxyOptions, prev *instance) error {
+	if prev != nil && prev.cache != nil && prev.cacheDir == o.cacheDir {
+		inst.cache, inst.cacheDir = prev.cache, prev.cacheDir
+		return nil
+	}
+	cache, err := o.openCache(inst.logger)
+	if err != nil {
+		return err
+	}
+	inst.cache, inst.cacheDir = cache, o.cacheDir
+	return nil
+}
+
+// openAccessLog opens the access log, or reopens the access log of the previous instance if it has not changed
+func (inst *instance) openAccessLog(o *proxyOptions, prev *instance) error {
+	inst.accessLogConfig = o.accessLogPath + " " + o.accessLogFormat
+	if prev != nil && prev.accessLogConfig == inst.accessLogConfig {
+		inst.accessLog, inst.accessLogRefs = prev.accessLog, prev.accessLogRefs
+		atomic.AddInt32(inst.accessLogRefs, 1)
+		return inst.accessLog.Reopen()
+	}
+	accessLog, err := o.openAccessLog()
+	if err != nil {
+		return err
+	}
+	inst.accessLog, inst.accessLogRefs = accessLog, new(int32)
+	*inst.accessLogRefs = 1
+	return nil
+}
+
+// release stops the instance, and closes the access log unless another instance still uses it
+func (inst *instance) release() {
+	inst.stop()
+	if inst.accessLogRefs != nil && atomic.AddInt32(inst.accessLogRefs, -1) == 0 {
+		_ = inst.accessLog.Close()
+	}
+}
+
+// retire releases the instance once the requests and tunnels still served by it have finished,
+// so that they are written to its access log even if the reload changed it
+func (inst *instance) retire() {
+	<-inst.server.Retire()
+	inst.release()
+	_ = inst.server.Close()
+}
+
+// close stops the instance and flushes its logs
+func (inst *instance) close() {
+	inst.release()
+	_ = inst.server.Close()
+}
+
+// reloader swaps in a new instance, built from the command line and the config file read again
+type reloader struct {
+	args  config.Args
+	proxy *proxy.Reloadable
+	// listeners are the listeners opened at startup, which the reloaded options are checked against
+	listeners *proxyListeners
+
+	// reload serializes reloads
+	reload sync.Mutex
+	mu     sync.RWMutex
+	inst   *instance
+}
+
+// instance returns the current instance
+func (r *reloader) instance() *instance {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.inst
+}
+
+// Reload reads the config file and the keyring again, and swaps in a new proxy server for new requests and tunnels.
+// Those in progress finish on the previous server. If the configuration is invalid, the current server is kept.
+func (r *reloader) Reload() error {
+	r.reload.Lock()
+	defer r.reload.Unlock()
+	// The options are parsed again from scratch, so that a rejected configuration leaves nothing behind
+	o := &proxyOptions{}
+	flags := pflag.NewFlagSet("proxy", pflag.ContinueOnError)
+	proxyFlags(flags, o)
+	if err := r.args.Set(flags); err != nil {
+		return err
+	}
+	configPath, err := loadConfig(flags)
+	if err != nil {
+		return err
+	}
+	if err := o.check(r.listeners); err != nil {
+		return err
+	}
+	prev := r.instance()
+	inst, err := newInstance(o, flags, configPath, prev)
+	if err != nil {
+		return err
+	}
+	if inst.listen != prev.listen {
+		inst.logger.Warn("listener changes take effect on restart")
+	}
+	r.mu.Lock()
+	r.inst = inst
+	r.mu.Unlock()
+	r.proxy.Swap(inst.server)
+	prev.stop()
+	go prev.retire()
+	inst.logger.Info("configuration reloaded")
+	return nil
+}
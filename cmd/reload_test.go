@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+func TestAccessLogShared(t *testing.T) {
+	o := &proxyOptions{accessLogPath: filepath.Join(t.TempDir(), "access.log"), accessLogFormat: "common"}
+	noop := func() {}
+
+	first := &instance{stop: noop}
+	if err := first.openAccessLog(o, nil); err != nil {
+		t.Fatal(err)
+	}
+	second := &instance{stop: noop}
+	if err := second.openAccessLog(o, first); err != nil {
+		t.Fatal(err)
+	}
+	if second.accessLog != first.accessLog {
+		t.Fatal("unchanged access log was opened again")
+	}
+
+	// The log stays open while the second instance uses it
+	first.release()
+	second.accessLog.Log(&logging.AccessEntry{Method: "GET", Target: "/open"})
+	second.release()
+	second.accessLog.Log(&logging.AccessEntry{Method: "GET", Target: "/closed"})
+
+	b, err := ioutil.ReadFile(o.accessLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); !strings.Contains(s, "/open") || strings.Contains(s, "/closed") {
+		t.Errorf("access log = %q, want only the entry written before the last release", s)
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	config := "logging:\n  access-log: " + filepath.Join(dir, "access.log") + "\nclients:\n  htpasswd: " + filepath.Join(dir, "htpasswd") + "\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { cfgFile = path }(cfgFile)
+	cfgFile = path
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Transparent clients can not authenticate, so the proxy refuses --htpasswd with them, at startup or on reload
+	r := &reloader{listeners: &proxyListeners{transparent: []net.Listener{l}}}
+	if err := r.Reload(); err == nil || !strings.Contains(err.Error(), "--htpasswd") {
+		t.Fatalf("Reload = %v, want the --htpasswd error", err)
+	}
+	if opts.accessLogPath != "" || opts.htpasswd != "" {
+		t.Errorf("rejected reload changed the command line options: access log %q, htpasswd %q", opts.accessLogPath, opts.htpasswd)
+	}
+	if r.instance() != nil {
+		t.Error("rejected reload replaced the instance")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/justenwalker/squiggly/config"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var cfgFile string
@@ -15,6 +17,26 @@ var RootCmd = &cobra.Command{
 	Short: "A forwarding proxy that proxies to another upstream proxy described by a PAC file",
 }
 
+func init() {
+	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is the first of $XDG_CONFIG_HOME/squiggly/config.yaml, ~/.config/squiggly/config.yaml and /etc/squiggly/config.yaml)")
+}
+
+// loadConfig applies the config file to the flags that were not given on the command line.
+// It returns the path of the file, or an empty string if there is none.
+func loadConfig(flags *pflag.FlagSet) (string, error) {
+	path := cfgFile
+	if path == "" {
+		if path = config.Find(); path == "" {
+			return "", nil
+		}
+	}
+	f, err := config.Load(path)
+	if err != nil {
+		return "", err
+	}
+	return path, f.Apply(flags)
+}
+
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
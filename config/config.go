@@ -0,0 +1,293 @@
+// Package config reads the squiggly configuration file.
+//
+// Every setting in the file corresponds to a command line flag, and is applied to
+// the flag unless the flag was given on the command line.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// Upstream modes
+const (
+	ModeProxy = "proxy"
+	ModePAC   = "pac"
+	ModeEnv   = "env"
+)
+
+// File is the configuration file. The flag tags name the command line flag each setting applies to.
+type File struct {
+	Address        string    `yaml:"address" flag:"address"`
+	Listen         []string  `yaml:"listen" flag:"listen"`
+	SOCKS          []string  `yaml:"socks" flag:"socks"`
+	Transparent    []string  `yaml:"transparent" flag:"transparent"`
+	Admin          []string  `yaml:"admin" flag:"admin"`
+	AdminTokenFile string    `yaml:"admin-token-file" flag:"admin-token-file"`
+	Upstream       Upstream  `yaml:"upstream"`
+	Auth           Auth      `yaml:"auth"`
+	Clients        Clients   `yaml:"clients"`
+	Logging        Logging   `yaml:"logging"`
+	Timeouts       Timeouts  `yaml:"timeouts"`
+	Rules          Rules     `yaml:"rules"`
+	Cache          Cache     `yaml:"cache"`
+	Intercept      Intercept `yaml:"intercept"`
+}
+
+// Upstream selects the upstream proxy. Mode is proxy, pac or env; without a mode,
+// the proxy is used if one is given, then the PAC file, then the environment.
+type Upstream struct {
+	Mode           string   `yaml:"mode"`
+	Proxy          string   `yaml:"proxy" flag:"proxy"`
+	PAC            string   `yaml:"pac" flag:"pac"`
+	PACTimeout     string   `yaml:"pac-timeout" flag:"pac-timeout"`
+	PACDialTimeout string   `yaml:"pac-dial-timeout" flag:"pac-dial-timeout"`
+	Bypass         []string `yaml:"bypass" flag:"bypass"`
+	CA             string   `yaml:"ca" flag:"proxy-ca"`
+	Cert           string   `yaml:"cert" flag:"proxy-cert"`
+	Key            string   `yaml:"key" flag:"proxy-key"`
+	ServerName     string   `yaml:"server-name" flag:"proxy-server-name"`
+	Race           string   `yaml:"race" flag:"race"`
+	RaceDelay      string   `yaml:"race-delay" flag:"race-delay"`
+	RaceRemember   string   `yaml:"race-remember" flag:"race-remember"`
+}
+
+// Auth is the upstream proxy authentication
+type Auth struct {
+	Service  string `yaml:"service" flag:"service"`
+	User     string `yaml:"user" flag:"user"`
+	Realm    string `yaml:"realm" flag:"realm"`
+	Krb5Conf string `yaml:"krb5conf" flag:"krb5conf"`
+}
+
+// Clients restricts the clients of the proxy
+type Clients struct {
+	Allow    []string `yaml:"allow" flag:"allow"`
+	Deny     []string `yaml:"deny" flag:"deny"`
+	Htpasswd string   `yaml:"htpasswd" flag:"htpasswd"`
+}
+
+// Logging configures the event and access logs
+type Logging struct {
+	Level           string `yaml:"level" flag:"log-level"`
+	Format          string `yaml:"format" flag:"log-format"`
+	Verbose         string `yaml:"verbose" flag:"verbose"`
+	AccessLog       string `yaml:"access-log" flag:"access-log"`
+	AccessLogFormat string `yaml:"access-log-format" flag:"access-log-format"`
+	RequestIDHeader string `yaml:"request-id-header" flag:"request-id-header"`
+}
+
+// Timeouts are the default timeouts, and the overrides for matching hosts
+type Timeouts struct {
+	Dial           string   `yaml:"dial" flag:"dial-timeout"`
+	Handshake      string   `yaml:"handshake" flag:"handshake-timeout"`
+	Auth           string   `yaml:"auth" flag:"auth-timeout"`
+	ResponseHeader string   `yaml:"response-header" flag:"response-header-timeout"`
+	Idle           string   `yaml:"idle" flag:"idle-timeout"`
+	Hosts          []string `yaml:"hosts" flag:"host-timeout"`
+}
+
+// Rules are the fallback, header, blocklist and rate limit rules
+type Rules struct {
+	Fallback         map[string]string `yaml:"fallback" flag:"fallback"`
+	Headers          []string          `yaml:"headers" flag:"header-rule"`
+	Blocklists       []string          `yaml:"blocklists" flag:"blocklist"`
+	BlocklistRefresh string            `yaml:"blocklist-refresh" flag:"blocklist-refresh"`
+	BlockPage        string            `yaml:"block-page" flag:"block-page"`
+	BlockFormat      string            `yaml:"block-format" flag:"block-format"`
+	RateLimit        string            `yaml:"rate-limit" flag:"rate-limit"`
+	ClientRateLimit  string            `yaml:"client-rate-limit" flag:"client-rate-limit"`
+	HostRateLimits   []string          `yaml:"host-rate-limits" flag:"host-rate-limit"`
+}
+
+// Cache configures the HTTP response cache
+type Cache struct {
+	Dir       string `yaml:"dir" flag:"cache-dir"`
+	MaxSize   string `yaml:"max-size" flag:"cache-max-size"`
+	MaxObject string `yaml:"max-object" flag:"cache-max-object"`
+}
+
+// Intercept configures TLS interception
+type Intercept struct {
+	Hosts []string `yaml:"hosts" flag:"intercept"`
+	CADir string   `yaml:"ca-dir" flag:"ca-dir"`
+}
+
+// DefaultPaths returns the locations searched for the configuration file, in order
+func DefaultPaths() []string {
+	var paths []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "squiggly", "config.yaml"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		if path := filepath.Join(home, ".config", "squiggly", "config.yaml"); len(paths) == 0 || paths[0] != path {
+			paths = append(paths, path)
+		}
+	}
+	return append(paths, filepath.Join(string(filepath.Separator), "etc", "squiggly", "config.yaml"))
+}
+
+// Find returns the first of the default paths that exists, or an empty string if there is none
+func Find() string {
+	for _, path := range DefaultPaths() {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// Load reads the configuration file. Unknown settings are an error.
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config '%s': %w", path, err)
+	}
+	var f File
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid config '%s': %w", path, err)
+	}
+	switch f.Upstream.Mode {
+	case "":
+	case ModeProxy:
+		if f.Upstream.Proxy == "" {
+			return nil, fmt.Errorf("invalid config '%s': upstream mode proxy requires upstream.proxy", path)
+		}
+	case ModePAC:
+		if f.Upstream.PAC == "" {
+			return nil, fmt.Errorf("invalid config '%s': upstream mode pac requires upstream.pac", path)
+		}
+	case ModeEnv:
+	default:
+		return nil, fmt.Errorf("invalid config '%s': unknown upstream mode '%s', expected proxy, pac or env", path, f.Upstream.Mode)
+	}
+	return &f, nil
+}
+
+// Apply sets the flags to the values in the file. Flags given on the command line keep their value,
+// and settings without a flag in the set are ignored, so that each command picks the settings it uses.
+// The upstream proxy and PAC file are chosen together: giving either on the command line ignores both in the file.
+func (f *File) Apply(fs *pflag.FlagSet) error {
+	skip := make(map[string]bool)
+	fs.Visit(func(fl *pflag.Flag) {
+		skip[fl.Name] = true
+	})
+	switch {
+	case skip["proxy"] || skip["pac"] || f.Upstream.Mode == ModeEnv:
+		skip["proxy"], skip["pac"] = true, true
+	case f.Upstream.Mode == ModePAC:
+		skip["proxy"] = true
+	case f.Upstream.Mode == ModeProxy:
+		skip["pac"] = true
+	}
+	return apply(fs, reflect.ValueOf(f).Elem(), "", skip)
+}
+
+func apply(fs *pflag.FlagSet, v reflect.Value, prefix string, skip map[string]bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := prefix + field.Tag.Get("yaml")
+		if field.Type.Kind() == reflect.Struct {
+			if err := apply(fs, v.Field(i), key+".", skip); err != nil {
+				return err
+			}
+			continue
+		}
+		name := field.Tag.Get("flag")
+		if name == "" || skip[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		var values []string
+		switch fv := v.Field(i).Interface().(type) {
+		case string:
+			if fv != "" {
+				values = []string{fv}
+			}
+		case []string:
+			values = fv
+		case map[string]string:
+			keys := make([]string, 0, len(fv))
+			for k := range fv {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				values = append(values, k+"="+fv[k])
+			}
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value '%s' for '%s' in config: %w", value, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Args are the flags given on the command line, with the values that set them again
+type Args map[string][]string
+
+// CommandLine returns the flags that were given on the command line.
+// It must be called before the file is applied, which marks the flags it sets as changed.
+func CommandLine(fs *pflag.FlagSet) Args {
+	args := make(Args)
+	fs.Visit(func(fl *pflag.Flag) {
+		switch v := fl.Value.(type) {
+		case pflag.SliceValue:
+			args[fl.Name] = v.GetSlice()
+		default:
+			value := fl.Value.String()
+			if fl.Value.Type() == "stringToString" {
+				value = strings.Trim(value, "[]")
+			}
+			args[fl.Name] = []string{value}
+		}
+	})
+	return args
+}
+
+// Set gives the flags to a new flag set, as if they were given on its command line.
+// Flags the set does not define are ignored.
+func (a Args) Set(fs *pflag.FlagSet) error {
+	for name, values := range a {
+		fl := fs.Lookup(name)
+		if fl == nil {
+			continue
+		}
+		for _, value := range values {
+			// An empty map has no pairs to set
+			if value == "" && fl.Value.Type() == "stringToString" {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid argument '%s' for --%s: %w", value, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Strings returns the flags as command line arguments, in the order of their names
+func (a Args) Strings() []string {
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, name := range names {
+		for _, value := range a[name] {
+			args = append(args, "--"+name+"="+value)
+		}
+	}
+	return args
+}
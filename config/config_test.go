@@ -0,0 +1,191 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type testFlags struct {
+	fs       *pflag.FlagSet
+	proxy    string
+	pac      string
+	user     string
+	listen   []string
+	allow    []string
+	fallback map[string]string
+	dial     time.Duration
+	verbose  bool
+}
+
+func newTestFlags() *testFlags {
+	f := &testFlags{fs: pflag.NewFlagSet("test", pflag.ContinueOnError)}
+	f.fs.StringVar(&f.proxy, "proxy", "", "")
+	f.fs.StringVar(&f.pac, "pac", "", "")
+	f.fs.StringVar(&f.user, "user", "", "")
+	f.fs.StringArrayVar(&f.listen, "listen", nil, "")
+	f.fs.StringSliceVar(&f.allow, "allow", nil, "")
+	f.fs.StringToStringVar(&f.fallback, "fallback", nil, "")
+	f.fs.DurationVar(&f.dial, "dial-timeout", time.Second, "")
+	f.fs.BoolVar(&f.verbose, "verbose", false, "")
+	return f
+}
+
+func TestApply(t *testing.T) {
+	path := writeConfig(t, `
+listen:
+  - localhost:8800
+  - unix:///run/squiggly.sock
+upstream:
+  proxy: http://proxy.example.com:8080
+  pac: http://wpad.example.com/proxy.pac
+auth:
+  user: alice
+clients:
+  allow: [10.0.0.0/8, 192.168.0.0/16]
+logging:
+  verbose: true
+timeouts:
+  dial: 5s
+rules:
+  fallback:
+    unreachable: next
+    timeout: direct
+`)
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := newTestFlags()
+	if err := flags.fs.Parse([]string{"--user", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Apply(flags.fs); err != nil {
+		t.Fatal(err)
+	}
+	if flags.user != "bob" {
+		t.Errorf("user = %q, the command line should win", flags.user)
+	}
+	if flags.proxy != "http://proxy.example.com:8080" || flags.pac != "http://wpad.example.com/proxy.pac" {
+		t.Errorf("proxy = %q, pac = %q", flags.proxy, flags.pac)
+	}
+	if want := []string{"localhost:8800", "unix:///run/squiggly.sock"}; !reflect.DeepEqual(flags.listen, want) {
+		t.Errorf("listen = %v, want %v", flags.listen, want)
+	}
+	if want := []string{"10.0.0.0/8", "192.168.0.0/16"}; !reflect.DeepEqual(flags.allow, want) {
+		t.Errorf("allow = %v, want %v", flags.allow, want)
+	}
+	if want := map[string]string{"unreachable": "next", "timeout": "direct"}; !reflect.DeepEqual(flags.fallback, want) {
+		t.Errorf("fallback = %v, want %v", flags.fallback, want)
+	}
+	if flags.dial != 5*time.Second || !flags.verbose {
+		t.Errorf("dial-timeout = %s, verbose = %v", flags.dial, flags.verbose)
+	}
+}
+
+func TestApplyUpstreamMode(t *testing.T) {
+	tests := []struct {
+		config string
+		args   []string
+		proxy  string
+		pac    string
+	}{
+		{config: "mode: pac\n  proxy: http://proxy:8080\n  pac: http://wpad/proxy.pac", pac: "http://wpad/proxy.pac"},
+		{config: "mode: env\n  proxy: http://proxy:8080"},
+		{config: "proxy: http://proxy:8080", args: []string{"--pac", "http://other/proxy.pac"}, pac: "http://other/proxy.pac"},
+	}
+	for _, tt := range tests {
+		f, err := Load(writeConfig(t, "upstream:\n  "+tt.config+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags := newTestFlags()
+		if err := flags.fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Apply(flags.fs); err != nil {
+			t.Fatal(err)
+		}
+		if flags.proxy != tt.proxy || flags.pac != tt.pac {
+			t.Errorf("%q %v: proxy = %q, pac = %q, want %q, %q", tt.config, tt.args, flags.proxy, flags.pac, tt.proxy, tt.pac)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{config: "upstream:\n  porxy: http://proxy:8080\n", err: "porxy"},
+		{config: "upstream:\n  mode: pac\n", err: "requires upstream.pac"},
+		{config: "upstream:\n  mode: socks\n", err: "unknown upstream mode"},
+	}
+	for _, tt := range tests {
+		if _, err := Load(writeConfig(t, tt.config)); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Load(%q) = %v, want error containing %q", tt.config, err, tt.err)
+		}
+	}
+
+	f, err := Load(writeConfig(t, "timeouts:\n  dial: soon\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Apply(newTestFlags().fs); err == nil || !strings.Contains(err.Error(), "timeouts.dial") {
+		t.Errorf("Apply = %v, want an error naming timeouts.dial", err)
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	flags := newTestFlags()
+	args := []string{"--user", "bob", "--listen", "a:1", "--listen", "b,2", "--allow", "10.0.0.0/8,::1/128", "--fallback", "unreachable=next,auth=fail", "--dial-timeout", "3s", "-"}
+	if err := flags.fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Load(writeConfig(t, "auth:\n  user: alice\nupstream:\n  proxy: http://proxy:8080\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := CommandLine(flags.fs)
+	if err := f.Apply(flags.fs); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line is given again to a new flag set, followed by the file
+	again := newTestFlags()
+	if err := cl.Set(again.fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Apply(again.fs); err != nil {
+		t.Fatal(err)
+	}
+	if again.user != "bob" || again.proxy != "http://proxy:8080" || again.dial != 3*time.Second {
+		t.Errorf("user = %q, proxy = %q, dial-timeout = %s", again.user, again.proxy, again.dial)
+	}
+	if !reflect.DeepEqual(again.listen, flags.listen) || !reflect.DeepEqual(again.allow, flags.allow) || !reflect.DeepEqual(again.fallback, flags.fallback) {
+		t.Errorf("listen = %v, allow = %v, fallback = %v, want %v, %v, %v", again.listen, again.allow, again.fallback, flags.listen, flags.allow, flags.fallback)
+	}
+
+	// or as arguments to a new process
+	parsed := newTestFlags()
+	if err := parsed.fs.Parse(cl.Strings()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.listen, flags.listen) || !reflect.DeepEqual(parsed.allow, flags.allow) || !reflect.DeepEqual(parsed.fallback, flags.fallback) || parsed.user != "bob" {
+		t.Errorf("parsed %v: user = %q, listen = %v, allow = %v, fallback = %v", cl.Strings(), parsed.user, parsed.listen, parsed.allow, parsed.fallback)
+	}
+}
@@ -0,0 +1,83 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Parse splits a listen spec into the network and address to listen on.
+// Supported forms are "tcp://host:port", "unix:///path/to/socket", "tproxy://host:port" and a bare "host:port".
+// The tproxy network is a TCP listener that can accept connections redirected by an iptables/nftables TPROXY rule.
+func Parse(spec string) (network string, address string, err error) {
+	if !strings.Contains(spec, "://") {
+		return "tcp", spec, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return "", "", fmt.Errorf("listen address '%s' parse error: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6", "tproxy":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("listen address '%s' is missing a host:port", spec)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix":
+		path := u.Path
+		if u.Host != "" {
+			// unix://relative/path
+			path = u.Host + u.Path
+		}
+		if path == "" {
+			return "", "", fmt.Errorf("listen address '%s' is missing a socket path", spec)
+		}
+		return "unix", path, nil
+	}
+	return "", "", fmt.Errorf("listen address '%s' has unsupported scheme '%s'", spec, u.Scheme)
+}
+
+// Listen opens a listener for the given spec. See Parse for the supported forms.
+func Listen(spec string) (net.Listener, error) {
+	network, address, err := Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "unix":
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	case "tproxy":
+		return listenTProxy(address)
+	}
+	return net.Listen(network, address)
+}
+
+// removeStaleSocket removes a unix socket left behind by a previous process
+// Regular files are never removed.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("listen path '%s' exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("listen path '%s' is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// String formats the listener address as a listen spec
+func String(l net.Listener) string {
+	addr := l.Addr()
+	return addr.Network() + "://" + addr.String()
+}
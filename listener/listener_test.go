@@ -0,0 +1,114 @@
+package listener
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		network string
+		address string
+		err     bool
+	}{
+		{spec: "localhost:8800", network: "tcp", address: "localhost:8800"},
+		{spec: ":8800", network: "tcp", address: ":8800"},
+		{spec: "tcp://127.0.0.1:8800", network: "tcp", address: "127.0.0.1:8800"},
+		{spec: "tcp4://0.0.0.0:8800", network: "tcp4", address: "0.0.0.0:8800"},
+		{spec: "tcp6://[::1]:8800", network: "tcp6", address: "[::1]:8800"},
+		{spec: "tproxy://0.0.0.0:8801", network: "tproxy", address: "0.0.0.0:8801"},
+		{spec: "unix:///run/squiggly.sock", network: "unix", address: "/run/squiggly.sock"},
+		{spec: "unix://relative/squiggly.sock", network: "unix", address: "relative/squiggly.sock"},
+		{spec: "tcp://", err: true},
+		{spec: "unix://", err: true},
+		{spec: "udp://127.0.0.1:53", err: true},
+		{spec: "http://localhost:8800", err: true},
+		{spec: "tcp://[::1", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			network, address, err := Parse(tt.spec)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("Parse(%q) = %s %s, want an error", tt.spec, network, address)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.spec, err)
+			}
+			if network != tt.network || address != tt.address {
+				t.Errorf("Parse(%q) = %s %s, want %s %s", tt.spec, network, address, tt.network, tt.address)
+			}
+		})
+	}
+}
+
+func TestListenUnixRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	// a socket file left behind by a listener that did not remove it
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stale socket was removed: %v", err)
+	}
+	l, err := Listen("unix://" + path)
+	if err != nil {
+		t.Fatalf("Listen over a stale socket: %v", err)
+	}
+	defer l.Close()
+	if got, want := String(l), "unix://"+path; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	// the socket is in use now
+	if _, err := Listen("unix://" + path); err == nil {
+		t.Error("Listen on a socket in use succeeded")
+	}
+}
+
+func TestListenUnixKeepsRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("unix://" + path); err == nil {
+		t.Fatal("Listen over a regular file succeeded")
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "data" {
+		t.Errorf("regular file was changed: %q %v", b, err)
+	}
+}
+
+func TestSystemdNotActivated(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  string
+		fds  string
+	}{
+		{name: "no environment"},
+		{name: "other process", pid: strconv.Itoa(os.Getpid() + 1), fds: "1"},
+		{name: "invalid pid", pid: "self", fds: "1"},
+		{name: "no fds", pid: strconv.Itoa(os.Getpid()), fds: "0"},
+		{name: "invalid fds", pid: strconv.Itoa(os.Getpid()), fds: "many"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", tt.fds)
+			t.Setenv("LISTEN_FDNAMES", "http")
+			ls, err := Systemd()
+			if err != nil || len(ls) != 0 {
+				t.Fatalf("Systemd() = %v, %v, want no listeners", ls, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// Activated is a listener inherited from the service manager
+type Activated struct {
+	// Name is the FileDescriptorName= of the socket unit, or "unknown" if none was given
+	Name string
+	net.Listener
+}
+
+// Systemd adopts the listeners passed by systemd socket activation (LISTEN_PID, LISTEN_FDS, LISTEN_FDNAMES).
+// It returns no listeners if the process was not socket activated.
+// The environment variables are unset so that child processes do not try to adopt them as well.
+func Systemd() ([]Activated, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	listeners := make([]Activated, 0, nfds)
+	for i := 0; i < nfds; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, a := range listeners {
+				a.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %d (%s): %w", fd, name, err)
+		}
+		listeners = append(listeners, Activated{Name: name, Listener: l})
+	}
+	return listeners, nil
+}
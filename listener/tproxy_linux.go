@@ -0,0 +1,35 @@
+package listener
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// ipTransparent is IP_TRANSPARENT / IPV6_TRANSPARENT from linux/in.h and linux/in6.h
+const (
+	ipTransparent   = 19
+	ipv6Transparent = 75
+)
+
+// listenTProxy listens on a TCP socket with IP_TRANSPARENT set, so that it can accept
+// connections for any destination address. This requires CAP_NET_ADMIN.
+func listenTProxy(address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1)
+					return
+				}
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipTransparent, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
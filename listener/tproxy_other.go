@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package listener
+
+import (
+	"errors"
+	"net"
+)
+
+func listenTProxy(address string) (net.Listener, error) {
+	return nil, errors.New("tproxy listeners are only supported on linux")
+}
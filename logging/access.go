@@ -0,0 +1,215 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessFormat selects how access log entries are written
+type AccessFormat string
+
+const (
+	// AccessCommon is the Common Log Format, followed by the squiggly fields
+	AccessCommon AccessFormat = "common"
+	// AccessCombined is the Combined Log Format, followed by the squiggly fields
+	AccessCombined AccessFormat = "combined"
+	// AccessJSON writes one JSON object per line
+	AccessJSON AccessFormat = "json"
+)
+
+// clfTimeFormat is the timestamp format of the Common Log Format
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// ParseAccessFormat parses an access log format name: common, combined or json
+func ParseAccessFormat(name string) (AccessFormat, error) {
+	switch f := AccessFormat(strings.ToLower(name)); f {
+	case AccessCommon, AccessCombined, AccessJSON:
+		return f, nil
+	case "":
+		return AccessCombined, nil
+	}
+	return "", fmt.Errorf("unknown access log format '%s'", name)
+}
+
+// AccessEntry describes a single proxied request or tunnel
+type AccessEntry struct {
+	RequestID  string
+	Time       time.Time
+	Client     string
+	User       string
+	Method     string
+	Target     string
+	Proto      string
+	Route      string
+	AuthScheme string
+	Status     int
+	BytesIn    int64
+	BytesOut   int64
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+	// Cache is the HTTP cache status of a plain request: HIT, MISS, REVALIDATED or BYPASS
+	Cache string
+}
+
+// AccessLog writes one line per request to a file.
+// A nil *AccessLog discards all entries.
+type AccessLog struct {
+	path   string
+	format AccessFormat
+
+	mu sync.Mutex
+	w  io.Writer
+	f  *os.File
+}
+
+// OpenAccessLog opens the access log file for appending, creating it if needed.
+// The path "-" writes to stdout.
+func OpenAccessLog(path string, format AccessFormat) (*AccessLog, error) {
+	l := &AccessLog{path: path, format: format}
+	if path == "-" {
+		l.w = os.Stdout
+		return l, nil
+	}
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	l.f, l.w = f, f
+	return l, nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("could not open access log '%s': %w", path, err)
+	}
+	return f, nil
+}
+
+// Reopen closes and reopens the access log file, so that it can be rotated by logrotate
+func (l *AccessLog) Reopen() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	f, err := openAppend(l.path)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f, l.w = f, f
+	l.mu.Unlock()
+	return old.Close()
+}
+
+// Close the access log file
+func (l *AccessLog) Close() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Log writes the entry
+func (l *AccessLog) Log(e *AccessEntry) {
+	if l == nil {
+		return
+	}
+	buf := &bytes.Buffer{}
+	switch l.format {
+	case AccessJSON:
+		writeAccessJSON(buf, e)
+	default:
+		writeAccessCLF(buf, e, l.format == AccessCombined)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(buf.Bytes())
+}
+
+// writeAccessCLF writes the Common or Combined Log Format line,
+// followed by the route, upstream auth scheme, request bytes, duration in seconds, request ID and cache status:
+//
+//	127.0.0.1 - user [10/Oct/2000:13:55:36 -0700] "CONNECT example.com:443 HTTP/1.1" 200 2326 "-" "curl/7.61" "proxy:8080" "ntlm" 517 0.153 9f86d081884c7d65 -
+func writeAccessCLF(buf *bytes.Buffer, e *AccessEntry, combined bool) {
+	client := e.Client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	fmt.Fprintf(buf, "%s - %s [%s] %s %d %d",
+		clfField(client),
+		clfField(e.User),
+		e.Time.Format(clfTimeFormat),
+		strconv.Quote(e.Method+" "+e.Target+" "+e.Proto),
+		e.Status,
+		e.BytesOut,
+	)
+	if combined {
+		fmt.Fprintf(buf, " %s %s", clfQuote(e.Referer), clfQuote(e.UserAgent))
+	}
+	fmt.Fprintf(buf, " %s %s %d %.3f %s %s\n",
+		clfQuote(e.Route),
+		clfQuote(e.AuthScheme),
+		e.BytesIn,
+		e.Duration.Seconds(),
+		clfField(e.RequestID),
+		clfField(e.Cache),
+	)
+}
+
+// clfField returns the value, or "-" if it is empty
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, " ", "_", -1)
+}
+
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+func writeAccessJSON(buf *bytes.Buffer, e *AccessEntry) {
+	buf.WriteString(`{"time":`)
+	writeJSON(buf, e.Time.Format(timeFormat))
+	fields := []Field{
+		F(KeyRequestID, e.RequestID),
+		F(KeyClient, e.Client),
+		F("user", e.User),
+		F("method", e.Method),
+		F(KeyTarget, e.Target),
+		F("proto", e.Proto),
+		F(KeyRoute, e.Route),
+		F(KeyScheme, e.AuthScheme),
+		F(KeyStatus, e.Status),
+		F("bytes_in", e.BytesIn),
+		F("bytes_out", e.BytesOut),
+		F(KeyDuration, e.Duration.Seconds()),
+		F("referer", e.Referer),
+		F("user_agent", e.UserAgent),
+		F(KeyCache, e.Cache),
+	}
+	for _, f := range fields {
+		if s, ok := f.Value.(string); ok && s == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		writeJSON(buf, f.Key)
+		buf.WriteByte(':')
+		writeJSON(buf, f.Value)
+	}
+	buf.WriteString("}\n")
+}
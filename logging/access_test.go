@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testAccessTime = time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60))
+
+func TestWriteAccessCLF(t *testing.T) {
+	full := &AccessEntry{
+		RequestID:  "9f86d081884c7d65",
+		Time:       testAccessTime,
+		Client:     "127.0.0.1:51234",
+		User:       "jane doe",
+		Method:     "GET",
+		Target:     `http://example.com/a "b"`,
+		Proto:      "HTTP/1.1",
+		Route:      "proxy:8080",
+		AuthScheme: "ntlm",
+		Status:     200,
+		BytesIn:    517,
+		BytesOut:   2326,
+		Duration:   153 * time.Millisecond,
+		Referer:    "http://example.com/",
+		UserAgent:  `curl/7.61 "test"`,
+		Cache:      "HIT",
+	}
+	bare := &AccessEntry{
+		Time:     testAccessTime,
+		Client:   "[2001:db8::1]:443",
+		Method:   "CONNECT",
+		Target:   "example.com:443",
+		Proto:    "SOCKS5",
+		Route:    "DIRECT",
+		Status:   502,
+		Duration: 2 * time.Second,
+	}
+	tests := []struct {
+		name     string
+		entry    *AccessEntry
+		combined bool
+		want     string
+	}{
+		{name: "common", entry: full,
+			want: `127.0.0.1 - jane_doe [10/Oct/2000:13:55:36 -0700] "GET http://example.com/a \"b\" HTTP/1.1" 200 2326 "proxy:8080" "ntlm" 517 0.153 9f86d081884c7d65 HIT` + "\n"},
+		{name: "combined", entry: full, combined: true,
+			want: `127.0.0.1 - jane_doe [10/Oct/2000:13:55:36 -0700] "GET http://example.com/a \"b\" HTTP/1.1" 200 2326 "http://example.com/" "curl/7.61 \"test\"" "proxy:8080" "ntlm" 517 0.153 9f86d081884c7d65 HIT` + "\n"},
+		{name: "combined missing", entry: bare, combined: true,
+			want: `2001:db8::1 - - [10/Oct/2000:13:55:36 -0700] "CONNECT example.com:443 SOCKS5" 502 0 "-" "-" "DIRECT" "-" 0 2.000 - -` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeAccessCLF(&buf, tt.entry, tt.combined)
+			if buf.String() != tt.want {
+				t.Errorf("writeAccessCLF =\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteAccessJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry *AccessEntry
+		want  string
+	}{
+		{name: "full", entry: &AccessEntry{
+			RequestID:  "9f86d081884c7d65",
+			Time:       testAccessTime,
+			Client:     "127.0.0.1:51234",
+			User:       "jane",
+			Method:     "GET",
+			Target:     `http://example.com/a "b"`,
+			Proto:      "HTTP/1.1",
+			Route:      "proxy:8080",
+			AuthScheme: "ntlm",
+			Status:     200,
+			BytesIn:    517,
+			BytesOut:   2326,
+			Duration:   153 * time.Millisecond,
+			Referer:    "http://example.com/",
+			UserAgent:  "curl/7.61 <x>",
+			Cache:      "MISS",
+		}, want: `{"time":"2000-10-10T13:55:36.000-07:00","request_id":"9f86d081884c7d65","client":"127.0.0.1:51234","user":"jane",` +
+			`"method":"GET","target":"http://example.com/a \"b\"","proto":"HTTP/1.1","route":"proxy:8080","scheme":"ntlm","status":200,` +
+			`"bytes_in":517,"bytes_out":2326,"duration":0.153,"referer":"http://example.com/","user_agent":"curl/7.61 \u003cx\u003e","cache":"MISS"}` + "\n"},
+		{name: "missing", entry: &AccessEntry{
+			Time:     testAccessTime,
+			Client:   "127.0.0.1:51234",
+			Method:   "CONNECT",
+			Target:   "example.com:443",
+			Proto:    "TRANSPARENT",
+			Route:    "DIRECT",
+			Status:   200,
+			Duration: time.Second,
+		}, want: `{"time":"2000-10-10T13:55:36.000-07:00","client":"127.0.0.1:51234","method":"CONNECT","target":"example.com:443",` +
+			`"proto":"TRANSPARENT","route":"DIRECT","status":200,"bytes_in":0,"bytes_out":0,"duration":1}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeAccessJSON(&buf, tt.entry)
+			if buf.String() != tt.want {
+				t.Errorf("writeAccessJSON =\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	l, err := OpenAccessLog(path, AccessJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Log(&AccessEntry{Time: testAccessTime, Method: "GET"})
+	rotated := filepath.Join(dir, "access.log.1")
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.Log(&AccessEntry{Time: testAccessTime, Method: "POST"})
+	for _, f := range []struct{ path, method string }{{rotated, "GET"}, {path, "POST"}} {
+		b, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(b, []byte(`"method":"`+f.method+`"`)) || bytes.Count(b, []byte("\n")) != 1 {
+			t.Errorf("%s = %q, want one %s entry", filepath.Base(f.path), b, f.method)
+		}
+	}
+}
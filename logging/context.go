@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// KeyRequestID is the field holding the ID of the request or tunnel an event belongs to
+const KeyRequestID = "request_id"
+
+type requestIDKey struct{}
+
+var fallbackID uint64
+
+// NewRequestID returns a random ID for an inbound request or tunnel
+func NewRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Still unique within this process
+		n := atomic.AddUint64(&fallbackID, 1)
+		return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(n, 36)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// WithRequestID returns a context carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by the context, or an empty string
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Ctx returns a logger that adds the request ID carried by the context to every event
+func (l *EventLogger) Ctx(ctx context.Context) *EventLogger {
+	id := RequestID(ctx)
+	if l == nil || id == "" {
+		return l
+	}
+	return l.With(F(KeyRequestID, id))
+}
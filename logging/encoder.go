@@ -0,0 +1,128 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeFormat is the timestamp format used by the encoders
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// ParseEncoder returns the encoder for a format name: text or json
+func ParseEncoder(format string) (Encoder, error) {
+	switch strings.ToLower(format) {
+	case "", "text":
+		return TextEncoder{}, nil
+	case "json":
+		return JSONEncoder{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format '%s'", format)
+}
+
+// TextEncoder formats events as human readable lines:
+//
+//	2006-01-02T15:04:05.000Z info  message key=value key="quoted value"
+type TextEncoder struct{}
+
+// Encode writes the event as a single line
+func (TextEncoder) Encode(w io.Writer, e *Entry) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString(e.Time.Format(timeFormat))
+	buf.WriteByte(' ')
+	fmt.Fprintf(buf, "%-5s", e.Level)
+	buf.WriteByte(' ')
+	buf.WriteString(e.Message)
+	for _, f := range e.Fields {
+		buf.WriteByte(' ')
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		buf.WriteString(quoteText(formatValue(f.Value)))
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func quoteText(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func formatValue(v interface{}) string {
+	switch vv := normalize(v).(type) {
+	case nil:
+		return ""
+	case string:
+		return vv
+	default:
+		return fmt.Sprint(vv)
+	}
+}
+
+// normalize converts errors, durations, times and other Stringers to strings.
+// Nil pointers become nil rather than panicking in their String method.
+func normalize(v interface{}) interface{} {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil
+	}
+	switch vv := v.(type) {
+	case error:
+		return vv.Error()
+	case time.Duration:
+		return vv.String()
+	case time.Time:
+		return vv.Format(timeFormat)
+	case fmt.Stringer:
+		return vv.String()
+	}
+	return v
+}
+
+// JSONEncoder formats events as one JSON object per line.
+// The time, level and msg keys are always present; fields are added as top level keys.
+// Fields named time, level or msg are renamed to fields.time, fields.level and fields.msg,
+// since parsers keep only one of duplicate keys.
+type JSONEncoder struct{}
+
+// jsonReservedKeys are the keys written by the JSONEncoder for every event
+var jsonReservedKeys = map[string]bool{"time": true, "level": true, "msg": true}
+
+// Encode writes the event as a single line of JSON
+func (JSONEncoder) Encode(w io.Writer, e *Entry) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString(`{"time":`)
+	writeJSON(buf, e.Time.Format(timeFormat))
+	buf.WriteString(`,"level":`)
+	writeJSON(buf, e.Level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(buf, e.Message)
+	for _, f := range e.Fields {
+		key := f.Key
+		if jsonReservedKeys[key] {
+			key = "fields." + key
+		}
+		buf.WriteByte(',')
+		writeJSON(buf, key)
+		buf.WriteByte(':')
+		writeJSON(buf, normalize(f.Value))
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+
+func TestTextEncoder(t *testing.T) {
+	var nilURL *url.URL
+	tests := []struct {
+		name   string
+		msg    string
+		fields []Field
+		want   string
+	}{
+		{name: "plain", msg: "dial", fields: []Field{F("target", "example.com:443"), F("status", 200)},
+			want: "2018-08-01T12:00:00.000Z info  dial target=example.com:443 status=200\n"},
+		{name: "quoted", msg: "request failed", fields: []Field{F("ua", `curl "x" 7.61`), F("empty", ""), F("eq", "a=b"), F("nl", "a\nb")},
+			want: `2018-08-01T12:00:00.000Z info  request failed ua="curl \"x\" 7.61" empty="" eq="a=b" nl="a\nb"` + "\n"},
+		{name: "error", msg: "dial failed", fields: []Field{Err(errors.New("connection refused")), F("duration", 1500*time.Millisecond)},
+			want: "2018-08-01T12:00:00.000Z info  dial failed error=\"connection refused\" duration=1.5s\n"},
+		{name: "nil", msg: "request", fields: []Field{Err(nil), F("url", nilURL)},
+			want: "2018-08-01T12:00:00.000Z info  request error=\"\" url=\"\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := (TextEncoder{}).Encode(&buf, &Entry{Time: testTime, Level: LevelInfo, Message: tt.msg, Fields: tt.fields}); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("Encode =\n%q\nwant\n%q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONEncoder(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    string
+		fields []Field
+		want   string
+	}{
+		{name: "plain", msg: "dial", fields: []Field{F("target", "example.com:443"), F("status", 200), F("ok", true)},
+			want: `{"time":"2018-08-01T12:00:00.000Z","level":"warn","msg":"dial","target":"example.com:443","status":200,"ok":true}` + "\n"},
+		{name: "escaping", msg: "say \"hi\"\n", fields: []Field{F("ua", "<script>\t\u00e9")},
+			want: `{"time":"2018-08-01T12:00:00.000Z","level":"warn","msg":"say \"hi\"\n","ua":"\u003cscript\u003e\té"}` + "\n"},
+		{name: "error", msg: "dial failed", fields: []Field{Err(errors.New("connection refused")), F("duration", time.Second)},
+			want: `{"time":"2018-08-01T12:00:00.000Z","level":"warn","msg":"dial failed","error":"connection refused","duration":"1s"}` + "\n"},
+		// values json can not encode are written as strings
+		{name: "unencodable", msg: "odd", fields: []Field{F("ch", make(chan int))}},
+		{name: "collisions", msg: "real", fields: []Field{F("time", "fake"), F("level", "error"), F("msg", "other"), F("timeout", 1)},
+			want: `{"time":"2018-08-01T12:00:00.000Z","level":"warn","msg":"real","fields.time":"fake","fields.level":"error","fields.msg":"other","timeout":1}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := (JSONEncoder{}).Encode(&buf, &Entry{Time: testTime, Level: LevelWarn, Message: tt.msg, Fields: tt.fields}); err != nil {
+				t.Fatal(err)
+			}
+			var obj map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &obj); err != nil {
+				t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+			}
+			if obj["time"] != "2018-08-01T12:00:00.000Z" || obj["level"] != "warn" || obj["msg"] != tt.msg {
+				t.Errorf("time, level or msg overwritten: %s", buf.String())
+			}
+			if tt.want != "" && buf.String() != tt.want {
+				t.Errorf("Encode =\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log event
+type Level int
+
+const (
+	// LevelTrace is for very noisy internals, such as the goproxy library logs
+	LevelTrace Level = iota - 1
+	// LevelDebug is for details useful when troubleshooting
+	LevelDebug
+	// LevelInfo is for normal operation
+	LevelInfo
+	// LevelWarn is for problems squiggly recovered from
+	LevelWarn
+	// LevelError is for problems that failed a request or operation
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelTrace: "trace",
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel parses a level name: trace, debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return l, nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// Standard field keys, so that events from different packages can be correlated
+const (
+	KeyClient   = "client"
+	KeyTarget   = "target"
+	KeyUpstream = "upstream"
+	KeyRoute    = "route"
+	KeyScheme   = "scheme"
+	KeyStatus   = "status"
+	KeyDuration = "duration"
+	KeyError    = "error"
+	KeyURL      = "url"
+	KeyCache    = "cache"
+)
+
+// Field is a key/value pair attached to a log event
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F creates a field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err creates an error field
+func Err(err error) Field {
+	return Field{Key: KeyError, Value: err}
+}
+
+// Entry is a single log event
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+// Encoder formats a log event as a single line
+type Encoder interface {
+	Encode(w io.Writer, e *Entry) error
+}
+
+// EventLogger writes levelled log events with key/value fields.
+// A nil *EventLogger discards all events, so callers do not need to check whether logging is enabled.
+type EventLogger struct {
+	out    *syncWriter
+	level  Level
+	enc    Encoder
+	fields []Field
+}
+
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewEventLogger creates a logger writing events at or above the level to w, formatted by the encoder
+func NewEventLogger(w io.Writer, level Level, enc Encoder) *EventLogger {
+	if enc == nil {
+		enc = TextEncoder{}
+	}
+	return &EventLogger{
+		out:   &syncWriter{w: w},
+		level: level,
+		enc:   enc,
+	}
+}
+
+// With returns a logger that adds the fields to every event
+func (l *EventLogger) With(fields ...Field) *EventLogger {
+	if l == nil {
+		return nil
+	}
+	child := *l
+	child.fields = make([]Field, 0, len(l.fields)+len(fields))
+	child.fields = append(child.fields, l.fields...)
+	child.fields = append(child.fields, fields...)
+	return &child
+}
+
+// Enabled reports whether events at the level are written
+func (l *EventLogger) Enabled(level Level) bool {
+	return l != nil && level >= l.level
+}
+
+// Level returns the minimum level of events written
+func (l *EventLogger) Level() Level {
+	if l == nil {
+		return LevelError + 1
+	}
+	return l.level
+}
+
+// Event writes an event at the level
+func (l *EventLogger) Event(level Level, msg string, fields ...Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	e := &Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Message: msg,
+		Fields:  fields,
+	}
+	if len(l.fields) > 0 {
+		e.Fields = make([]Field, 0, len(l.fields)+len(fields))
+		e.Fields = append(e.Fields, l.fields...)
+		e.Fields = append(e.Fields, fields...)
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	_ = l.enc.Encode(l.out.w, e)
+}
+
+// Trace writes a trace event
+func (l *EventLogger) Trace(msg string, fields ...Field) {
+	l.Event(LevelTrace, msg, fields...)
+}
+
+// Debug writes a debug event
+func (l *EventLogger) Debug(msg string, fields ...Field) {
+	l.Event(LevelDebug, msg, fields...)
+}
+
+// Info writes an info event
+func (l *EventLogger) Info(msg string, fields ...Field) {
+	l.Event(LevelInfo, msg, fields...)
+}
+
+// Warn writes a warning event
+func (l *EventLogger) Warn(msg string, fields ...Field) {
+	l.Event(LevelWarn, msg, fields...)
+}
+
+// Error writes an error event
+func (l *EventLogger) Error(msg string, fields ...Field) {
+	l.Event(LevelError, msg, fields...)
+}
+
+// At adapts the logger to the Logger interface, writing each line as an event at the level.
+// This allows libraries that only log lines, such as goproxy, to be routed through a LogWriter.
+func (l *EventLogger) At(level Level) Logger {
+	return levelLogger{l: l, level: level}
+}
+
+type levelLogger struct {
+	l     *EventLogger
+	level Level
+}
+
+func (l levelLogger) Log(msg string) {
+	l.l.Event(l.level, msg)
+}
@@ -3,6 +3,7 @@ package logging
 import (
 	"log"
 	"strings"
+	"sync"
 )
 
 // Logger logs messages
@@ -29,6 +30,7 @@ func (l *StandardLogger) Log(msg string) {
 // LogWriter implements the io.Writer interface by passing each line to the Logger after it hits a line break ('\n').
 type LogWriter struct {
 	logger Logger
+	mu     sync.Mutex
 	sb     *strings.Builder
 }
 
@@ -42,6 +44,8 @@ func NewLogWriter(logger Logger) *LogWriter {
 
 // Writes to the string buffer, and passes each line to the logger after it reaches a new line
 func (w *LogWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	for _, c := range p {
 		if c == '\n' { // Print log line
 			w.logger.Log(w.sb.String())
@@ -54,9 +58,13 @@ func (w *LogWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
-// Flush a log line out and empty the buffer
+// Flush the partial log line out, if there is one, and empty the buffer
 func (w *LogWriter) Flush() error {
-	w.logger.Log(w.sb.String())
-	w.sb.Reset()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sb.Len() > 0 {
+		w.logger.Log(w.sb.String())
+		w.sb.Reset()
+	}
 	return nil
 }
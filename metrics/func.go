@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"io"
+	"sync"
+)
+
+// GaugeFuncVec is a family of gauges whose values are computed when the metrics are written
+type GaugeFuncVec struct {
+	desc
+	mu    sync.Mutex
+	funcs map[string]gaugeFunc
+}
+
+type gaugeFunc struct {
+	labels []string
+	f      func() float64
+}
+
+// NewGaugeFuncVec creates a gauge family computed by functions and registers it with the default registry
+func NewGaugeFuncVec(name, help string, labels ...string) *GaugeFuncVec {
+	g := &GaugeFuncVec{
+		desc:  desc{name: name, help: help, typ: "gauge", labels: labels},
+		funcs: make(map[string]gaugeFunc),
+	}
+	Default.Register(g)
+	return g
+}
+
+// Func sets the function computing the gauge for the label values, replacing any previous function
+func (g *GaugeFuncVec) Func(f func() float64, labels ...string) {
+	key := g.key(labels)
+	g.mu.Lock()
+	g.funcs[key] = gaugeFunc{labels: append([]string(nil), labels...), f: f}
+	g.mu.Unlock()
+}
+
+func (g *GaugeFuncVec) Write(w io.Writer) error {
+	g.mu.Lock()
+	values := make(map[string]*value, len(g.funcs))
+	for k, gf := range g.funcs {
+		values[k] = &value{labels: gf.labels, v: gf.f()}
+	}
+	g.mu.Unlock()
+	var mu sync.Mutex
+	return writeValues(w, &g.desc, &mu, values)
+}
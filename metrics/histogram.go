@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are histogram buckets, in seconds, suited to network latencies
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// HistogramVec is a family of histograms partitioned by label values
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram samples observations into buckets
+type Histogram struct {
+	h       *histogram
+	buckets []float64
+}
+
+// NewHistogramVec creates a histogram family and registers it with the default registry.
+// If buckets is nil, DefaultBuckets are used.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	Default.Register(h)
+	return h
+}
+
+// With returns the histogram for the label values, creating it if needed
+func (h *HistogramVec) With(labels ...string) Histogram {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogram{
+			labels: append([]string(nil), labels...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = v
+	}
+	return Histogram{h: v, buckets: h.buckets}
+}
+
+// Observe adds a single observation
+func (h Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.h.mu.Lock()
+	defer h.h.mu.Unlock()
+	if i < len(h.h.counts) {
+		h.h.counts[i]++
+	}
+	h.h.count++
+	h.h.sum += v
+}
+
+// ObserveDuration adds the time elapsed since start, in seconds
+func (h Histogram) ObserveDuration(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *HistogramVec) Write(w io.Writer) error {
+	type sample struct {
+		counts []uint64
+		count  uint64
+		sum    float64
+	}
+	h.mu.Lock()
+	labels := make(map[string][]string, len(h.values))
+	snapshot := make(map[string]sample, len(h.values))
+	for k, v := range h.values {
+		v.mu.Lock()
+		labels[k] = v.labels
+		snapshot[k] = sample{counts: append([]uint64(nil), v.counts...), count: v.count, sum: v.sum}
+		v.mu.Unlock()
+	}
+	h.mu.Unlock()
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	for _, k := range sortedKeys(labels) {
+		s := snapshot[k]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(labels[k], "le", formatFloat(le)), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(labels[k], "le", formatFloat(math.Inf(1))), s.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(labels[k]), formatFloat(s.sum)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(labels[k]), s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
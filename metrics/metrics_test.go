@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+// useRegistry makes the package level constructors register with a new registry for the test
+func useRegistry(t *testing.T) *Registry {
+	t.Helper()
+	prev := Default
+	Default = NewRegistry()
+	t.Cleanup(func() { Default = prev })
+	return Default
+}
+
+func TestRegistryWrite(t *testing.T) {
+	r := useRegistry(t)
+	requests := NewCounterVec("test_requests_total", "Requests by route.\nSecond line with a \\ backslash.", "route")
+	requests.With("DIRECT").Inc()
+	requests.With(`proxy "a"` + "\n" + `c:\`).Add(2.5)
+	connections := NewGaugeVec("test_connections", "Open connections.")
+	connections.With().Inc()
+	connections.With().Inc()
+	connections.With().Dec()
+	NewGaugeFuncVec("test_rate", "Rate by direction.", "dir").Func(func() float64 { return 0.25 }, "in")
+	dial := NewHistogramVec("test_dial_seconds", "Dial time.", []float64{1, 0.1}, "route")
+	dial.With("DIRECT").Observe(0.05)
+	dial.With("DIRECT").Observe(0.1)
+	dial.With("DIRECT").Observe(3)
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_connections Open connections.
+# TYPE test_connections gauge
+test_connections 1
+# HELP test_dial_seconds Dial time.
+# TYPE test_dial_seconds histogram
+test_dial_seconds_bucket{route="DIRECT",le="0.1"} 2
+test_dial_seconds_bucket{route="DIRECT",le="1"} 2
+test_dial_seconds_bucket{route="DIRECT",le="+Inf"} 3
+test_dial_seconds_sum{route="DIRECT"} 3.15
+test_dial_seconds_count{route="DIRECT"} 3
+# HELP test_rate Rate by direction.
+# TYPE test_rate gauge
+test_rate{dir="in"} 0.25
+# HELP test_requests_total Requests by route.\nSecond line with a \\ backslash.
+# TYPE test_requests_total counter
+test_requests_total{route="DIRECT"} 1
+test_requests_total{route="proxy \"a\"\nc:\\"} 2.5
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Write =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	useRegistry(t)
+	NewCounterVec("test_total", "Total.")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a duplicate metric did not panic")
+		}
+	}()
+	NewGaugeVec("test_total", "Total.")
+}
+
+func TestCounterDecrease(t *testing.T) {
+	useRegistry(t)
+	defer func() {
+		if recover() == nil {
+			t.Error("decreasing a counter did not panic")
+		}
+	}()
+	NewCounterVec("test_total", "Total.").With().Add(-1)
+}
+
+func TestLabelCount(t *testing.T) {
+	useRegistry(t)
+	defer func() {
+		if recover() == nil {
+			t.Error("wrong number of label values did not panic")
+		}
+	}()
+	NewCounterVec("test_total", "Total.", "a", "b").With("a")
+}
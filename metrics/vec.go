@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CounterVec is a family of counters partitioned by label values
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*value
+}
+
+// GaugeVec is a family of gauges partitioned by label values
+type GaugeVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*value
+}
+
+// value is a single counter or gauge sample
+type value struct {
+	labels []string
+	mu     sync.Mutex
+	v      float64
+}
+
+func (v *value) add(d float64) {
+	v.mu.Lock()
+	v.v += d
+	v.mu.Unlock()
+}
+
+func (v *value) set(f float64) {
+	v.mu.Lock()
+	v.v = f
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	v *value
+}
+
+// Inc increments the counter by 1
+func (c Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add adds a non-negative amount to the counter
+func (c Counter) Add(d float64) {
+	if d < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.v.add(d)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v *value
+}
+
+// Inc increments the gauge by 1
+func (g Gauge) Inc() {
+	g.v.add(1)
+}
+
+// Dec decrements the gauge by 1
+func (g Gauge) Dec() {
+	g.v.add(-1)
+}
+
+// Add adds an amount to the gauge
+func (g Gauge) Add(d float64) {
+	g.v.add(d)
+}
+
+// Set the gauge to a value
+func (g Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+// Value returns the current value of the gauge
+func (g Gauge) Value() float64 {
+	return g.v.get()
+}
+
+// NewCounterVec creates a counter family and registers it with the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]*value),
+	}
+	Default.Register(c)
+	return c
+}
+
+// NewGaugeVec creates a gauge family and registers it with the default registry
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		desc:   desc{name: name, help: help, typ: "gauge", labels: labels},
+		values: make(map[string]*value),
+	}
+	Default.Register(g)
+	return g
+}
+
+// With returns the counter for the label values, creating it if needed
+func (c *CounterVec) With(labels ...string) Counter {
+	return Counter{lookup(&c.desc, &c.mu, c.values, labels)}
+}
+
+// With returns the gauge for the label values, creating it if needed
+func (g *GaugeVec) With(labels ...string) Gauge {
+	return Gauge{lookup(&g.desc, &g.mu, g.values, labels)}
+}
+
+func lookup(d *desc, mu *sync.Mutex, values map[string]*value, labels []string) *value {
+	key := d.key(labels)
+	mu.Lock()
+	defer mu.Unlock()
+	v, ok := values[key]
+	if !ok {
+		v = &value{labels: append([]string(nil), labels...)}
+		values[key] = v
+	}
+	return v
+}
+
+func (c *CounterVec) Write(w io.Writer) error {
+	return writeValues(w, &c.desc, &c.mu, c.values)
+}
+
+func (g *GaugeVec) Write(w io.Writer) error {
+	return writeValues(w, &g.desc, &g.mu, g.values)
+}
+
+func writeValues(w io.Writer, d *desc, mu *sync.Mutex, values map[string]*value) error {
+	mu.Lock()
+	labels := make(map[string][]string, len(values))
+	snapshot := make(map[string]float64, len(values))
+	for k, v := range values {
+		labels[k] = v.labels
+		snapshot[k] = v.get()
+	}
+	mu.Unlock()
+	if err := d.writeHeader(w); err != nil {
+		return err
+	}
+	for _, k := range sortedKeys(labels) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", d.name, d.labelString(labels[k]), formatFloat(snapshot[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	certFile = "ca.pem"
+	keyFile  = "ca-key.pem"
+
+	// caValidity is how long a generated CA is valid for
+	caValidity = 10 * 365 * 24 * time.Hour
+)
+
+// ErrNoCA is returned by LoadCA when no CA has been initialized
+var ErrNoCA = errors.New("no CA found; run 'squiggly ca init'")
+
+// CA is a local certificate authority used to sign certificates for intercepted hosts
+type CA struct {
+	Cert *x509.Certificate
+	key  crypto.Signer
+	der  []byte
+}
+
+// DefaultDir returns the directory the CA is stored in when none is given
+func DefaultDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "squiggly", "ca"), nil
+}
+
+// InitCA generates a new CA and writes it to the directory.
+// An existing CA is not overwritten unless force is true.
+func InitCA(dir string, force bool) (*CA, error) {
+	if !force {
+		if _, err := os.Stat(filepath.Join(dir, keyFile)); err == nil {
+			return nil, fmt.Errorf("CA already exists in '%s'", dir)
+		}
+	}
+	ca, err := newCA()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(ca.key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, keyFile), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, certFile), ca.CertPEM(), 0644); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// LoadCA reads the CA from the directory
+func LoadCA(dir string) (*CA, error) {
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, certFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNoCA
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Join(dir, keyFile))
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("CA in '%s': %w", dir, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA in '%s': unsupported private key", dir)
+	}
+	return &CA{Cert: cert, key: key, der: pair.Certificate[0]}, nil
+}
+
+func newCA() (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       []string{"squiggly"},
+			OrganizationalUnit: []string{hostname},
+			CommonName:         "squiggly local CA",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, key: key, der: der}, nil
+}
+
+// CertPEM returns the PEM encoded CA certificate, suitable for adding to trust stores
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der})
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,45 @@
+package mitm
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitLoadCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := InitCA(dir, false)
+	if err != nil {
+		t.Fatalf("InitCA: %v", err)
+	}
+	if !ca.Cert.IsCA {
+		t.Error("CA certificate is not a CA")
+	}
+	loaded, err := LoadCA(dir)
+	if err != nil {
+		t.Fatalf("LoadCA: %v", err)
+	}
+	if !loaded.Cert.Equal(ca.Cert) {
+		t.Error("loaded CA certificate differs from the one written")
+	}
+	if !bytes.Equal(loaded.CertPEM(), ca.CertPEM()) {
+		t.Error("loaded CA PEM differs from the one written")
+	}
+	if _, err := InitCA(dir, false); err == nil {
+		t.Error("InitCA overwrote an existing CA without force")
+	}
+	replaced, err := InitCA(dir, true)
+	if err != nil {
+		t.Fatalf("InitCA with force: %v", err)
+	}
+	if replaced.Cert.Equal(ca.Cert) {
+		t.Error("InitCA with force kept the old CA")
+	}
+}
+
+func TestLoadCAMissing(t *testing.T) {
+	if _, err := LoadCA(filepath.Join(t.TempDir(), "ca")); !errors.Is(err, ErrNoCA) {
+		t.Errorf("LoadCA = %v, want %v", err, ErrNoCA)
+	}
+}
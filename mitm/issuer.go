@@ -0,0 +1,148 @@
+package mitm
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// leafValidity is how long minted leaf certificates are valid for
+	leafValidity = 7 * 24 * time.Hour
+	// leafRenewBefore re-mints cached certificates that are about to expire
+	leafRenewBefore = time.Hour
+	// leafCacheSize is the number of leaf certificates kept, the least recently used are dropped first
+	leafCacheSize = 4096
+)
+
+// Issuer mints leaf certificates signed by the CA on demand and caches them by host name.
+type Issuer struct {
+	ca  *CA
+	key crypto.Signer
+
+	mu    sync.Mutex
+	size  int
+	cache map[string]*list.Element
+	// lru holds the cached leafs, most recently used first
+	lru *list.List
+}
+
+// leaf is a cached certificate
+type leaf struct {
+	host string
+	cert *tls.Certificate
+}
+
+// NewIssuer creates an issuer for the CA. All leaf certificates share a single key pair.
+func NewIssuer(ca *CA) (*Issuer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{
+		ca:    ca,
+		key:   key,
+		size:  leafCacheSize,
+		cache: make(map[string]*list.Element),
+		lru:   list.New(),
+	}, nil
+}
+
+// TLSConfig returns a server TLS configuration presenting a certificate for the host.
+// The handshake fails if the client sends an SNI for another host, which was not checked against the intercept rules.
+func (is *Issuer) TLSConfig(host string) *tls.Config {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" && normalizeHost(hello.ServerName) != normalizeHost(host) {
+				return nil, fmt.Errorf("server name '%s' does not match the requested host '%s'", hello.ServerName, host)
+			}
+			return is.Certificate(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+}
+
+// Certificate returns a cached certificate for the host, minting a new one if needed
+func (is *Issuer) Certificate(host string) (*tls.Certificate, error) {
+	host = normalizeHost(host)
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if e, ok := is.cache[host]; ok {
+		if cert := e.Value.(*leaf).cert; time.Until(cert.Leaf.NotAfter) > leafRenewBefore {
+			is.lru.MoveToFront(e)
+			return cert, nil
+		}
+		is.lru.Remove(e)
+		delete(is.cache, host)
+	}
+	cert, err := is.mint(host)
+	if err != nil {
+		return nil, err
+	}
+	is.cache[host] = is.lru.PushFront(&leaf{host: host, cert: cert})
+	for is.lru.Len() > is.size {
+		oldest := is.lru.Back()
+		is.lru.Remove(oldest)
+		delete(is.cache, oldest.Value.(*leaf).host)
+	}
+	return cert, nil
+}
+
+// normalizeHost lower-cases the host and strips a trailing dot
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (is *Issuer) mint(host string) (*tls.Certificate, error) {
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(leafValidity)
+	if notAfter.After(is.ca.Cert.NotAfter) {
+		notAfter = is.ca.Cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"squiggly"},
+			CommonName:   host,
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, is.ca.Cert, is.key.Public(), is.ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, is.ca.der},
+		PrivateKey:  is.key,
+		Leaf:        leaf,
+	}, nil
+}
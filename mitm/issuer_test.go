@@ -0,0 +1,120 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func newTestIssuer(t *testing.T) (*CA, *Issuer) {
+	t.Helper()
+	ca, err := newCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, err := NewIssuer(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, is
+}
+
+func TestIssuerCertificateVerifies(t *testing.T) {
+	ca, is := newTestIssuer(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	for _, host := range []string{"www.example.com", "192.0.2.1", "2001:db8::1"} {
+		t.Run(host, func(t *testing.T) {
+			cert, err := is.Certificate(host)
+			if err != nil {
+				t.Fatalf("Certificate: %v", err)
+			}
+			_, err = cert.Leaf.Verify(x509.VerifyOptions{
+				DNSName:   host,
+				Roots:     roots,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			if err != nil {
+				t.Errorf("leaf does not verify against the CA: %v", err)
+			}
+			if ip := net.ParseIP(host); ip != nil && len(cert.Leaf.IPAddresses) != 1 {
+				t.Errorf("IPAddresses = %v, want %s", cert.Leaf.IPAddresses, host)
+			}
+		})
+	}
+}
+
+func TestIssuerCache(t *testing.T) {
+	_, is := newTestIssuer(t)
+	first, err := is.Certificate("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := is.Certificate("WWW.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Error("certificate was minted again instead of cached")
+	}
+}
+
+func TestIssuerCacheEvicts(t *testing.T) {
+	_, is := newTestIssuer(t)
+	is.size = 3
+	get := func(host string) {
+		t.Helper()
+		if _, err := is.Certificate(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		get("host" + strconv.Itoa(i) + ".example.com")
+	}
+	// host0 is used again, so host1 is the least recently used
+	get("host0.example.com")
+	get("host3.example.com")
+	if is.lru.Len() != 3 || len(is.cache) != 3 {
+		t.Fatalf("cache holds %d/%d certificates, want 3", is.lru.Len(), len(is.cache))
+	}
+	if _, ok := is.cache["host1.example.com"]; ok {
+		t.Error("least recently used certificate was not evicted")
+	}
+	for _, host := range []string{"host0.example.com", "host2.example.com", "host3.example.com"} {
+		if _, ok := is.cache[host]; !ok {
+			t.Errorf("%s was evicted", host)
+		}
+	}
+}
+
+func TestIssuerTLSConfigServerName(t *testing.T) {
+	ca, is := newTestIssuer(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	tests := []struct {
+		name       string
+		serverName string
+		wantErr    bool
+	}{
+		{name: "same host", serverName: "www.example.com"},
+		{name: "same host different case", serverName: "WWW.example.com"},
+		{name: "other host", serverName: "www.bank.example", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go func() {
+				_ = tls.Server(server, is.TLSConfig("www.example.com:443")).Handshake()
+				server.Close()
+			}()
+			err := tls.Client(client, &tls.Config{ServerName: tt.serverName, RootCAs: roots}).Handshake()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Handshake() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package pac
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	findProxyParams = regexp.MustCompile(`FindProxyForURL\s*\(\s*\w+\s*,\s*(\w+)\s*\)`)
+	ifStatement     = regexp.MustCompile(`\bif\s*\(`)
+	returnDirect    = regexp.MustCompile(`^\s*\{?\s*return\s*["']\s*(?i:direct)\s*["']`)
+)
+
+// DirectHosts returns the hosts, domains and networks the PAC file connects to directly, as NO_PROXY entries.
+// They are pulled out of if statements returning "DIRECT" whose condition is one or more simple host tests
+// (dnsDomainIs, localHostOrDomainIs, shExpMatch, isInNet, ==) joined by ||. Each entry is checked
+// against the PAC itself, since an earlier rule may send it to a proxy. Other rules are left out.
+func (r *PAC) DirectHosts() []string {
+	r.mu.RLock()
+	source := r.source
+	r.mu.RUnlock()
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, h := range directCandidates(source) {
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		// a domain is checked with a host in it, and a network with its first address
+		probe := h
+		if strings.HasPrefix(probe, ".") {
+			probe = "www" + probe
+		}
+		if i := strings.IndexByte(probe, '/'); i >= 0 {
+			probe = probe[:i]
+		}
+		proxies, err := r.ProxyForRequest("http://"+probe+"/", probe)
+		if err == nil && len(proxies) > 0 && proxies[0] == Direct {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// directCandidates returns the NO_PROXY entries of the simple conditions of the if statements that return "DIRECT"
+func directCandidates(source string) []string {
+	host := "host"
+	if m := findProxyParams.FindStringSubmatch(source); m != nil {
+		host = m[1]
+	}
+	q := `["']([^"']+)["']`
+	arg := `\(\s*` + host + `\s*,\s*` + q
+	var (
+		dnsDomainIs         = regexp.MustCompile(`^dnsDomainIs` + arg + `\s*\)$`)
+		localHostOrDomainIs = regexp.MustCompile(`^localHostOrDomainIs` + arg + `\s*\)$`)
+		shExpMatch          = regexp.MustCompile(`^shExpMatch` + arg + `\s*\)$`)
+		hostEquals          = regexp.MustCompile(`^` + host + `\s*===?\s*` + q + `$`)
+		equalsHost          = regexp.MustCompile(`^` + q + `\s*===?\s*` + host + `$`)
+		isInNet             = regexp.MustCompile(`^isInNet\(\s*(?:` + host + `|dnsResolve\(\s*` + host + `\s*\))\s*,\s*` + q + `\s*,\s*` + q + `\s*\)$`)
+	)
+	var hosts []string
+	for _, loc := range ifStatement.FindAllStringIndex(source, -1) {
+		open := loc[1] - 1
+		end := closingParen(source, open)
+		if end < 0 || !returnDirect.MatchString(source[end+1:]) {
+			continue
+		}
+		for _, term := range splitOr(source[open+1 : end]) {
+			term = trimParens(term)
+			if strings.Contains(term, "&&") || strings.Contains(term, "!") {
+				continue
+			}
+			if m := dnsDomainIs.FindStringSubmatch(term); m != nil {
+				hosts = append(hosts, m[1])
+			} else if m := localHostOrDomainIs.FindStringSubmatch(term); m != nil {
+				hosts = append(hosts, m[1])
+			} else if m := hostEquals.FindStringSubmatch(term); m != nil {
+				hosts = append(hosts, m[1])
+			} else if m := equalsHost.FindStringSubmatch(term); m != nil {
+				hosts = append(hosts, m[1])
+			} else if m := shExpMatch.FindStringSubmatch(term); m != nil {
+				if h, ok := shExpHost(m[1]); ok {
+					hosts = append(hosts, h)
+				}
+			} else if m := isInNet.FindStringSubmatch(term); m != nil {
+				if n, ok := network(m[1], m[2]); ok {
+					hosts = append(hosts, n)
+				}
+			}
+		}
+	}
+	return hosts
+}
+
+// closingParen returns the index of the parenthesis closing the one at open, or -1
+func closingParen(s string, open int) int {
+	depth := 0
+	var quote byte
+	for i := open; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitOr splits a condition on the || operators outside of parentheses
+func splitOr(cond string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i := 0; i < len(cond); i++ {
+		switch cond[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '|':
+			if depth == 0 && i+1 < len(cond) && cond[i+1] == '|' {
+				terms = append(terms, cond[start:i])
+				start = i + 2
+				i++
+			}
+		}
+	}
+	return append(terms, cond[start:])
+}
+
+// trimParens removes the spaces and the parentheses around a term
+func trimParens(term string) string {
+	term = strings.TrimSpace(term)
+	for strings.HasPrefix(term, "(") && closingParen(term, 0) == len(term)-1 {
+		term = strings.TrimSpace(term[1 : len(term)-1])
+	}
+	return term
+}
+
+// shExpHost converts a host pattern without wildcards, or one starting with "*.", to a NO_PROXY entry
+func shExpHost(pattern string) (string, bool) {
+	if strings.HasPrefix(pattern, "*.") {
+		pattern = pattern[1:]
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		return "", false
+	}
+	return pattern, true
+}
+
+// network converts the address and mask of isInNet to a CIDR block
+func network(addr, mask string) (string, bool) {
+	ip, m := net.ParseIP(addr).To4(), net.ParseIP(mask).To4()
+	if ip == nil || m == nil {
+		return "", false
+	}
+	ones, bits := net.IPMask(m).Size()
+	if bits == 0 {
+		return "", false
+	}
+	return ip.Mask(net.IPMask(m)).String() + "/" + strconv.Itoa(ones), true
+}
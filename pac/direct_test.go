@@ -0,0 +1,55 @@
+package pac
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const directPAC = `function FindProxyForURL(url, h) {
+	if (dnsDomainIs(h, "build.corp.example.com")) {
+		return "PROXY proxy.example.com:8080";
+	}
+	if (dnsDomainIs(h, ".corp.example.com") || localHostOrDomainIs(h, "intranet") ||
+		(shExpMatch(h, "*.internal.example.com")) || shExpMatch(h, "git-*.example.com"))
+		return "DIRECT";
+	if (h == "wiki.example.com" || isInNet(dnsResolve(h), "10.0.0.0", "255.0.0.0")) { return 'DIRECT'; }
+	if (dnsDomainIs(h, ".both.example.com") && isPlainHostName(h)) return "DIRECT";
+	if (dnsDomainIs(h, ".proxied.example.com")) return "PROXY proxy.example.com:8080; DIRECT";
+	if (shExpMatch(url, "http://*.example.org/*")) return "DIRECT";
+	if (dnsDomainIs(h, "build.corp.example.com") || h === "docs.example.com") return "DIRECT";
+	return "PROXY proxy.example.com:8080";
+}`
+
+func TestDirectHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := ioutil.WriteFile(path, []byte(directPAC), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &PAC{URL: "file://" + filepath.ToSlash(path)}
+	if _, err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".corp.example.com", "intranet", ".internal.example.com", "wiki.example.com", "10.0.0.0/8", "docs.example.com"}
+	if got := p.DirectHosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DirectHosts() = %q, want %q", got, want)
+	}
+}
+
+func TestDirectCandidatesSkipsNegation(t *testing.T) {
+	source := `function FindProxyForURL(url, host) {
+		if (!dnsDomainIs(host, ".public.example.com") || host != "www.example.com") return "DIRECT";
+		return "PROXY proxy.example.com:8080";
+	}`
+	if got := directCandidates(source); len(got) != 0 {
+		t.Errorf("directCandidates() = %q, want none", got)
+	}
+}
+
+func TestDirectHostsNotLoaded(t *testing.T) {
+	p := &PAC{URL: "file:///nonexistent.pac"}
+	if got := p.DirectHosts(); len(got) != 0 {
+		t.Errorf("DirectHosts() = %q, want none", got)
+	}
+}
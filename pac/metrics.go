@@ -0,0 +1,16 @@
+package pac
+
+import "github.com/justenwalker/squiggly/metrics"
+
+var (
+	pacRefreshes = metrics.NewCounterVec(
+		"squiggly_pac_refreshes_total",
+		"PAC file refreshes by outcome.",
+		"outcome",
+	)
+	pacEvalDuration = metrics.NewHistogramVec(
+		"squiggly_pac_eval_duration_seconds",
+		"Time spent evaluating FindProxyForURL in the PAC file.",
+		[]float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	)
+)
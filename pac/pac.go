@@ -13,34 +13,83 @@ import (
 	"time"
 
 	"github.com/jackwakefield/gopac"
+	"github.com/justenwalker/squiggly/logging"
 )
 
 const lastModifiedFormat = "2006-01-02 15:04:05 GMT"
 
-var noProxyTransport http.RoundTripper = &http.Transport{
-	DialContext: (&net.Dialer{
-		Timeout:   1 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}).DialContext,
-	MaxIdleConns:          0,
-	IdleConnTimeout:       0 * time.Second,
-	TLSHandshakeTimeout:   10 * time.Second,
-	ExpectContinueTimeout: 1 * time.Second,
-}
+// DefaultDialTimeout is the time allowed to connect to the PAC server, if the PAC has no DialTimeout
+const DefaultDialTimeout = 1 * time.Second
 
-var noProxyClient = &http.Client{
-	Transport: noProxyTransport,
+// noProxyClient returns a client that connects to the PAC server directly
+func noProxyClient(dialTimeout, fetchTimeout time.Duration) *http.Client {
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+	return &http.Client{
+		Timeout: fetchTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          0,
+			IdleConnTimeout:       0 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
 }
 
 type PAC struct {
-	URL          string
+	URL    string
+	Logger *logging.EventLogger
+	// DialTimeout limits connecting to the PAC server. Zero means DefaultDialTimeout.
+	DialTimeout time.Duration
+	// FetchTimeout limits fetching the PAC file, including reading it. Zero means no limit.
+	FetchTimeout time.Duration
+
+	clientOnce   sync.Once
+	client       *http.Client
 	parsed       *gopac.Parser
+	source       string
 	etag         string
 	lastModified time.Time
 	lastRefresh  time.Time
+	lastUpdate   time.Time
+	lastError    error
 	mu           sync.RWMutex
 }
 
+// Status describes the state of the PAC file
+type Status struct {
+	URL          string    `json:"url"`
+	Loaded       bool      `json:"loaded"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+	LastRefresh  time.Time `json:"last_refresh"`
+	LastUpdate   time.Time `json:"last_update"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// Status returns the current state of the PAC file
+func (r *PAC) Status() Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	st := Status{
+		URL:          r.URL,
+		Loaded:       r.parsed != nil,
+		ETag:         r.etag,
+		LastModified: r.lastModified,
+		LastRefresh:  r.lastRefresh,
+		LastUpdate:   r.lastUpdate,
+	}
+	if r.lastError != nil {
+		st.LastError = r.lastError.Error()
+	}
+	return st
+}
+
 // Proxy returns the proxy URL for a request, or nil if the request should not be proxied
 type Proxy interface {
 	Proxy(req *http.Request) (*url.URL, error)
@@ -71,7 +120,9 @@ func (r *PAC) ProxyForRequest(url, host string) ([]Proxy, error) {
 	if r.parsed == nil {
 		return nil, nil
 	}
+	start := time.Now()
 	result, err := r.parsed.FindProxy(url, host)
+	pacEvalDuration.With().ObserveDuration(start)
 	if err != nil {
 		return nil, err
 	}
@@ -80,6 +131,16 @@ func (r *PAC) ProxyForRequest(url, host string) ([]Proxy, error) {
 
 // Proxy function to be used in a transport
 func (r *PAC) Proxy(req *http.Request) (*url.URL, error) {
+	proxies, err := r.Proxies(req)
+	if err != nil || len(proxies) == 0 {
+		return nil, err
+	}
+	return proxies[0], nil
+}
+
+// Proxies returns every proxy the PAC file lists for the request, in order.
+// A nil URL is a direct connection.
+func (r *PAC) Proxies(req *http.Request) ([]*url.URL, error) {
 	r.mu.RLock()
 	lastRefresh := r.lastRefresh
 	r.mu.RUnlock()
@@ -90,19 +151,52 @@ func (r *PAC) Proxy(req *http.Request) (*url.URL, error) {
 	}
 	proxies, err := r.ProxyForRequest(req.URL.String(), req.URL.Hostname())
 	if err != nil {
+		r.Logger.Warn("PAC evaluation failed", logging.F(logging.KeyTarget, req.URL.Host), logging.Err(err))
 		return nil, nil
 	}
-	if len(proxies) == 0 {
-		return nil, nil
+	urls := make([]*url.URL, 0, len(proxies))
+	for _, p := range proxies {
+		u, err := p.Proxy(req)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
 	}
-	return proxies[0].Proxy(req)
+	return urls, nil
 }
 
 // Refresh fetches the PAC file
 // The boolean returned indicates if an update occurred
 func (r *PAC) Refresh() (bool, error) {
+	updated, err := r.refresh()
+	r.mu.Lock()
+	prev := r.lastError
+	r.lastError = err
+	if updated {
+		r.lastUpdate = time.Now()
+	}
+	r.mu.Unlock()
+	if err != nil {
+		// An unreachable PAC server fails on every refresh, so only a new failure is a warning
+		log := r.Logger.Warn
+		if prev != nil && prev.Error() == err.Error() {
+			log = r.Logger.Debug
+		}
+		log("PAC refresh failed", logging.F(logging.KeyURL, r.URL), logging.Err(err))
+		pacRefreshes.With("failure").Inc()
+	} else {
+		if updated {
+			r.Logger.Info("PAC updated", logging.F(logging.KeyURL, r.URL))
+		}
+		pacRefreshes.With("success").Inc()
+	}
+	return updated, err
+}
+
+func (r *PAC) refresh() (bool, error) {
 	r.mu.Lock()
 	r.lastRefresh = time.Now()
+	etag, lastModified := r.etag, r.lastModified
 	r.mu.Unlock()
 	u, err := url.Parse(r.URL)
 	if err != nil {
@@ -116,7 +210,7 @@ func (r *PAC) Refresh() (bool, error) {
 			return false, err
 		}
 		modified := stat.ModTime()
-		if modified.After(r.lastModified) {
+		if modified.After(lastModified) {
 			bytes, err := ioutil.ReadFile(path)
 			if err != nil {
 				return false, err
@@ -128,6 +222,7 @@ func (r *PAC) Refresh() (bool, error) {
 				return false, err
 			}
 			r.parsed = parser
+			r.source = string(bytes)
 			r.lastModified = modified
 			return true, nil
 		}
@@ -136,12 +231,15 @@ func (r *PAC) Refresh() (bool, error) {
 		if err != nil {
 			return false, err
 		}
-		if r.etag != "" {
-			req.Header.Set("If-None-Match", r.etag)
-		} else if !r.lastModified.IsZero() {
-			req.Header.Set("If-Modified-Since", r.lastModified.Format(lastModifiedFormat))
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		} else if !lastModified.IsZero() {
+			req.Header.Set("If-Modified-Since", lastModified.Format(lastModifiedFormat))
 		}
-		resp, err := noProxyClient.Do(req)
+		r.clientOnce.Do(func() {
+			r.client = noProxyClient(r.DialTimeout, r.FetchTimeout)
+		})
+		resp, err := r.client.Do(req)
 		if err != nil {
 			return false, err
 		}
@@ -161,6 +259,7 @@ func (r *PAC) Refresh() (bool, error) {
 				return false, err
 			}
 			r.parsed = parser
+			r.source = string(bytes)
 			r.etag = resp.Header.Get("ETag")
 			if lm := resp.Header.Get("Last-Modified"); lm != "" {
 				if date, err := time.Parse(lastModifiedFormat, lm); err == nil {
@@ -180,8 +279,14 @@ func parsePACResult(result string) ([]Proxy, error) {
 	for _, p := range strings.Split(result, ";") {
 		p = strings.ToLower(strings.TrimSpace(p))
 		if strings.HasPrefix(p, "proxy") {
-			hostport := strings.TrimSpace(strings.TrimPrefix(p, "proxy"))
-			purl, err := url.Parse(fmt.Sprintf("http://%s/", hostport))
+			purl, err := parsePACProxy("http", strings.TrimPrefix(p, "proxy"))
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, proxyURL{purl})
+		}
+		if strings.HasPrefix(p, "https") {
+			purl, err := parsePACProxy("https", strings.TrimPrefix(p, "https"))
 			if err != nil {
 				return nil, err
 			}
@@ -193,3 +298,17 @@ func parsePACResult(result string) ([]Proxy, error) {
 	}
 	return proxies, nil
 }
+
+// parsePACProxy parses the host:port of a PROXY or HTTPS result.
+// IPv6 addresses should be in brackets; a bare IPv6 address is taken to have no port.
+func parsePACProxy(scheme string, hostport string) (*url.URL, error) {
+	hostport = strings.TrimSpace(hostport)
+	if ip := net.ParseIP(hostport); ip != nil && ip.To4() == nil {
+		hostport = "[" + hostport + "]"
+	}
+	purl, err := url.Parse(scheme + "://" + hostport + "/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy '%s' in PAC result: %w", hostport, err)
+	}
+	return purl, nil
+}
@@ -0,0 +1,99 @@
+package pac
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+func TestParsePACResult(t *testing.T) {
+	tests := []struct {
+		result string
+		want   []string
+	}{
+		{result: "DIRECT", want: []string{"DIRECT"}},
+		{result: "PROXY proxy.example.com:8080; DIRECT", want: []string{"http://proxy.example.com:8080/", "DIRECT"}},
+		{result: "PROXY 192.0.2.1:3128", want: []string{"http://192.0.2.1:3128/"}},
+		{result: "HTTPS proxy.example.com:443", want: []string{"https://proxy.example.com:443/"}},
+		{result: "PROXY [2001:db8::1]:8080", want: []string{"http://[2001:db8::1]:8080/"}},
+		{result: "HTTPS [2001:db8::1]:443; PROXY [2001:db8::2]:3128", want: []string{"https://[2001:db8::1]:443/", "http://[2001:db8::2]:3128/"}},
+		{result: "PROXY 2001:db8::1", want: []string{"http://[2001:db8::1]/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.result, func(t *testing.T) {
+			proxies, err := parsePACResult(tt.result)
+			if err != nil {
+				t.Fatalf("parsePACResult: %v", err)
+			}
+			if len(proxies) != len(tt.want) {
+				t.Fatalf("got %d proxies, want %d", len(proxies), len(tt.want))
+			}
+			for i, p := range proxies {
+				got := "DIRECT"
+				if pu, ok := p.(proxyURL); ok {
+					got = pu.URL.String()
+				}
+				if got != tt.want[i] {
+					t.Errorf("proxy %d = %q, want %q", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParsePACResultIPv6Hostname(t *testing.T) {
+	proxies, err := parsePACResult("PROXY [2001:db8::1]:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := proxies[0].(proxyURL).URL
+	if u.Hostname() != "2001:db8::1" || u.Port() != "8080" {
+		t.Errorf("got host %q port %q", u.Hostname(), u.Port())
+	}
+}
+
+func TestRefreshLogsRepeatedFailuresAtDebug(t *testing.T) {
+	dir := t.TempDir()
+	fileURL := func(name string) string {
+		return (&url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(dir, name))}).String()
+	}
+	var buf bytes.Buffer
+	r := &PAC{Logger: logging.NewEventLogger(&buf, logging.LevelDebug, logging.TextEncoder{})}
+	steps := []struct {
+		name  string
+		file  string
+		write bool
+		level string
+	}{
+		{name: "first failure", file: "missing.pac", level: "warn"},
+		{name: "same failure", file: "missing.pac", level: "debug"},
+		{name: "different failure", file: "other.pac", level: "warn"},
+		{name: "success", file: "proxy.pac", write: true},
+		{name: "failure after success", file: "other.pac", level: "warn"},
+	}
+	for _, st := range steps {
+		buf.Reset()
+		if st.write {
+			script := `function FindProxyForURL(url, host) { return "DIRECT"; }`
+			if err := ioutil.WriteFile(filepath.Join(dir, st.file), []byte(script), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.URL = fileURL(st.file)
+		_, err := r.Refresh()
+		if (err != nil) != (st.level != "") {
+			t.Fatalf("%s: Refresh() error = %v", st.name, err)
+		}
+		if st.level == "" {
+			continue
+		}
+		if line := buf.String(); !strings.Contains(line, "PAC refresh failed") || !strings.Contains(line, st.level) {
+			t.Errorf("%s: logged %q, want PAC refresh failed at %s", st.name, line, st.level)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+type accessKey struct{}
+
+// accessRecord collects the access log entry of a request or tunnel as it is proxied.
+// It is carried in the request context, so that the dialer can record the route and upstream auth scheme.
+type accessRecord struct {
+	start     time.Time
+	bytesIn   int64
+	bytesOut  int64
+	decrypted bool
+	once      sync.Once
+	// flow limits and measures the traffic of the request or tunnel
+	flow *flow
+
+	mu    sync.Mutex
+	entry logging.AccessEntry
+	// upstreams and challenges are the upstream proxies tried and the auth schemes they asked for,
+	// reported to the client when the connection fails
+	upstreams  []string
+	challenges []string
+}
+
+func newAccessRecord(ctx context.Context, client, method, target, proto string) *accessRecord {
+	return &accessRecord{
+		start: time.Now(),
+		entry: logging.AccessEntry{
+			RequestID: logging.RequestID(ctx),
+			Client:    client,
+			Method:    method,
+			Target:    target,
+			Proto:     proto,
+		},
+	}
+}
+
+// withAccessRecord starts recording the request, and returns it with the record in its context
+func withAccessRecord(req *http.Request) (*http.Request, *accessRecord) {
+	rec := newAccessRecord(req.Context(), req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+	if req.Method == http.MethodConnect {
+		rec.entry.Target = req.Host
+	}
+	rec.entry.Referer = req.Referer()
+	rec.entry.UserAgent = req.UserAgent()
+	return req.WithContext(withRecord(req.Context(), rec)), rec
+}
+
+func withRecord(ctx context.Context, rec *accessRecord) context.Context {
+	return context.WithValue(ctx, accessKey{}, rec)
+}
+
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	rec, _ := ctx.Value(accessKey{}).(*accessRecord)
+	return rec
+}
+
+// client returns the address of the client, or an empty string if there is no record
+func (r *accessRecord) client() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.entry.Client
+}
+
+// addUpstream records an upstream proxy that was tried
+func (r *accessRecord) addUpstream(upstream string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.upstreams = append(r.upstreams, upstream)
+	r.mu.Unlock()
+}
+
+// addChallenges records the auth schemes of a 407 response from an upstream proxy
+func (r *accessRecord) addChallenges(resp *http.Response) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, challenge := range resp.Header.Values("Proxy-Authenticate") {
+		fields := strings.Fields(challenge)
+		if len(fields) == 0 {
+			continue
+		}
+		if scheme := strings.ToLower(fields[0]); !containsString(r.challenges, scheme) {
+			r.challenges = append(r.challenges, scheme)
+		}
+	}
+}
+
+// diagnostics returns the route, the upstream proxies tried and the auth schemes they asked for
+func (r *accessRecord) diagnostics() (string, []string, []string) {
+	if r == nil {
+		return "", nil, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.entry.Route, append([]string(nil), r.upstreams...), append([]string(nil), r.challenges...)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the route recorded for the request, or DIRECT if none was, as for a cache hit
+func (r *accessRecord) route() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entry.Route == "" {
+		return routeDirect
+	}
+	return r.entry.Route
+}
+
+func (r *accessRecord) setRoute(route string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.entry.Route = route
+	r.mu.Unlock()
+}
+
+func (r *accessRecord) setAuthScheme(scheme string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.entry.AuthScheme = scheme
+	r.mu.Unlock()
+}
+
+func (r *accessRecord) setUser(user string) {
+	r.mu.Lock()
+	r.entry.User = user
+	r.mu.Unlock()
+}
+
+func (r *accessRecord) setCache(status string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.entry.Cache = status
+	r.mu.Unlock()
+}
+
+func (r *accessRecord) setStatus(status int) {
+	r.mu.Lock()
+	r.entry.Status = status
+	r.mu.Unlock()
+}
+
+// logAccess writes the access log entry. Only the first call for a record has any effect.
+func (s *Server) logAccess(r *accessRecord) {
+	r.once.Do(func() {
+		r.mu.Lock()
+		e := r.entry
+		r.mu.Unlock()
+		e.Time = r.start
+		e.Duration = time.Since(r.start)
+		e.BytesIn = atomic.LoadInt64(&r.bytesIn)
+		e.BytesOut = atomic.LoadInt64(&r.bytesOut)
+		if e.Route == "" {
+			e.Route = routeDirect
+		}
+		s.accessLog.Log(&e)
+	})
+}
+
+// countingBody counts the bytes read from a request or response body,
+// and calls done on EOF or when the body is closed, whichever happens first.
+type countingBody struct {
+	io.ReadCloser
+	n    *int64
+	done func()
+	// flow limits the rate the body is read at
+	flow *flow
+	dir  direction
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	b.flow.transfer(n, b.dir)
+	if err == io.EOF && b.done != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.done != nil {
+		b.done()
+	}
+	return err
+}
+
+// accessWriter records the status and size of a response written to the client
+type accessWriter struct {
+	http.ResponseWriter
+	rec         *accessRecord
+	wroteHeader bool
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.rec.setStatus(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.rec.bytesOut, int64(n))
+	w.rec.flow.transfer(n, directionOut)
+	return n, err
+}
+
+// AccessLog writes a line for every proxied request, CONNECT, SOCKS and transparent tunnel to the access log
+func AccessLog(l *logging.AccessLog) Option {
+	return func(s *Server) {
+		s.accessLog = l
+	}
+}
+
+// RequestIDHeader is the response header carrying the request ID, when enabled with the RequestIDHeader option
+const RequestIDHeader = "X-Squiggly-Request-Id"
+
+// withRequestID returns the request with a new request ID in its context
+func withRequestID(req *http.Request) *http.Request {
+	return req.WithContext(logging.WithRequestID(req.Context(), logging.NewRequestID()))
+}
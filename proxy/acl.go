@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// clientAuthRealm is the realm presented to clients in the Proxy-Authenticate challenge
+const clientAuthRealm = "squiggly"
+
+// ClientVerifier checks inbound proxy credentials
+type ClientVerifier interface {
+	Verify(username, password string) bool
+}
+
+// ParseCIDRs parses a list of CIDR blocks. Bare IP addresses are treated as a single host.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client address '%s'", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client network '%s': %w", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP extracts the IP address of a client from its remote address.
+// It returns nil for clients without an IP address, such as unix socket peers.
+func clientIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// allowClient reports whether a client may use the proxy according to the allow and deny lists.
+// Deny rules take precedence. Clients without an IP address (unix sockets) are always allowed;
+// access to those is controlled by the socket file permissions.
+func (s *Server) allowClient(remoteAddr string) bool {
+	ip := clientIP(remoteAddr)
+	if ip == nil {
+		return true
+	}
+	if containsIP(s.denyClients, ip) {
+		return false
+	}
+	if len(s.allowClients) > 0 {
+		return containsIP(s.allowClients, ip)
+	}
+	return true
+}
+
+// authorizeClient checks the client Proxy-Authorization Basic credentials, if client auth is configured.
+func (s *Server) authorizeClient(req *http.Request) bool {
+	if s.clientAuth == nil {
+		return true
+	}
+	username, password, ok := parseProxyBasicAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return false
+	}
+	return s.clientAuth.Verify(username, password)
+}
+
+func parseProxyBasicAuth(header string) (username, password string, ok bool) {
+	const prefix = "basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	c, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(string(c), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// checkAccess applies the client ACL and inbound authentication to a request, and records the client user name.
+// It writes a 403 or 407 response and returns its status if the request should not be proxied,
+// or returns 200 if it may be proxied.
+func (s *Server) checkAccess(w http.ResponseWriter, req *http.Request, rec *accessRecord) int {
+	if !s.allowClient(req.RemoteAddr) {
+		s.logger.Ctx(req.Context()).Warn("client denied", logging.F(logging.KeyClient, req.RemoteAddr))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return http.StatusForbidden
+	}
+	if s.clientAuth != nil {
+		if username, _, ok := parseProxyBasicAuth(req.Header.Get("Proxy-Authorization")); ok {
+			rec.setUser(username)
+		}
+	}
+	if !s.authorizeClient(req) {
+		s.logger.Ctx(req.Context()).Debug("client proxy authentication required", logging.F(logging.KeyClient, req.RemoteAddr))
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", clientAuthRealm))
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return http.StatusProxyAuthRequired
+	}
+	// Never forward the client's credentials upstream
+	req.Header.Del("Proxy-Authorization")
+	return http.StatusOK
+}
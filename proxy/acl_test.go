@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	nets, err := ParseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets := mustParseCIDRs(t, "10.0.0.0/8", " 192.0.2.1 ", "", "2001:db8::/32", "2001:db8::1")
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32", "2001:db8::1/128"}
+	if len(nets) != len(want) {
+		t.Fatalf("ParseCIDRs = %v, want %v", nets, want)
+	}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Errorf("network %d = %s, want %s", i, n, want[i])
+		}
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "example.com", "10.0.0"} {
+		if _, err := ParseCIDRs([]string{invalid}); err == nil {
+			t.Errorf("ParseCIDRs(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestAllowClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  []string
+		deny   []string
+		remote string
+		want   bool
+	}{
+		{name: "no rules", remote: "203.0.113.1:1234", want: true},
+		{name: "allowed", allow: []string{"10.0.0.0/8"}, remote: "10.1.2.3:1234", want: true},
+		{name: "not allowed", allow: []string{"10.0.0.0/8"}, remote: "192.0.2.1:1234", want: false},
+		{name: "denied", deny: []string{"192.0.2.0/24"}, remote: "192.0.2.1:1234", want: false},
+		{name: "not denied", deny: []string{"192.0.2.0/24"}, remote: "198.51.100.1:1234", want: true},
+		{name: "deny wins", allow: []string{"10.0.0.0/8"}, deny: []string{"10.1.0.0/16"}, remote: "10.1.2.3:1234", want: false},
+		{name: "single host", allow: []string{"127.0.0.1"}, remote: "127.0.0.1:1234", want: true},
+		{name: "ipv6", allow: []string{"2001:db8::/32"}, remote: "[2001:db8::1]:1234", want: true},
+		{name: "ipv6 zone", allow: []string{"fe80::/10"}, remote: "[fe80::1%eth0]:1234", want: true},
+		{name: "ipv4 mapped", allow: []string{"10.0.0.0/8"}, remote: "[::ffff:10.1.2.3]:1234", want: true},
+		{name: "unix socket", allow: []string{"10.0.0.0/8"}, remote: "@", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{allowClients: mustParseCIDRs(t, tt.allow...), denyClients: mustParseCIDRs(t, tt.deny...)}
+			if got := s.allowClient(tt.remote); got != tt.want {
+				t.Errorf("allowClient(%q) = %v, want %v", tt.remote, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProxyBasicAuth(t *testing.T) {
+	basic := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		header   string
+		username string
+		password string
+		ok       bool
+	}{
+		{header: "Basic " + basic("alice:secret"), username: "alice", password: "secret", ok: true},
+		{header: "basic " + basic("alice:with:colon"), username: "alice", password: "with:colon", ok: true},
+		{header: "Basic " + basic("alice:"), username: "alice", password: "", ok: true},
+		{header: "Basic " + basic("alice")},
+		{header: "Basic !!!"},
+		{header: "Negotiate " + basic("alice:secret")},
+		{header: ""},
+	}
+	for _, tt := range tests {
+		username, password, ok := parseProxyBasicAuth(tt.header)
+		if username != tt.username || password != tt.password || ok != tt.ok {
+			t.Errorf("parseProxyBasicAuth(%q) = %q, %q, %v", tt.header, username, password, ok)
+		}
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	s := &Server{
+		denyClients: mustParseCIDRs(t, "192.0.2.0/24"),
+		clientAuth:  staticVerifier{username: "alice", password: "secret"},
+	}
+	tests := []struct {
+		name   string
+		remote string
+		auth   string
+		want   int
+		user   string
+	}{
+		{name: "denied", remote: "192.0.2.1:1234", auth: "alice:secret", want: http.StatusForbidden},
+		{name: "no credentials", remote: "198.51.100.1:1234", want: http.StatusProxyAuthRequired},
+		{name: "wrong password", remote: "198.51.100.1:1234", auth: "alice:wrong", want: http.StatusProxyAuthRequired, user: "alice"},
+		{name: "authorized", remote: "198.51.100.1:1234", auth: "alice:secret", want: http.StatusOK, user: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.auth != "" {
+				req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(tt.auth)))
+			}
+			w := httptest.NewRecorder()
+			rec := newAccessRecord(req.Context(), tt.remote, req.Method, req.URL.String(), req.Proto)
+			if got := s.checkAccess(w, req, rec); got != tt.want {
+				t.Fatalf("checkAccess = %d, want %d", got, tt.want)
+			}
+			if tt.want != http.StatusOK && w.Code != tt.want {
+				t.Errorf("response status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusProxyAuthRequired && w.Header().Get("Proxy-Authenticate") == "" {
+				t.Error("missing Proxy-Authenticate challenge")
+			}
+			if tt.want == http.StatusOK && req.Header.Get("Proxy-Authorization") != "" {
+				t.Error("client credentials would be forwarded upstream")
+			}
+			if rec.entry.User != tt.user {
+				t.Errorf("access log user = %q, want %q", rec.entry.User, tt.user)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/justenwalker/squiggly/logging"
+	"gopkg.in/elazarl/goproxy.v1"
+)
+
+// hostsFileNames are the local names found in hosts files, which are never blocked
+var hostsFileNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// Blocklist is a set of blocked domains, loaded from hosts files and domain lists.
+// A blocked domain also blocks all of its subdomains.
+type Blocklist struct {
+	Logger *logging.EventLogger
+	// Sources are the file paths or http(s) URLs of the lists
+	Sources []string
+	// FetchTimeout limits downloading a list. Zero means no limit.
+	FetchTimeout time.Duration
+
+	clientOnce sync.Once
+	client     *http.Client
+
+	mu sync.RWMutex
+	// lists holds the domains of each source, so that a source that fails to refresh keeps its previous domains
+	lists   map[string]map[string]struct{}
+	domains map[string]string
+}
+
+// Refresh loads every source again. A source that fails keeps the domains it had;
+// the error of the first failing source is returned.
+func (b *Blocklist) Refresh() error {
+	var firstErr error
+	lists := make(map[string]map[string]struct{}, len(b.Sources))
+	b.mu.RLock()
+	for source, domains := range b.lists {
+		lists[source] = domains
+	}
+	b.mu.RUnlock()
+	for _, source := range b.Sources {
+		domains, err := b.load(source)
+		if err != nil {
+			b.Logger.Warn("blocklist refresh failed", logging.F(logging.KeyURL, source), logging.Err(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		lists[source] = domains
+	}
+	// A domain on several lists is reported as blocked by the first of them
+	index := make(map[string]string)
+	for i := len(b.Sources) - 1; i >= 0; i-- {
+		for domain := range lists[b.Sources[i]] {
+			index[domain] = b.Sources[i]
+		}
+	}
+	b.mu.Lock()
+	b.lists, b.domains = lists, index
+	b.mu.Unlock()
+	blocklistDomains.Set(float64(len(index)))
+	b.Logger.Info("blocklist loaded", logging.F("domains", len(index)))
+	return firstErr
+}
+
+// Watch refreshes the lists every interval, until the context is done
+func (b *Blocklist) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = b.Refresh()
+		}
+	}
+}
+
+// Len returns the number of blocked domains
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.domains)
+}
+
+// Match returns the source that blocks the host, with or without a port, if it is blocked
+func (b *Blocklist) Match(host string) (string, bool) {
+	host = strings.ToLower(strings.TrimSuffix(hostname(host), "."))
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.domains) == 0 {
+		return "", false
+	}
+	if net.ParseIP(host) != nil {
+		source, ok := b.domains[host]
+		return source, ok
+	}
+	for host != "" {
+		if source, ok := b.domains[host]; ok {
+			return source, true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return "", false
+}
+
+func (b *Blocklist) load(source string) (map[string]struct{}, error) {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseBlocklist(f)
+	}
+	b.clientOnce.Do(func() {
+		// Lists are fetched directly, the same as PAC files
+		b.client = &http.Client{Timeout: b.FetchTimeout, Transport: &http.Transport{Proxy: nil}}
+	})
+	resp, err := b.client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status fetching '%s': %s", source, resp.Status)
+	}
+	return parseBlocklist(resp.Body)
+}
+
+// parseBlocklist reads a hosts file ("0.0.0.0 example.com") or a domain list with one domain per line.
+// Adblock style domain rules ("||example.com^") are also accepted.
+func parseBlocklist(r io.Reader) (map[string]struct{}, error) {
+	domains := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "!") || strings.HasPrefix(fields[0], "[") {
+			continue
+		}
+		names := fields[:1]
+		if net.ParseIP(fields[0]) != nil && len(fields) > 1 {
+			names = fields[1:]
+		}
+		for _, name := range names {
+			name = strings.TrimPrefix(strings.TrimSuffix(name, "^"), "||")
+			name = strings.TrimPrefix(strings.TrimPrefix(name, "*"), ".")
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name == "" || hostsFileNames[name] || strings.ContainsAny(name, "/*^$|") {
+				continue
+			}
+			domains[name] = struct{}{}
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// BlockedError is returned when a tunnel is refused because its destination is on the blocklist
+type BlockedError struct {
+	Host string
+	// List is the source of the blocklist that blocked the host
+	List string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("'%s' is blocked", e.Host)
+}
+
+// checkBlocked returns an error if the host is on the blocklist
+func (s *Server) checkBlocked(ctx context.Context, host, kind string) *BlockedError {
+	if s.blocklist == nil {
+		return nil
+	}
+	list, ok := s.blocklist.Match(host)
+	if !ok {
+		return nil
+	}
+	blocked.With(kind).Inc()
+	s.logger.Ctx(ctx).Info("blocked", logging.F(logging.KeyTarget, host), logging.F("list", list))
+	return &BlockedError{Host: hostname(host), List: list}
+}
+
+// BlockInfo is the data available to block page templates
+type BlockInfo struct {
+	Host      string `json:"host"`
+	URL       string `json:"url"`
+	Client    string `json:"client"`
+	RequestID string `json:"request_id"`
+	List      string `json:"list"`
+}
+
+// BlockPage is the response to plain HTTP requests to blocked hosts
+type BlockPage struct {
+	json bool
+	tmpl interface {
+		Execute(w io.Writer, data interface{}) error
+	}
+}
+
+var defaultBlockPage = htmltemplate.Must(htmltemplate.New("block").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Blocked</title></head>
+<body>
+<h1>Blocked</h1>
+<p>Access to <b>{{.Host}}</b> is blocked by the proxy.</p>
+<p><small>Request ID {{.RequestID}}</small></p>
+</body>
+</html>
+`))
+
+// NewBlockPage returns the block page in the format, html or json. The body is rendered from the template file
+// with a BlockInfo if a path is given; JSON templates may use {{json .Host}} to quote values.
+// Without a template, a short HTML page or a JSON object with the BlockInfo fields is returned.
+func NewBlockPage(format, path string) (*BlockPage, error) {
+	p := &BlockPage{}
+	switch strings.ToLower(format) {
+	case "", "html":
+	case "json":
+		p.json = true
+	default:
+		return nil, fmt.Errorf("unknown block page format '%s', expected html or json", format)
+	}
+	if path == "" {
+		if !p.json {
+			p.tmpl = defaultBlockPage
+		}
+		return p, nil
+	}
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read block page '%s': %w", path, err)
+	}
+	if p.json {
+		p.tmpl, err = template.New(path).Funcs(template.FuncMap{"json": jsonValue}).Parse(string(text))
+	} else {
+		p.tmpl, err = htmltemplate.New(path).Parse(string(text))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid block page '%s': %w", path, err)
+	}
+	return p, nil
+}
+
+func jsonValue(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// response returns the block page for the request
+func (p *BlockPage) response(req *http.Request, err *BlockedError) *http.Response {
+	info := &BlockInfo{
+		Host:      err.Host,
+		URL:       req.URL.String(),
+		Client:    hostname(req.RemoteAddr),
+		RequestID: logging.RequestID(req.Context()),
+		List:      err.List,
+	}
+	contentType := goproxy.ContentTypeHtml
+	if p.json {
+		contentType = "application/json"
+	}
+	var body strings.Builder
+	var xerr error
+	if p.tmpl != nil {
+		xerr = p.tmpl.Execute(&body, info)
+	} else {
+		xerr = json.NewEncoder(&body).Encode(struct {
+			Error string `json:"error"`
+			*BlockInfo
+		}{Error: "blocked", BlockInfo: info})
+	}
+	if xerr != nil {
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, err.Error()+"\n")
+	}
+	resp := goproxy.NewResponse(req, contentType, http.StatusForbidden, body.String())
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
+// Block refuses requests and tunnels to the hosts on the blocklist. Plain HTTP requests are answered
+// with the block page, or with the default HTML page if it is nil. Tunnels are refused with 403 Forbidden.
+func Block(list *Blocklist, page *BlockPage) Option {
+	return func(s *Server) {
+		if page == nil {
+			page = &BlockPage{tmpl: defaultBlockPage}
+		}
+		s.blocklist, s.blockPage = list, page
+	}
+}
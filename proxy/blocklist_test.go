@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	list := `# hosts file
+127.0.0.1 localhost
+::1 localhost ip6-localhost
+0.0.0.0 telemetry.example.com ads.example.com # trailing comment
+0.0.0.0 Tracker.Example.NET.
+
+! adblock
+||metrics.example.org^
+[Adblock Plus 2.0]
+*.wild.example.com
+/path/rule/
+`
+	domains, err := parseBlocklist(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for d := range domains {
+		got = append(got, d)
+	}
+	sort.Strings(got)
+	want := []string{"ads.example.com", "metrics.example.org", "telemetry.example.com", "tracker.example.net", "wild.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("domains = %v, want %v", got, want)
+	}
+}
+
+func writeBlocklist(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBlocklistMatch(t *testing.T) {
+	var fail int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("telemetry.example.com\n192.0.2.1\n"))
+	}))
+	defer srv.Close()
+	file := writeBlocklist(t, "0.0.0.0 ads.example.com\n")
+	b := &Blocklist{Sources: []string{file, srv.URL}}
+	if err := b.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		list string
+	}{
+		{host: "ads.example.com", list: file},
+		{host: "eu.ads.example.com:443", list: file},
+		{host: "ADS.example.com.", list: file},
+		{host: "telemetry.example.com:80", list: srv.URL},
+		{host: "192.0.2.1:443", list: srv.URL},
+		{host: "example.com"},
+		{host: "badads.example.com"},
+		{host: "192.0.2.10"},
+	}
+	for _, tt := range tests {
+		list, ok := b.Match(tt.host)
+		if ok != (tt.list != "") || list != tt.list {
+			t.Errorf("Match(%q) = %q, %v, want %q", tt.host, list, ok, tt.list)
+		}
+	}
+
+	// A list that fails to refresh keeps its domains
+	atomic.StoreInt32(&fail, 1)
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Refresh(); err == nil {
+		t.Error("refresh of missing sources succeeded")
+	}
+	if n := b.Len(); n != 3 {
+		t.Errorf("domains after failed refresh = %d, want 3", n)
+	}
+}
+
+func TestBlockPage(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://ads.example.com/x", nil)
+	blocked := &BlockedError{Host: "ads.example.com", List: "ads.txt"}
+
+	html, err := NewBlockPage("html", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := html.response(req, blocked)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "<b>ads.example.com</b>") {
+		t.Errorf("html block page = %d %s", resp.StatusCode, body)
+	}
+
+	js, err := NewBlockPage("json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = js.response(req, blocked)
+	var info map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info["error"] != "blocked" || info["host"] != "ads.example.com" || info["list"] != "ads.txt" {
+		t.Errorf("json block page = %v", info)
+	}
+
+	tmpl := writeBlocklist(t, `{"blocked":{{json .URL}}}`)
+	custom, err := NewBlockPage("json", tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = custom.response(req, blocked)
+	body, _ = ioutil.ReadAll(resp.Body)
+	if string(body) != `{"blocked":"http://ads.example.com/x"}` || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("custom block page = %s %s", resp.Header.Get("Content-Type"), body)
+	}
+
+	if _, err := NewBlockPage("xml", ""); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestBlockProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer origin.Close()
+	b := &Blocklist{Sources: []string{writeBlocklist(t, "127.0.0.1\n")}}
+	if err := b.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	s := New(Block(b, nil))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	purl, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(purl)}}
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("plain request: %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	if _, err := s.dialTunnel(context.Background(), "tcp", origin.Listener.Addr().String()); errorStatus(err) != http.StatusForbidden {
+		t.Errorf("tunnel error = %v", err)
+	}
+	if code := socksReplyCode(s.checkBlocked(context.Background(), "127.0.0.1:443", "tunnel")); code != socksRepNotAllowed {
+		t.Errorf("SOCKS reply = %d, want %d", code, socksRepNotAllowed)
+	}
+}
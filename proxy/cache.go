@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// Cache status of a plain HTTP request, as recorded in the access log
+const (
+	// CacheHit is a response served from the cache without contacting the destination
+	CacheHit = "HIT"
+	// CacheMiss is a response fetched from the destination
+	CacheMiss = "MISS"
+	// CacheRevalidated is a stale response served from the cache after the destination confirmed it is unchanged
+	CacheRevalidated = "REVALIDATED"
+	// CacheBypass is a request the cache could not answer, such as a range request
+	CacheBypass = "BYPASS"
+)
+
+// CacheConfig configures a ResponseCache
+type CacheConfig struct {
+	// Dir stores the cached responses, and is created if it does not exist
+	Dir string
+	// MaxSize is the total size of the stored response bodies.
+	// The least recently used responses are evicted when it is exceeded.
+	MaxSize int64
+	// MaxObjectSize is the largest response body that is stored. Zero means MaxSize.
+	MaxObjectSize int64
+}
+
+// ResponseCache is a shared HTTP cache (RFC 9111) of the responses to plain HTTP requests, stored on disk.
+// It is safe for concurrent use.
+type ResponseCache struct {
+	store *cacheStore
+}
+
+// OpenResponseCache opens the cache directory, and loads the responses stored by a previous run
+func OpenResponseCache(cfg CacheConfig) (*ResponseCache, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("cache directory is required")
+	}
+	if cfg.MaxSize <= 0 {
+		return nil, fmt.Errorf("cache size must be positive")
+	}
+	if cfg.MaxObjectSize <= 0 || cfg.MaxObjectSize > cfg.MaxSize {
+		cfg.MaxObjectSize = cfg.MaxSize
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create cache directory '%s': %w", cfg.Dir, err)
+	}
+	store := &cacheStore{
+		dir:       cfg.Dir,
+		maxSize:   cfg.MaxSize,
+		maxObject: cfg.MaxObjectSize,
+		entries:   make(map[string][]*cacheEntry),
+		lru:       list.New(),
+	}
+	if err := store.load(); err != nil {
+		return nil, fmt.Errorf("could not load cache directory '%s': %w", cfg.Dir, err)
+	}
+	return &ResponseCache{store: store}, nil
+}
+
+// Size returns the total size of the stored response bodies
+func (c *ResponseCache) Size() int64 {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	return c.store.size
+}
+
+// roundTrip answers the request from the cache, or sends it with next and stores the response
+func (c *ResponseCache) roundTrip(req *http.Request, next http.RoundTripper, logger *logging.EventLogger) (*http.Response, error) {
+	rec := accessRecordFrom(req.Context())
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return next.RoundTrip(req)
+	default:
+		// Unsafe methods invalidate the stored responses of the URL once they succeed
+		resp, err := next.RoundTrip(req)
+		if err == nil && resp.StatusCode < 400 {
+			c.store.invalidate(req.URL.String())
+		}
+		return resp, err
+	}
+	result := func(status string) {
+		rec.setCache(status)
+		cacheRequests.With(status).Inc()
+		logger.Debug("cache "+strings.ToLower(status), logging.F(logging.KeyTarget, req.URL))
+	}
+	reqCC := parseCacheControl(req.Header)
+	if req.Header.Get("Range") != "" || reqCC.has("no-store") {
+		result(CacheBypass)
+		return next.RoundTrip(req)
+	}
+	now := time.Now()
+	e := c.store.lookup(req)
+	if e != nil && e.fresh(req, reqCC, now) {
+		if resp, err := c.serve(req, e, now); err == nil {
+			result(CacheHit)
+			return resp, nil
+		}
+		e = nil
+	}
+	if reqCC.has("only-if-cached") {
+		result(CacheMiss)
+		return cacheResponse(req, http.StatusGatewayTimeout, nil), nil
+	}
+	if e != nil && !conditional(req) && (e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != "") {
+		resp, revalidated, err := c.revalidate(req, e, next)
+		if revalidated {
+			result(CacheRevalidated)
+		} else {
+			result(CacheMiss)
+		}
+		return resp, err
+	}
+	result(CacheMiss)
+	return c.fetch(req, next)
+}
+
+// revalidate asks the destination whether the stored response is still current, and serves it if it is.
+// Otherwise it returns the new response from the destination, which replaces the stored response.
+func (c *ResponseCache) revalidate(req *http.Request, e *cacheEntry, next http.RoundTripper) (*http.Response, bool, error) {
+	vreq := req.Clone(req.Context())
+	if etag := e.Header.Get("ETag"); etag != "" {
+		vreq.Header.Set("If-None-Match", etag)
+	}
+	if modified := e.Header.Get("Last-Modified"); modified != "" {
+		vreq.Header.Set("If-Modified-Since", modified)
+	}
+	requestTime := time.Now()
+	resp, err := next.RoundTrip(vreq)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		return c.store.fill(req, resp, requestTime), false, nil
+	}
+	resp.Body.Close()
+	now := time.Now()
+	updated, err := c.store.update(e, resp.Header, requestTime, now)
+	if err != nil {
+		updated = e
+	}
+	if resp, err := c.serve(req, updated, now); err == nil {
+		return resp, true, nil
+	}
+	// The stored body is gone
+	resp, err = c.fetch(req, next)
+	return resp, false, err
+}
+
+// fetch sends the request to the destination, and stores the response if it can be stored
+func (c *ResponseCache) fetch(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+	requestTime := time.Now()
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.store.fill(req, resp, requestTime), nil
+}
+
+// serve returns the stored response, or 304 Not Modified if it matches the validators of the request
+func (c *ResponseCache) serve(req *http.Request, e *cacheEntry, now time.Time) (*http.Response, error) {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	if e.notModified(req) {
+		for _, name := range []string{"Content-Length", "Content-Type", "Content-Encoding"} {
+			header.Del(name)
+		}
+		resp := cacheResponse(req, http.StatusNotModified, header)
+		return resp, nil
+	}
+	f, err := c.store.open(e)
+	if err != nil {
+		return nil, err
+	}
+	header.Set("Content-Length", strconv.FormatInt(e.Size, 10))
+	resp := cacheResponse(req, e.Status, header)
+	resp.Body = f
+	resp.ContentLength = e.Size
+	return resp, nil
+}
+
+func cacheResponse(req *http.Request, status int, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: 0,
+		Request:       req,
+	}
+}
+
+// hopHeaders are not stored, they only apply to a single connection
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// fill returns the response with a body that stores it as it is read by the client, if it can be stored
+func (s *cacheStore) fill(req *http.Request, resp *http.Response, requestTime time.Time) *http.Response {
+	if !storable(req, resp) || resp.ContentLength > s.maxObject {
+		return resp
+	}
+	header := resp.Header.Clone()
+	for _, name := range header.Values("Connection") {
+		for _, h := range strings.Split(name, ",") {
+			header.Del(strings.TrimSpace(h))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	f, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return resp
+	}
+	resp.Body = &cacheFill{
+		ReadCloser: resp.Body,
+		store:      s,
+		entry: &cacheEntry{
+			Key:          req.URL.String(),
+			Variant:      requestVariant(req, varyHeaders(resp.Header)),
+			Status:       resp.StatusCode,
+			Header:       header,
+			RequestTime:  requestTime,
+			ResponseTime: time.Now(),
+		},
+		length: resp.ContentLength,
+		file:   f,
+	}
+	return resp
+}
+
+// Cache stores the responses to plain HTTP requests in the cache, and answers requests from it.
+// Requests decrypted from intercepted tunnels are not cached.
+func Cache(c *ResponseCache) Option {
+	return func(s *Server) {
+		s.cache = c
+	}
+}
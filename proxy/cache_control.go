@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heuristicMax caps the heuristic freshness lifetime of responses without explicit expiration
+const heuristicMax = 24 * time.Hour
+
+// cacheableStatus are the response codes the cache stores
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheControl is a parsed Cache-Control header, mapping each directive to its argument
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, value = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of the directive
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// requestNoCache reports whether the request asks for the cached response to be validated first
+func requestNoCache(req *http.Request, cc cacheControl) bool {
+	if cc.has("no-cache") {
+		return true
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok && maxAge == 0 {
+		return true
+	}
+	// Pragma is only used by HTTP/1.0 clients that do not send Cache-Control
+	return len(cc) == 0 && strings.EqualFold(strings.TrimSpace(req.Header.Get("Pragma")), "no-cache")
+}
+
+// storable reports whether a shared cache may store the response to the request
+func storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || !cacheableStatus[resp.StatusCode] {
+		return false
+	}
+	if parseCacheControl(req.Header).has("no-store") {
+		return false
+	}
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	// Responses that set cookies are meant for a single client
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	return cc.has("max-age") || cc.has("s-maxage") || resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("Last-Modified") != "" || resp.Header.Get("ETag") != ""
+}
+
+// varyHeaders returns the canonical names of the request headers listed by the Vary header
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// freshness returns the freshness lifetime of a stored response
+func (e *cacheEntry) freshness() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if v := e.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// An invalid Expires, such as 0, means already expired
+			return 0
+		}
+		return expires.Sub(e.date())
+	}
+	if v := e.Header.Get("Last-Modified"); v != "" {
+		if modified, err := http.ParseTime(v); err == nil {
+			d := e.date().Sub(modified) / 10
+			if d > heuristicMax {
+				d = heuristicMax
+			}
+			return d
+		}
+	}
+	return 0
+}
+
+// date returns the Date of the stored response, or when it was received
+func (e *cacheEntry) date() time.Time {
+	if d, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return d
+	}
+	return e.ResponseTime
+}
+
+// age returns the current age of the stored response
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparent := e.ResponseTime.Sub(e.date())
+	if apparent < 0 {
+		apparent = 0
+	}
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if apparent > corrected {
+		corrected = apparent
+	}
+	return corrected + now.Sub(e.ResponseTime)
+}
+
+// fresh reports whether the stored response may be served to the request without validation
+func (e *cacheEntry) fresh(req *http.Request, reqCC cacheControl, now time.Time) bool {
+	if requestNoCache(req, reqCC) || parseCacheControl(e.Header).has("no-cache") {
+		return false
+	}
+	age := e.age(now)
+	lifetime := e.freshness()
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+	return age < lifetime
+}
+
+// notModified reports whether the conditional headers of the request match the stored response,
+// so that it can be answered with 304 Not Modified
+func (e *cacheEntry) notModified(req *http.Request) bool {
+	if inm := strings.Join(req.Header.Values("If-None-Match"), ","); inm != "" {
+		etag := weakETag(e.Header.Get("ETag"))
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || (etag != "" && weakETag(tag) == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		modified, merr := http.ParseTime(e.Header.Get("Last-Modified"))
+		return err == nil && merr == nil && !modified.After(since)
+	}
+	return false
+}
+
+// weakETag returns the entity tag without the weak indicator, for weak comparison
+func weakETag(tag string) string {
+	return strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+}
+
+// conditional reports whether the request has its own validators
+func conditional(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
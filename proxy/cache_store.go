@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a stored response. Its metadata is kept in memory and in a JSON file next to the body.
+type cacheEntry struct {
+	// Key is the URL of the request
+	Key string `json:"key"`
+	// Variant holds the values of the request headers named by the Vary header of the response
+	Variant      map[string]string `json:"variant,omitempty"`
+	Status       int               `json:"status"`
+	Header       http.Header       `json:"header"`
+	RequestTime  time.Time         `json:"request_time"`
+	ResponseTime time.Time         `json:"response_time"`
+	Size         int64             `json:"size"`
+
+	id   string
+	elem *list.Element
+}
+
+// cacheID returns the file name of the response to the key with the variant
+func cacheID(key string, variant map[string]string) string {
+	names := make([]string, 0, len(variant))
+	for name := range variant {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	io.WriteString(h, key)
+	for _, name := range names {
+		fmt.Fprintf(h, "\x00%s\x00%s", name, variant[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// requestVariant returns the values of the varying headers in the request
+func requestVariant(req *http.Request, names []string) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	variant := make(map[string]string, len(names))
+	for _, name := range names {
+		variant[name] = strings.Join(req.Header.Values(name), ", ")
+	}
+	return variant
+}
+
+// matches reports whether the request selects this variant of the response
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for name, value := range e.Variant {
+		if strings.Join(req.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheStore is the set of stored responses, evicting the least recently used when it is full
+type cacheStore struct {
+	dir       string
+	maxSize   int64
+	maxObject int64
+
+	mu      sync.Mutex
+	entries map[string][]*cacheEntry
+	lru     *list.List
+	size    int64
+}
+
+func (s *cacheStore) bodyPath(id string) string {
+	return filepath.Join(s.dir, id+".body")
+}
+
+func (s *cacheStore) metaPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// load reads the index of the responses stored in the directory, and removes incomplete files
+func (s *cacheStore) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var loaded []*cacheEntry
+	for _, fi := range files {
+		name := fi.Name()
+		switch {
+		case strings.HasPrefix(name, "tmp-"):
+			_ = os.Remove(filepath.Join(s.dir, name))
+		case strings.HasSuffix(name, ".json"):
+			id := strings.TrimSuffix(name, ".json")
+			e, err := s.readMeta(id)
+			if err != nil {
+				_ = os.Remove(s.metaPath(id))
+				_ = os.Remove(s.bodyPath(id))
+				continue
+			}
+			loaded = append(loaded, e)
+		}
+	}
+	// The most recently stored responses are the last to be evicted
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].ResponseTime.Before(loaded[j].ResponseTime) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range loaded {
+		s.insert(e)
+	}
+	s.evict()
+	return nil
+}
+
+func (s *cacheStore) readMeta(id string) (*cacheEntry, error) {
+	b, err := ioutil.ReadFile(s.metaPath(id))
+	if err != nil {
+		return nil, err
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, err
+	}
+	if e.id = cacheID(e.Key, e.Variant); e.id != id {
+		return nil, fmt.Errorf("cache entry '%s' has the wrong name", id)
+	}
+	fi, err := os.Stat(s.bodyPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != e.Size {
+		return nil, fmt.Errorf("cache entry '%s' is incomplete", id)
+	}
+	return e, nil
+}
+
+// writeMeta atomically writes the metadata of the entry
+func (s *cacheStore) writeMeta(e *cacheEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.metaPath(e.id))
+}
+
+// lookup returns the stored response matching the request, or nil
+func (s *cacheStore) lookup(req *http.Request) *cacheEntry {
+	key := req.URL.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries[key] {
+		if e.matches(req) {
+			s.lru.MoveToFront(e.elem)
+			return e
+		}
+	}
+	return nil
+}
+
+// open returns the body of the stored response
+func (s *cacheStore) open(e *cacheEntry) (*os.File, error) {
+	return os.Open(s.bodyPath(e.id))
+}
+
+// insert adds the entry to the index, replacing the entry with the same id. s.mu must be held.
+func (s *cacheStore) insert(e *cacheEntry) {
+	variants := s.entries[e.Key]
+	for i, old := range variants {
+		if old.id == e.id {
+			s.lru.Remove(old.elem)
+			s.size -= old.Size
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	e.elem = s.lru.PushFront(e)
+	s.entries[e.Key] = append(variants, e)
+	s.size += e.Size
+	cacheSize.Set(float64(s.size))
+}
+
+// remove deletes the entry from the index and the disk. s.mu must be held.
+func (s *cacheStore) remove(e *cacheEntry) {
+	variants := s.entries[e.Key]
+	for i, v := range variants {
+		if v == e {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(s.entries, e.Key)
+	} else {
+		s.entries[e.Key] = variants
+	}
+	s.lru.Remove(e.elem)
+	s.size -= e.Size
+	cacheSize.Set(float64(s.size))
+	_ = os.Remove(s.metaPath(e.id))
+	_ = os.Remove(s.bodyPath(e.id))
+}
+
+// evict removes the least recently used entries until the cache fits in its maximum size. s.mu must be held.
+func (s *cacheStore) evict() {
+	for s.size > s.maxSize && s.lru.Len() > 0 {
+		s.remove(s.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// invalidate removes every stored variant of the URL
+func (s *cacheStore) invalidate(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range append([]*cacheEntry(nil), s.entries[key]...) {
+		s.remove(e)
+	}
+}
+
+// commit stores the entry with the body written to the temporary file
+func (s *cacheStore) commit(e *cacheEntry, tmp string) error {
+	e.id = cacheID(e.Key, e.Variant)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmp, s.bodyPath(e.id)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := s.writeMeta(e); err != nil {
+		_ = os.Remove(s.bodyPath(e.id))
+		return err
+	}
+	s.insert(e)
+	s.evict()
+	return nil
+}
+
+// update replaces the headers of a stored response after it was validated with a 304 response
+func (s *cacheStore) update(e *cacheEntry, header http.Header, requestTime, responseTime time.Time) (*cacheEntry, error) {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Transfer-Encoding", "Content-Encoding", "Content-Range":
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.RequestTime, updated.ResponseTime = requestTime, responseTime
+	updated.elem = nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeMeta(&updated); err != nil {
+		return nil, err
+	}
+	s.insert(&updated)
+	return &updated, nil
+}
+
+// cacheFill copies a response body to a temporary file as it is read, and stores it once it is read completely.
+// The response is passed through unchanged if it can not be stored.
+type cacheFill struct {
+	io.ReadCloser
+	store  *cacheStore
+	entry  *cacheEntry
+	length int64
+	file   *os.File
+	n      int64
+	done   bool
+}
+
+func (f *cacheFill) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if f.file != nil && n > 0 {
+		f.n += int64(n)
+		if f.n > f.store.maxObject {
+			f.abort()
+		} else if _, werr := f.file.Write(p[:n]); werr != nil {
+			f.abort()
+		}
+	}
+	if err == io.EOF {
+		f.finish()
+	}
+	return n, err
+}
+
+func (f *cacheFill) Close() error {
+	// A body closed before EOF was not read completely
+	f.abort()
+	return f.ReadCloser.Close()
+}
+
+func (f *cacheFill) finish() {
+	if f.file == nil || f.done {
+		return
+	}
+	f.done = true
+	tmp := f.file.Name()
+	if err := f.file.Close(); err != nil || (f.length >= 0 && f.n != f.length) {
+		_ = os.Remove(tmp)
+		f.file = nil
+		return
+	}
+	f.file = nil
+	f.entry.Size = f.n
+	_ = f.store.commit(f.entry, tmp)
+}
+
+func (f *cacheFill) abort() {
+	if f.file == nil {
+		return
+	}
+	f.file.Close()
+	_ = os.Remove(f.file.Name())
+	f.file = nil
+}
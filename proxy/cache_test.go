@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func openTestCache(t *testing.T, cfg CacheConfig) *ResponseCache {
+	t.Helper()
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = 1 << 20
+	}
+	c, err := OpenResponseCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// cacheGet sends a GET through the cache, and returns the response with its body read and the cache status
+func cacheGet(t *testing.T, c *ResponseCache, target string, header http.Header) (*http.Response, string, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req, rec := withAccessRecord(req)
+	resp, err := c.roundTrip(req, http.DefaultTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body), rec.entry.Cache
+}
+
+func TestResponseCache(t *testing.T) {
+	var hits int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		switch req.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("fresh"))
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("etag"))
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(req.Header.Get("Accept-Language")))
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("no-store"))
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+			w.Write([]byte("private"))
+		}
+	}))
+	defer origin.Close()
+	c := openTestCache(t, CacheConfig{})
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		body   string
+		status string
+		hits   int64
+	}{
+		{name: "first", path: "/fresh", body: "fresh", status: CacheMiss, hits: 1},
+		{name: "fresh", path: "/fresh", body: "fresh", status: CacheHit, hits: 0},
+		{name: "client no-cache", path: "/fresh", header: http.Header{"Cache-Control": {"no-cache"}}, body: "fresh", status: CacheMiss, hits: 1},
+		{name: "range", path: "/fresh", header: http.Header{"Range": {"bytes=0-1"}}, body: "fresh", status: CacheBypass, hits: 1},
+		{name: "etag first", path: "/etag", body: "etag", status: CacheMiss, hits: 1},
+		{name: "etag revalidated", path: "/etag", body: "etag", status: CacheRevalidated, hits: 1},
+		{name: "vary en", path: "/vary", header: http.Header{"Accept-Language": {"en"}}, body: "en", status: CacheMiss, hits: 1},
+		{name: "vary fr", path: "/vary", header: http.Header{"Accept-Language": {"fr"}}, body: "fr", status: CacheMiss, hits: 1},
+		{name: "vary en again", path: "/vary", header: http.Header{"Accept-Language": {"en"}}, body: "en", status: CacheHit, hits: 0},
+		{name: "no-store", path: "/no-store", body: "no-store", status: CacheMiss, hits: 1},
+		{name: "no-store again", path: "/no-store", body: "no-store", status: CacheMiss, hits: 1},
+		{name: "private", path: "/private", body: "private", status: CacheMiss, hits: 1},
+		{name: "private again", path: "/private", body: "private", status: CacheMiss, hits: 1},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt64(&hits, 0)
+		_, body, status := cacheGet(t, c, origin.URL+tt.path, tt.header)
+		if body != tt.body {
+			t.Errorf("%s: body = %q, want %q", tt.name, body, tt.body)
+		}
+		if status != tt.status {
+			t.Errorf("%s: cache status = %q, want %q", tt.name, status, tt.status)
+		}
+		if got := atomic.LoadInt64(&hits); got != tt.hits {
+			t.Errorf("%s: origin requests = %d, want %d", tt.name, got, tt.hits)
+		}
+	}
+
+	resp, _, _ := cacheGet(t, c, origin.URL+"/fresh", http.Header{"If-None-Match": {`"x"`, "*"}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional hit status = %d, want 304", resp.StatusCode)
+	}
+
+	// Unsafe methods invalidate the stored response
+	req := httptest.NewRequest(http.MethodPost, origin.URL+"/fresh", strings.NewReader("x"))
+	resp, err := c.roundTrip(req, http.DefaultTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, _, status := cacheGet(t, c, origin.URL+"/fresh", nil); status != CacheMiss {
+		t.Errorf("after POST: cache status = %q, want %q", status, CacheMiss)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer origin.Close()
+	dir := t.TempDir()
+	c := openTestCache(t, CacheConfig{Dir: dir, MaxSize: 250, MaxObjectSize: 200})
+	for _, path := range []string{"/a", "/b", "/c"} {
+		cacheGet(t, c, origin.URL+path, nil)
+	}
+	if size := c.Size(); size != 200 {
+		t.Errorf("size = %d, want 200", size)
+	}
+	if _, _, status := cacheGet(t, c, origin.URL+"/a", nil); status != CacheMiss {
+		t.Errorf("least recently used: cache status = %q, want %q", status, CacheMiss)
+	}
+
+	// The stored responses are loaded by the next run
+	c = openTestCache(t, CacheConfig{Dir: dir, MaxSize: 250})
+	if size := c.Size(); size != 200 {
+		t.Errorf("reloaded size = %d, want 200", size)
+	}
+	if _, _, status := cacheGet(t, c, origin.URL+"/a", nil); status != CacheHit {
+		t.Errorf("reloaded: cache status = %q, want %q", status, CacheHit)
+	}
+}
+
+func TestResponseCacheProxy(t *testing.T) {
+	var hits int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Date", time.Now().Add(-10*time.Second).UTC().Format(http.TimeFormat))
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	s := New(Cache(openTestCache(t, CacheConfig{})))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	purl, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(purl)}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" || resp.ContentLength != 5 {
+			t.Errorf("response %d: body = %q, length = %d", i, body, resp.ContentLength)
+		}
+		if age, _ := strconv.Atoi(resp.Header.Get("Age")); i == 1 && age < 10 {
+			t.Errorf("Age = %q, want at least 10", resp.Header.Get("Age"))
+		}
+	}
+	if hits := atomic.LoadInt64(&hits); hits != 1 {
+		t.Errorf("origin requests = %d, want 1", hits)
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// serveConnect dials the target of a CONNECT request and tunnels the client connection to it
+func (s *Server) serveConnect(w http.ResponseWriter, req *http.Request, rec *accessRecord) {
+	logger := s.logger.Ctx(req.Context()).With(logging.F(logging.KeyClient, req.RemoteAddr), logging.F(logging.KeyTarget, req.Host))
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		logger.Error("connection does not support CONNECT")
+		rec.setStatus(http.StatusInternalServerError)
+		http.Error(w, "CONNECT is not supported", http.StatusInternalServerError)
+		return
+	}
+	logger.Debug("connect")
+	target, err := s.dialTunnel(req.Context(), "tcp", req.Host)
+	if err != nil {
+		logger.Warn("connect failed", logging.Err(err))
+		rec.setStatus(writeDialError(w, req, err))
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		logger.Error("hijack failed", logging.Err(err))
+		target.Close()
+		return
+	}
+	established := "HTTP/1.1 200 Connection established\r\n"
+	if s.requestIDHeader {
+		established += RequestIDHeader + ": " + logging.RequestID(req.Context()) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, established+"\r\n"); err != nil {
+		conn.Close()
+		target.Close()
+		return
+	}
+	rec.setStatus(http.StatusOK)
+	// The client may have sent data before reading the response
+	if n := brw.Reader.Buffered(); n > 0 {
+		conn = &bufferedConn{Conn: conn, r: io.MultiReader(io.LimitReader(brw.Reader, int64(n)), conn)}
+	}
+	rec.bytesIn, rec.bytesOut = tunnel(conn, limitTunnel(target, rec), s.timeoutsFor(req.Host).Idle)
+}
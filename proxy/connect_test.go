@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+func TestServeConnect(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	accessLog, err := logging.OpenAccessLog(logPath, logging.AccessCombined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accessLog.Close()
+	srv := httptest.NewServer(New(AccessLog(accessLog)))
+	defer srv.Close()
+
+	conn, status := connectThrough(t, srv.Listener.Addr().String(), echo.Addr().String())
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT = %d, want %d", status, http.StatusOK)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping\n"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping\n" {
+		t.Errorf("tunnelled %q, want %q", got, "ping\n")
+	}
+	conn.Close()
+
+	// The tunnel is logged once both sides have closed
+	line := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^\]]+\] "CONNECT ` + regexp.QuoteMeta(echo.Addr().String()) +
+		` HTTP/1\.1" 200 5 "-" "-" "DIRECT" "-" 5 \d+\.\d{3} [0-9a-f]{16} -\n$`)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, err := ioutil.ReadFile(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > 0 {
+			if !line.Match(b) {
+				t.Errorf("access log line %q does not match %s", b, line)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was not logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeConnectUnreachable(t *testing.T) {
+	srv := httptest.NewServer(New())
+	defer srv.Close()
+	conn, status := connectThrough(t, srv.Listener.Addr().String(), closedAddr(t))
+	conn.Close()
+	if status != http.StatusBadGateway {
+		t.Errorf("CONNECT = %d, want %d", status, http.StatusBadGateway)
+	}
+}
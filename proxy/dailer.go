@@ -3,6 +3,7 @@ package proxy
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -20,38 +21,35 @@ import (
 var errProxyAuth = errors.New("proxy auth required")
 
 type ProxyDialer struct {
-	Logger logging.Logger
+	Logger *logging.EventLogger
 	Auth   *auth.Auth
 	Host   *url.URL
-	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	// TLSConfig is used to connect to https upstream proxies.
+	// If its ServerName is empty, the host name of the proxy is used.
+	TLSConfig *tls.Config
+	Dialer    func(ctx context.Context, network, addr string) (net.Conn, error)
+	// HandshakeTimeout limits the TLS handshake with an https proxy and waiting for the response to the CONNECT.
+	// Zero means no limit.
+	HandshakeTimeout time.Duration
+	// AuthTimeout limits the authentication handshake. Zero means no limit.
+	AuthTimeout time.Duration
+	// HeaderRules with the HeaderConnect direction rewrite the headers of the CONNECT requests
+	HeaderRules []HeaderRule
 }
 
+// host returns the host:port of the proxy url, adding the default port of its scheme if it has none
 func host(u *url.URL) string {
-	if strings.IndexRune(u.Host, ':') == -1 {
+	if u.Port() == "" {
 		switch u.Scheme {
 		case "", "http":
-			return u.Host + ":80"
+			return net.JoinHostPort(u.Hostname(), "80")
 		case "https":
-			return u.Host + ":443"
+			return net.JoinHostPort(u.Hostname(), "443")
 		}
 	}
 	return u.Host
 }
 
-func (d *ProxyDialer) log(msg string) {
-	if d.Logger == nil {
-		return
-	}
-	d.Logger.Log(msg)
-}
-
-func (d *ProxyDialer) logf(format string, v ...interface{}) {
-	if d.Logger == nil {
-		return
-	}
-	d.Logger.Log(fmt.Sprintf(format, v...))
-}
-
 func (d *ProxyDialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	if d.Dialer == nil {
 		if dl, ok := ctx.Deadline(); ok {
@@ -62,17 +60,97 @@ func (d *ProxyDialer) dialContext(ctx context.Context, network, addr string) (ne
 	return d.Dialer(ctx, network, addr)
 }
 
+// interruptOnCancel sets a deadline in the past on the connection when the context is cancelled,
+// so that the CONNECT and auth handshakes do not block.
+// The returned function stops watching the context and clears the deadline.
+func interruptOnCancel(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+		_ = conn.SetDeadline(time.Time{})
+	}
+}
+
+// handshake starts TLS on the connection to an https upstream proxy
+func (d *ProxyDialer) handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	var cfg *tls.Config
+	if d.TLSConfig != nil {
+		cfg = d.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = d.Host.Hostname()
+	}
+	tc := tls.Client(conn, cfg)
+	if dl, ok := ctx.Deadline(); ok {
+		_ = tc.SetDeadline(dl)
+		defer tc.SetDeadline(time.Time{})
+	}
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with proxy '%s' failed: %w", d.Host.Host, err)
+	}
+	return tc, nil
+}
+
 type proxyConnection struct {
+	ctx    context.Context
 	dialer *ProxyDialer
 	proxy  *url.URL
 	conn   net.Conn
+	br     *bufio.Reader
 	addr   string
 }
 
+// bufferedConn is a connection whose first reads are served from a reader
+// that may have buffered data past the end of the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// netConn returns the tunnelled connection, preserving any bytes the target sent
+// immediately after the proxy accepted the CONNECT.
+func (c *proxyConnection) netConn() net.Conn {
+	if c.br == nil || c.br.Buffered() == 0 {
+		return c.conn
+	}
+	return &bufferedConn{Conn: c.conn, r: io.MultiReader(io.LimitReader(c.br, int64(c.br.Buffered())), c.conn)}
+}
+
 func (c *proxyConnection) Proxy() *url.URL {
 	return c.proxy
 }
 
+func (c *proxyConnection) Context() context.Context {
+	return c.ctx
+}
+
 func (c *proxyConnection) Connect(auth string) (*http.Response, error) {
 	connectReq := &http.Request{
 		Method: "CONNECT",
@@ -80,14 +158,17 @@ func (c *proxyConnection) Connect(auth string) (*http.Response, error) {
 		Host:   c.addr,
 		Header: make(http.Header),
 	}
+	applyHeaderRules(c.ctx, c.dialer.HeaderRules, HeaderConnect, connectReq.Header, c.addr, accessRecordFrom(c.ctx).client())
 	if auth != "" {
 		connectReq.Header.Set("Proxy-Authorization", auth)
 	}
 	if err := connectReq.Write(c.conn); err != nil {
 		return nil, err
 	}
-	br := bufio.NewReader(c.conn)
-	resp, err := http.ReadResponse(br, connectReq)
+	if c.br == nil {
+		c.br = bufio.NewReader(c.conn)
+	}
+	resp, err := http.ReadResponse(c.br, connectReq)
 	if err != nil {
 		return nil, err
 	}
@@ -99,20 +180,33 @@ func (c *proxyConnection) Connect(auth string) (*http.Response, error) {
 		_, _ = io.Copy(ioutil.Discard, resp.Body)
 		return resp, errProxyAuth
 	}
-	out, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return resp, err
-	}
-	return nil, fmt.Errorf("proxy return error '%s': %s", resp.Status, string(out))
+	// The body only explains the status, so a failure to read it is not an error
+	out, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return resp, &ErrProxyRefused{StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(out))}
 }
 
+// DialContext connects to the address through the upstream proxy, authenticating if the proxy asks for it.
+// Failures are returned as a *ProxyError, unless the context was cancelled.
 func (d *ProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	logger := d.Logger.Ctx(ctx).With(logging.F(logging.KeyUpstream, d.Host.Host), logging.F(logging.KeyTarget, addr))
 	c, err := d.dialContext(ctx, network, host(d.Host))
 	if err != nil {
-		d.log("proxy tcp connect failed")
-		return nil, err
+		logger.Debug("upstream tcp connect failed", logging.Err(err))
+		return nil, d.fail(ctx, ErrProxyUnreachable, err)
+	}
+	hctx, cancel := withTimeout(ctx, d.HandshakeTimeout)
+	defer cancel()
+	stop := interruptOnCancel(hctx, c)
+	defer func() { stop() }()
+	if d.Host.Scheme == "https" {
+		// The CONNECT, credentials and NTLM/Negotiate handshakes are all sent over TLS
+		if c, err = d.handshake(hctx, c); err != nil {
+			logger.Warn("upstream TLS handshake failed", logging.Err(err))
+			return nil, d.fail(ctx, handshakeKind(err, ErrProxyTLS), err)
+		}
 	}
 	pc := &proxyConnection{
+		ctx:    ctx,
 		dialer: d,
 		proxy:  d.Host,
 		conn:   c,
@@ -121,30 +215,75 @@ func (d *ProxyDialer) DialContext(ctx context.Context, network, addr string) (ne
 	resp, err := pc.Connect("")
 	// connection success
 	if err == nil {
-		d.log("proxy connect success")
-		return c, nil
+		logger.Debug("upstream connect success")
+		return pc.netConn(), nil
 	}
 	// no response from proxy
 	if resp == nil {
-		d.log("proxy empty response")
+		logger.Warn("upstream empty response", logging.Err(err))
 		c.Close()
-		return nil, err
+		kind := ErrProxyUnreachable
+		if d.Host.Scheme == "https" && isTLSAlert(err) {
+			kind = ErrProxyTLS
+		}
+		return nil, d.fail(ctx, handshakeKind(err, kind), err)
 	}
 	// unexpected status from proxy
 	if resp.StatusCode != http.StatusProxyAuthRequired {
-		d.logf("proxy unexpected status: %v", resp.Status)
+		logger.Warn("upstream unexpected status", logging.F(logging.KeyStatus, resp.StatusCode), logging.Err(err))
 		c.Close()
-		return nil, err
+		return nil, d.fail(ctx, err, nil)
 	}
+	proxyAuthRequired.With(d.Host.Host).Inc()
+	accessRecordFrom(ctx).addChallenges(resp)
+	accessRecordFrom(ctx).setAuthScheme(auth.GetHeader(resp).Scheme())
+	if d.Auth == nil {
+		logger.Warn("upstream auth required, but no credentials are configured")
+		c.Close()
+		return nil, d.fail(ctx, ErrProxyAuthFailed, errors.New("no credentials configured"))
+	}
+	// The authentication handshake has its own timeout
+	stop()
+	actx, cancelAuth := withTimeout(ctx, d.AuthTimeout)
+	defer cancelAuth()
+	stop = interruptOnCancel(actx, c)
 	// try proxy auth
 	err = d.Auth.Authorize(resp, pc)
 	// proxy auth failed
 	if err != nil {
-		d.logf("proxy auth failed: %v", err)
+		logger.Warn("upstream auth failed", logging.Err(err))
 		c.Close()
-		return nil, err
+		var refused *ErrProxyRefused
+		if errors.As(err, &refused) {
+			return nil, d.fail(ctx, refused, nil)
+		}
+		return nil, d.fail(ctx, handshakeKind(err, ErrProxyAuthFailed), err)
 	}
-	d.log("proxy auth success")
+	logger.Debug("upstream auth success")
 	// proxy auth success
-	return c, nil
+	return pc.netConn(), nil
+}
+
+// fail returns the error of a failed dial as a *ProxyError of the given kind,
+// or the context error if the dial was cancelled by the caller.
+func (d *ProxyDialer) fail(ctx context.Context, kind error, err error) error {
+	if ctx.Err() == context.Canceled {
+		return ctx.Err()
+	}
+	return &ProxyError{Proxy: d.Host.Host, Kind: kind, Err: err}
+}
+
+// isTLSAlert reports whether the error is an alert sent by the TLS peer. With TLS 1.3, a proxy that rejects
+// the client certificate only says so after the client has completed its handshake, on the first read.
+func isTLSAlert(err error) bool {
+	var oerr *net.OpError
+	return errors.As(err, &oerr) && oerr.Op == "remote error"
+}
+
+// handshakeKind returns ErrHandshakeTimeout if the error is a timeout, otherwise the given kind
+func handshakeKind(err error, kind error) error {
+	if isTimeout(err) {
+		return ErrHandshakeTimeout
+	}
+	return kind
 }
@@ -1,39 +1,54 @@
 package proxy_test
 
 import (
-	"github.com/justenwalker/squiggly/proxy"
+	"bufio"
+	"bytes"
+	"context"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/justenwalker/squiggly/auth"
+	"github.com/justenwalker/squiggly/logging"
+	"github.com/justenwalker/squiggly/proxy"
 )
 
-type testLogger struct {
+type testWriter struct {
 	t *testing.T
 }
 
-func (l testLogger) Log(msg string) {
-	l.t.Log(msg)
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(p))
+	return len(p), nil
 }
 
 func TestProxyDialer(t *testing.T) {
 	proxyUser := os.Getenv("PROXY_USER")
 	proxyPass := os.Getenv("PROXY_PASS")
 	proxyHost := os.Getenv("PROXY_HOST")
-	var auth *proxy.BasicAuth
+	var pauth *auth.Auth
 	if proxyHost == "" {
 		t.Skip("PROXY_HOST not defined")
 	}
+	purl, err := url.Parse(proxyHost)
+	if err != nil {
+		t.Fatal("error parsing PROXY_HOST", err)
+	}
 	if proxyUser != "" {
-		auth = &proxy.BasicAuth{
+		pauth = auth.NewAuth(auth.Credentials{
 			Username: proxyUser,
 			Password: proxyPass,
-		}
+		}, nil)
 	}
 	dialer := &proxy.ProxyDialer{
-		Logger: testLogger{t},
-		Auth:   auth,
-		Host:   proxyHost,
+		Logger: logging.NewEventLogger(testWriter{t}, logging.LevelTrace, nil),
+		Auth:   pauth,
+		Host:   purl,
 	}
 	client := http.Client{
 		Transport: &http.Transport{
@@ -51,3 +66,55 @@ func TestProxyDialer(t *testing.T) {
 	}
 	t.Log(string(body))
 }
+
+// serveBasicAuthProxy answers CONNECT requests without credentials with a 407 asking for Basic auth,
+// and accepts the next CONNECT on the same connection
+func serveBasicAuthProxy(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			for {
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") == "" {
+					_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nContent-Length: 0\r\n\r\n")
+					continue
+				}
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				return
+			}
+		}()
+	}
+}
+
+func TestProxyDialerAuthLogsRequestID(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveBasicAuthProxy(l)
+	var buf bytes.Buffer
+	pauth := auth.NewAuth(auth.Credentials{Username: "alice", Password: "secret"}, nil)
+	pauth.Logger = logging.NewEventLogger(&buf, logging.LevelDebug, logging.JSONEncoder{})
+	dialer := &proxy.ProxyDialer{
+		Host: &url.URL{Scheme: "http", Host: l.Addr().String()},
+		Auth: pauth,
+	}
+	ctx := logging.WithRequestID(context.Background(), "9f86d081884c7d65")
+	conn, err := dialer.DialContext(ctx, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !strings.Contains(buf.String(), `"msg":"proxy auth"`) || !strings.Contains(buf.String(), `"request_id":"9f86d081884c7d65"`) {
+		t.Errorf("auth log %q does not carry the request ID", buf.String())
+	}
+}
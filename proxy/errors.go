@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/justenwalker/squiggly/logging"
+	"gopkg.in/elazarl/goproxy.v1"
+)
+
+var (
+	// ErrProxyUnreachable is the kind of ProxyError returned when no connection to the upstream proxy could be established
+	ErrProxyUnreachable = errors.New("proxy unreachable")
+	// ErrProxyAuthFailed is the kind of ProxyError returned when the upstream proxy did not accept the credentials,
+	// or asked for authentication without any credentials configured
+	ErrProxyAuthFailed = errors.New("proxy authentication failed")
+	// ErrHandshakeTimeout is the kind of ProxyError returned when the upstream proxy accepted the connection,
+	// but the TLS, CONNECT or authentication handshake timed out
+	ErrHandshakeTimeout = errors.New("proxy handshake timed out")
+	// ErrProxyTLS is the kind of ProxyError returned when the TLS handshake with an https upstream proxy failed,
+	// for example because its certificate could not be verified
+	ErrProxyTLS = errors.New("proxy TLS handshake failed")
+)
+
+// ErrProxyRefused is the kind of ProxyError returned when the upstream proxy answered the CONNECT
+// with a status other than 200 or 407. Use errors.As to get the status.
+type ErrProxyRefused struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *ErrProxyRefused) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("proxy refused the connection: %s", e.Status)
+	}
+	return fmt.Sprintf("proxy refused the connection: %s: %s", e.Status, e.Body)
+}
+
+// ProxyError is returned by ProxyDialer when a connection through the upstream proxy failed.
+// errors.Is and errors.As match both its Kind and the underlying error.
+type ProxyError struct {
+	// Proxy is the host:port of the upstream proxy
+	Proxy string
+	// Kind is ErrProxyUnreachable, ErrProxyAuthFailed, ErrHandshakeTimeout, ErrProxyTLS or an *ErrProxyRefused
+	Kind error
+	// Err is the underlying error
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	if e.Err == nil || e.Err == e.Kind {
+		return fmt.Sprintf("%s: %v", e.Proxy, e.Kind)
+	}
+	return fmt.Sprintf("%s: %v: %v", e.Proxy, e.Kind, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Kind
+}
+
+// Is matches the underlying error, the Kind is matched through Unwrap
+func (e *ProxyError) Is(target error) bool {
+	return e.Err != nil && errors.Is(e.Err, target)
+}
+
+// As matches the underlying error, the Kind is matched through Unwrap
+func (e *ProxyError) As(target interface{}) bool {
+	return e.Err != nil && errors.As(e.Err, target)
+}
+
+// errorClass returns the name of the kind of a ProxyError, as used in the fallback policy and the X-Squiggly-Error header
+func errorClass(err error) string {
+	var refused *ErrProxyRefused
+	switch {
+	case errors.As(err, &refused):
+		return ClassRefused
+	case errors.Is(err, ErrProxyAuthFailed):
+		return ClassAuthFailed
+	case errors.Is(err, ErrHandshakeTimeout):
+		return ClassHandshakeTimeout
+	case errors.Is(err, ErrProxyTLS):
+		return ClassTLS
+	case errors.Is(err, ErrProxyUnreachable):
+		return ClassUnreachable
+	}
+	return ""
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// Headers of the responses to requests and tunnels that could not be proxied
+const (
+	// ErrorHeader is the class of the error: one of the fallback classes, blocked or destination
+	ErrorHeader = "X-Squiggly-Error"
+	// RouteHeader is the route that was chosen: DIRECT or the upstream proxy host
+	RouteHeader = "X-Squiggly-Route"
+	// UpstreamHeader lists the upstream proxies that were tried, in order
+	UpstreamHeader = "X-Squiggly-Upstream"
+	// ChallengeHeader lists the authentication schemes the upstream proxies asked for
+	ChallengeHeader = "X-Squiggly-Proxy-Challenge"
+)
+
+// Error classes reported in the ErrorHeader besides the fallback classes
+const (
+	// ClassBlocked is a destination on the blocklist
+	ClassBlocked = "blocked"
+	// ClassDestination is a destination that could not be reached or did not respond
+	ClassDestination = "destination"
+)
+
+// errorStatus returns the status returned to the client when a dial failed
+func errorStatus(err error) int {
+	var blocked *BlockedError
+	var refused *ErrProxyRefused
+	switch {
+	case errors.As(err, &blocked):
+		return http.StatusForbidden
+	case errors.Is(err, ErrHandshakeTimeout) || isTimeout(err):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &refused) && refused.StatusCode >= 400 && refused.StatusCode < 600 &&
+		refused.StatusCode != http.StatusProxyAuthRequired:
+		// The status of the upstream proxy, such as 403 for a destination its policy forbids, tells the client more
+		return refused.StatusCode
+	}
+	return http.StatusBadGateway
+}
+
+// ErrorReport describes why a request or tunnel could not be proxied.
+// It is returned to the client as JSON, HTML or plain text, depending on its Accept header.
+type ErrorReport struct {
+	Status int    `json:"status"`
+	Class  string `json:"class"`
+	Target string `json:"target"`
+	// Route is DIRECT or the upstream proxy the connection took last
+	Route string `json:"route"`
+	// Upstreams are the upstream proxies that were tried
+	Upstreams []string `json:"upstreams,omitempty"`
+	// Challenges are the authentication schemes the upstream proxies asked for
+	Challenges []string `json:"challenges,omitempty"`
+	Error      string   `json:"error"`
+	RequestID  string   `json:"request_id"`
+}
+
+func newErrorReport(req *http.Request, err error) *ErrorReport {
+	r := &ErrorReport{
+		Status:    errorStatus(err),
+		Class:     errorClass(err),
+		Target:    requestHost(req),
+		Error:     err.Error(),
+		RequestID: logging.RequestID(req.Context()),
+	}
+	if r.Class == "" {
+		var blocked *BlockedError
+		if errors.As(err, &blocked) {
+			r.Class = ClassBlocked
+		} else {
+			r.Class = ClassDestination
+		}
+	}
+	r.Route, r.Upstreams, r.Challenges = accessRecordFrom(req.Context()).diagnostics()
+	if r.Route == "" {
+		r.Route = routeDirect
+	}
+	return r
+}
+
+func (r *ErrorReport) setHeaders(h http.Header) {
+	h.Set(ErrorHeader, r.Class)
+	h.Set(RouteHeader, r.Route)
+	if len(r.Upstreams) > 0 {
+		h.Set(UpstreamHeader, strings.Join(r.Upstreams, ", "))
+	}
+	if len(r.Challenges) > 0 {
+		h.Set(ChallengeHeader, strings.Join(r.Challenges, ", "))
+	}
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>The proxy could not connect to <b>{{.Target}}</b>.</p>
+<table>
+<tr><th align="left">Error</th><td>{{.Class}}: {{.Error}}</td></tr>
+<tr><th align="left">Route</th><td>{{.Route}}</td></tr>
+{{- if .Upstreams}}
+<tr><th align="left">Upstream proxies tried</th><td>{{range $i, $u := .Upstreams}}{{if $i}}, {{end}}{{$u}}{{end}}</td></tr>
+{{- end}}
+{{- if .Challenges}}
+<tr><th align="left">Proxy authentication requested</th><td>{{range $i, $c := .Challenges}}{{if $i}}, {{end}}{{$c}}{{end}}</td></tr>
+{{- end}}
+<tr><th align="left">Request ID</th><td>{{.RequestID}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// render returns the content type and body of the report in the format the client accepts
+func (r *ErrorReport) render(accept string) (string, []byte) {
+	accept = strings.ToLower(accept)
+	switch {
+	case strings.Contains(accept, "application/json"):
+		b, _ := json.Marshal(r)
+		return "application/json", append(b, '\n')
+	case strings.Contains(accept, "text/html"):
+		var buf bytes.Buffer
+		_ = errorPage.Execute(&buf, struct {
+			*ErrorReport
+			StatusText string
+		}{r, http.StatusText(r.Status)})
+		return "text/html; charset=utf-8", buf.Bytes()
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d %s: %s\n", r.Status, http.StatusText(r.Status), r.Error)
+	fmt.Fprintf(&buf, "class: %s\nroute: %s\n", r.Class, r.Route)
+	if len(r.Upstreams) > 0 {
+		fmt.Fprintf(&buf, "upstreams: %s\n", strings.Join(r.Upstreams, ", "))
+	}
+	if len(r.Challenges) > 0 {
+		fmt.Fprintf(&buf, "challenges: %s\n", strings.Join(r.Challenges, ", "))
+	}
+	fmt.Fprintf(&buf, "request id: %s\n", r.RequestID)
+	return "text/plain; charset=utf-8", buf.Bytes()
+}
+
+// writeDialError writes the reason a dial failed to the client, and returns the status
+func writeDialError(w http.ResponseWriter, req *http.Request, err error) int {
+	r := newErrorReport(req, err)
+	r.setHeaders(w.Header())
+	contentType, body := r.render(req.Header.Get("Accept"))
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(r.Status)
+	_, _ = w.Write(body)
+	return r.Status
+}
+
+// dialErrorResponse returns the response telling the client why a request could not be proxied
+func dialErrorResponse(req *http.Request, err error) *http.Response {
+	r := newErrorReport(req, err)
+	contentType, body := r.render(req.Header.Get("Accept"))
+	resp := goproxy.NewResponse(req, contentType, r.Status, string(body))
+	r.setHeaders(resp.Header)
+	return resp
+}
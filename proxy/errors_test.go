@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestErrorReport(t *testing.T) {
+	challenge := listenLoopback(t)
+	go serveStatus(challenge, "407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nProxy-Authenticate: Negotiate")
+	forbidden := listenLoopback(t)
+	go serveStatus(forbidden, "403 Forbidden")
+	var purl *url.URL
+	s := New(Proxy(func(req *http.Request) (*url.URL, error) { return purl, nil }))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// Plain request through an upstream asking for credentials that are not configured
+	purl = proxyURLFor(challenge)
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept", "application/json")
+	proxyURL, _ := url.Parse(srv.URL)
+	resp, err := (&http.Transport{Proxy: http.ProxyURL(proxyURL)}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report ErrorReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway || report.Status != http.StatusBadGateway {
+		t.Errorf("status = %d, report status = %d", resp.StatusCode, report.Status)
+	}
+	headers := map[string]string{
+		ErrorHeader:     ClassAuthFailed,
+		RouteHeader:     purl.Host,
+		UpstreamHeader:  purl.Host,
+		ChallengeHeader: "ntlm, negotiate",
+	}
+	for name, want := range headers {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if report.Class != ClassAuthFailed || report.Route != purl.Host || strings.Join(report.Challenges, ",") != "ntlm,negotiate" ||
+		report.Target != "example.com" || report.RequestID == "" || !strings.Contains(report.Error, "no credentials configured") {
+		t.Errorf("report = %+v", report)
+	}
+
+	// CONNECT refused by the upstream gets its status
+	purl = proxyURLFor(forbidden)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	cresp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cresp.StatusCode != http.StatusForbidden || cresp.Header.Get(ErrorHeader) != ClassRefused {
+		t.Errorf("CONNECT = %s, %s: %s", cresp.Status, ErrorHeader, cresp.Header.Get(ErrorHeader))
+	}
+}
+
+func TestErrorReportRender(t *testing.T) {
+	r := &ErrorReport{Status: 504, Class: ClassHandshakeTimeout, Target: "example.com:443", Route: "proxy:8080",
+		Upstreams: []string{"proxy:8080"}, Error: "proxy:8080: proxy handshake timed out", RequestID: "abc"}
+	contentType, body := r.render("text/html,application/xhtml+xml")
+	if !strings.HasPrefix(contentType, "text/html") || !strings.Contains(string(body), "<b>example.com:443</b>") {
+		t.Errorf("html = %s %s", contentType, body)
+	}
+	contentType, body = r.render("*/*")
+	want := "504 Gateway Timeout: proxy:8080: proxy handshake timed out\nclass: timeout\nroute: proxy:8080\nupstreams: proxy:8080\nrequest id: abc\n"
+	if !strings.HasPrefix(contentType, "text/plain") || string(body) != want {
+		t.Errorf("text = %s %q", contentType, body)
+	}
+}
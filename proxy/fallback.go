@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Error classes of the fallback policy
+const (
+	// ClassUnreachable is a connection to the upstream proxy that could not be established
+	ClassUnreachable = "unreachable"
+	// ClassAuthFailed is an upstream proxy that did not accept the credentials
+	ClassAuthFailed = "auth"
+	// ClassRefused is an upstream proxy that answered the CONNECT with an error status
+	ClassRefused = "refused"
+	// ClassHandshakeTimeout is an upstream proxy that accepted the connection, but did not complete the handshake in time
+	ClassHandshakeTimeout = "timeout"
+	// ClassTLS is an https upstream proxy whose TLS handshake failed, such as a certificate that could not be verified
+	ClassTLS = "tls"
+)
+
+// FallbackAction is what happens to a connection when the upstream proxy fails
+type FallbackAction string
+
+const (
+	// FallbackDirect connects directly to the destination
+	FallbackDirect FallbackAction = "direct"
+	// FallbackNext tries the next proxy returned by the PAC file, and fails if there is none
+	FallbackNext FallbackAction = "next"
+	// FallbackFail returns the error to the client
+	FallbackFail FallbackAction = "fail"
+)
+
+// FallbackPolicy maps each error class to the action taken when a connection through the upstream proxy fails
+type FallbackPolicy map[string]FallbackAction
+
+// DefaultFallbackPolicy connects directly when the upstream proxy is unreachable, and fails otherwise.
+// A proxy whose certificate does not verify may be an interception attempt, so it is never bypassed by default.
+func DefaultFallbackPolicy() FallbackPolicy {
+	return FallbackPolicy{
+		ClassUnreachable:      FallbackDirect,
+		ClassAuthFailed:       FallbackFail,
+		ClassRefused:          FallbackFail,
+		ClassHandshakeTimeout: FallbackFail,
+		ClassTLS:              FallbackFail,
+	}
+}
+
+// Set the action for an error class
+func (p FallbackPolicy) Set(class, action string) error {
+	if _, ok := DefaultFallbackPolicy()[class]; !ok {
+		return fmt.Errorf("unknown error class '%s', expected one of %s", class, strings.Join(p.classes(), ", "))
+	}
+	switch a := FallbackAction(strings.ToLower(action)); a {
+	case FallbackDirect, FallbackNext, FallbackFail:
+		p[class] = a
+		return nil
+	}
+	return fmt.Errorf("unknown fallback action '%s' for '%s', expected direct, next or fail", action, class)
+}
+
+func (p FallbackPolicy) classes() []string {
+	classes := make([]string, 0, len(p))
+	for class := range DefaultFallbackPolicy() {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// action returns the action for the error returned by the upstream proxy
+func (p FallbackPolicy) action(err error) FallbackAction {
+	if a, ok := p[errorClass(err)]; ok {
+		return a
+	}
+	return FallbackFail
+}
+
+// Fallback sets what happens to a connection for each class of upstream proxy error.
+// Classes missing from the policy keep their default action.
+func Fallback(policy FallbackPolicy) Option {
+	return func(s *Server) {
+		merged := DefaultFallbackPolicy()
+		for class, action := range policy {
+			merged[class] = action
+		}
+		s.fallback = merged
+	}
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// serveStatus answers every CONNECT with the status line
+func serveStatus(l net.Listener, status string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+				return
+			}
+			_, _ = io.WriteString(conn, "HTTP/1.1 "+status+"\r\nContent-Length: 6\r\n\r\ndenied")
+		}()
+	}
+}
+
+func proxyURLFor(l net.Listener) *url.URL {
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// closedAddr returns an address nothing is listening on
+func closedAddr(t *testing.T) string {
+	l := listenLoopback(t)
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestProxyDialerErrors(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+	addr := echo.Addr().String()
+
+	refusing := listenLoopback(t)
+	go serveStatus(refusing, "403 Forbidden")
+	authenticating := listenLoopback(t)
+	go serveStatus(authenticating, "407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"")
+	blackhole := listenLoopback(t)
+	serveBlackhole(t, blackhole)
+
+	tests := []struct {
+		name  string
+		proxy *url.URL
+		class string
+	}{
+		{"unreachable", &url.URL{Scheme: "http", Host: closedAddr(t)}, ClassUnreachable},
+		{"refused", proxyURLFor(refusing), ClassRefused},
+		{"auth without credentials", proxyURLFor(authenticating), ClassAuthFailed},
+		{"handshake timeout", proxyURLFor(blackhole), ClassHandshakeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			d := &ProxyDialer{Host: tt.proxy}
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+				t.Fatal("DialContext succeeded")
+			}
+			var perr *ProxyError
+			if !errors.As(err, &perr) {
+				t.Fatalf("error %v is %T, want *ProxyError", err, err)
+			}
+			if class := errorClass(err); class != tt.class {
+				t.Errorf("class of %v = %q, want %q", err, class, tt.class)
+			}
+		})
+	}
+
+	t.Run("refused status", func(t *testing.T) {
+		d := &ProxyDialer{Host: proxyURLFor(refusing)}
+		_, err := d.DialContext(context.Background(), "tcp", addr)
+		var refused *ErrProxyRefused
+		if !errors.As(err, &refused) {
+			t.Fatalf("error %v is not ErrProxyRefused", err)
+		}
+		if refused.StatusCode != http.StatusForbidden || refused.Body != "denied" {
+			t.Errorf("refused = %+v", refused)
+		}
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		d := &ProxyDialer{Host: proxyURLFor(blackhole)}
+		_, err := d.DialContext(ctx, "tcp", addr)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("error = %v, want context.Canceled", err)
+		}
+	})
+}
+
+func TestFallbackPolicy(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+	addr := echo.Addr().String()
+
+	refusing := listenLoopback(t)
+	go serveStatus(refusing, "403 Forbidden")
+	working := listenLoopback(t)
+	go serveConnectProxy(working, make(chan string, 10))
+	unreachable := &url.URL{Scheme: "http", Host: closedAddr(t)}
+
+	tests := []struct {
+		name    string
+		proxies []*url.URL
+		policy  FallbackPolicy
+		route   string
+		class   string
+	}{
+		{"unreachable falls back direct by default", []*url.URL{unreachable}, nil, routeDirect, ""},
+		{"refused fails by default", []*url.URL{proxyURLFor(refusing), nil}, nil, "", ClassRefused},
+		{"refused tries the next proxy", []*url.URL{proxyURLFor(refusing), proxyURLFor(working)}, FallbackPolicy{ClassRefused: FallbackNext}, working.Addr().String(), ""},
+		{"next proxy may be direct", []*url.URL{proxyURLFor(refusing), nil}, FallbackPolicy{ClassRefused: FallbackNext}, routeDirect, ""},
+		{"next fails without another proxy", []*url.URL{proxyURLFor(refusing)}, FallbackPolicy{ClassRefused: FallbackNext}, "", ClassRefused},
+		{"unreachable may fail", []*url.URL{unreachable, nil}, FallbackPolicy{ClassUnreachable: FallbackFail}, "", ClassUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxies := tt.proxies
+			s := New(
+				Proxies(func(req *http.Request) ([]*url.URL, error) { return proxies, nil }),
+				Fallback(tt.policy),
+			)
+			conn, route, err := s.dialRoute(context.Background(), "tcp", addr)
+			if tt.class != "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("dialRoute succeeded through %s", route)
+				}
+				if class := errorClass(err); class != tt.class {
+					t.Errorf("class of %v = %q, want %q", err, class, tt.class)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialRoute: %v", err)
+			}
+			if route != tt.route {
+				t.Errorf("route = %q, want %q", route, tt.route)
+			}
+			assertEcho(t, conn)
+		})
+	}
+}
+
+func TestFallbackPolicySet(t *testing.T) {
+	p := DefaultFallbackPolicy()
+	if err := p.Set(ClassAuthFailed, "DIRECT"); err != nil {
+		t.Fatal(err)
+	}
+	if p[ClassAuthFailed] != FallbackDirect {
+		t.Errorf("auth = %q, want %q", p[ClassAuthFailed], FallbackDirect)
+	}
+	if err := p.Set("dns", "direct"); err == nil {
+		t.Error("unknown class accepted")
+	}
+	if err := p.Set(ClassRefused, "retry"); err == nil {
+		t.Error("unknown action accepted")
+	}
+}
+
+func TestFallbackPolicyRace(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+	addr := echo.Addr().String()
+
+	refusing := listenLoopback(t)
+	go serveStatus(refusing, "403 Forbidden")
+	authenticating := listenLoopback(t)
+	go serveStatus(authenticating, "407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"")
+	working := listenLoopback(t)
+	go serveConnectProxy(working, make(chan string, 10))
+	unreachable := &url.URL{Scheme: "http", Host: closedAddr(t)}
+
+	tests := []struct {
+		name    string
+		proxies []*url.URL
+		policy  FallbackPolicy
+		route   string
+		class   string
+	}{
+		{"unreachable races direct by default", []*url.URL{unreachable}, nil, routeDirect, ""},
+		{"refused fails by default", []*url.URL{proxyURLFor(refusing)}, nil, "", ClassRefused},
+		{"auth fails by default", []*url.URL{proxyURLFor(authenticating), nil}, nil, "", ClassAuthFailed},
+		{"refused tries the next proxy", []*url.URL{proxyURLFor(refusing), proxyURLFor(working)}, FallbackPolicy{ClassRefused: FallbackNext}, working.Addr().String(), ""},
+		{"unreachable tries the next proxy", []*url.URL{unreachable, proxyURLFor(working)}, FallbackPolicy{ClassUnreachable: FallbackNext}, working.Addr().String(), ""},
+		{"unreachable may fail", []*url.URL{unreachable, nil}, FallbackPolicy{ClassUnreachable: FallbackFail}, "", ClassUnreachable},
+		{"refused may race direct", []*url.URL{proxyURLFor(refusing)}, FallbackPolicy{ClassRefused: FallbackDirect}, routeDirect, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxies := tt.proxies
+			s := New(
+				Proxies(func(req *http.Request) ([]*url.URL, error) { return proxies, nil }),
+				Fallback(tt.policy),
+				// The delay is longer than the test, so the direct dial only starts when the proxy fails
+				Race(time.Minute, 0),
+			)
+			conn, route, err := s.dialRoute(context.Background(), "tcp", addr)
+			if tt.class != "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("dialRoute succeeded through %s", route)
+				}
+				if class := errorClass(err); class != tt.class {
+					t.Errorf("class of %v = %q, want %q", err, class, tt.class)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialRoute: %v", err)
+			}
+			if route != tt.route {
+				t.Errorf("route = %q, want %q", route, tt.route)
+			}
+			assertEcho(t, conn)
+		})
+	}
+}
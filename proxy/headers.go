@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// HeaderDirection is the message a header rule applies to
+type HeaderDirection string
+
+const (
+	// HeaderRequest rules apply to plain and decrypted requests sent to the destination
+	HeaderRequest HeaderDirection = "request"
+	// HeaderResponse rules apply to the responses to plain and decrypted requests returned to the client
+	HeaderResponse HeaderDirection = "response"
+	// HeaderConnect rules apply to the CONNECT requests sent to the upstream proxy
+	HeaderConnect HeaderDirection = "connect"
+)
+
+// HeaderAction is what a header rule does to the header
+type HeaderAction string
+
+const (
+	// HeaderSet replaces the header with the value
+	HeaderSet HeaderAction = "set"
+	// HeaderAdd adds the value to the header
+	HeaderAdd HeaderAction = "add"
+	// HeaderRemove removes the header
+	HeaderRemove HeaderAction = "remove"
+)
+
+// HeaderRule changes a header of the messages in one direction to the matching hosts.
+// The value may refer to the client IP address as {client}, the destination host as {host}
+// and the request ID as {request_id}.
+type HeaderRule struct {
+	Direction HeaderDirection
+	// Hosts are the destinations the rule applies to. Empty matches every host.
+	Hosts  HostPatterns
+	Action HeaderAction
+	Name   string
+	Value  string
+}
+
+// ParseHeaderRule parses a header rule in the form DIRECTION[@PATTERN]:ACTION:NAME[=VALUE],
+// e.g. "connect:set:User-Agent=Mozilla/5.0", "request@.intranet.example.com:set:X-Team=infra"
+// or "response:remove:Server"
+func ParseHeaderRule(s string) (HeaderRule, error) {
+	var r HeaderRule
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return r, fmt.Errorf("invalid header rule '%s', expected DIRECTION[@PATTERN]:ACTION:NAME[=VALUE]", s)
+	}
+	direction := parts[0]
+	if i := strings.Index(direction, "@"); i >= 0 {
+		if direction[i+1:] == "" {
+			return r, fmt.Errorf("invalid header rule '%s': empty host pattern", s)
+		}
+		r.Hosts = HostPatterns{direction[i+1:]}
+		direction = direction[:i]
+	}
+	switch d := HeaderDirection(strings.ToLower(direction)); d {
+	case HeaderRequest, HeaderResponse, HeaderConnect:
+		r.Direction = d
+	default:
+		return r, fmt.Errorf("invalid header rule '%s': unknown direction '%s', expected request, response or connect", s, direction)
+	}
+	switch a := HeaderAction(strings.ToLower(parts[1])); a {
+	case HeaderSet, HeaderAdd, HeaderRemove:
+		r.Action = a
+	default:
+		return r, fmt.Errorf("invalid header rule '%s': unknown action '%s', expected set, add or remove", s, parts[1])
+	}
+	name := parts[2]
+	if i := strings.Index(name, "="); i >= 0 {
+		name, r.Value = name[:i], name[i+1:]
+	} else if r.Action != HeaderRemove {
+		return r, fmt.Errorf("invalid header rule '%s': %s needs a value", s, r.Action)
+	}
+	if r.Name = http.CanonicalHeaderKey(strings.TrimSpace(name)); r.Name == "" {
+		return r, fmt.Errorf("invalid header rule '%s': empty header name", s)
+	}
+	return r, nil
+}
+
+// applyHeaderRules applies the rules of the direction matching the destination host to the header, in order
+func applyHeaderRules(ctx context.Context, rules []HeaderRule, dir HeaderDirection, h http.Header, host, client string) {
+	var vars *strings.Replacer
+	for _, r := range rules {
+		if r.Direction != dir || (len(r.Hosts) > 0 && !r.Hosts.Match(host)) {
+			continue
+		}
+		value := r.Value
+		if strings.Contains(value, "{") {
+			if vars == nil {
+				vars = strings.NewReplacer(
+					"{client}", hostname(client),
+					"{host}", hostname(host),
+					"{request_id}", logging.RequestID(ctx),
+				)
+			}
+			value = vars.Replace(value)
+		}
+		switch r.Action {
+		case HeaderSet:
+			h.Set(r.Name, value)
+		case HeaderAdd:
+			h.Add(r.Name, value)
+		case HeaderRemove:
+			h.Del(r.Name)
+		}
+	}
+}
+
+// HeaderRules rewrites the headers of requests, responses and upstream CONNECTs.
+// Rules are applied in the order they are given.
+func HeaderRules(rules ...HeaderRule) Option {
+	return func(s *Server) {
+		s.headerRules = append(s.headerRules, rules...)
+	}
+}
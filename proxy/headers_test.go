@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseHeaderRule(t *testing.T) {
+	tests := []struct {
+		in   string
+		want HeaderRule
+		err  bool
+	}{
+		{in: "connect:set:User-Agent=Mozilla/5.0 (X11)", want: HeaderRule{Direction: HeaderConnect, Action: HeaderSet, Name: "User-Agent", Value: "Mozilla/5.0 (X11)"}},
+		{in: "request@.intranet.example.com:add:x-team=a=b", want: HeaderRule{Direction: HeaderRequest, Hosts: HostPatterns{".intranet.example.com"}, Action: HeaderAdd, Name: "X-Team", Value: "a=b"}},
+		{in: "response:remove:Server", want: HeaderRule{Direction: HeaderResponse, Action: HeaderRemove, Name: "Server"}},
+		{in: "request:set:Via=", want: HeaderRule{Direction: HeaderRequest, Action: HeaderSet, Name: "Via"}},
+		{in: "request:set:Via", err: true},
+		{in: "request:set", err: true},
+		{in: "upstream:set:Via=x", err: true},
+		{in: "request:replace:Via=x", err: true},
+		{in: "request@:remove:Via", err: true},
+		{in: "request:remove:=x", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseHeaderRule(tt.in)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("ParseHeaderRule(%q) = %+v, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseHeaderRule(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	rules := []HeaderRule{
+		{Direction: HeaderRequest, Action: HeaderAdd, Name: "X-Forwarded-For", Value: "{client}"},
+		{Direction: HeaderRequest, Action: HeaderSet, Name: "Via", Value: "1.1 squiggly ({host})"},
+		{Direction: HeaderRequest, Hosts: HostPatterns{".intranet.example.com"}, Action: HeaderSet, Name: "X-Team", Value: "infra"},
+		{Direction: HeaderRequest, Action: HeaderRemove, Name: "Cookie"},
+		{Direction: HeaderResponse, Action: HeaderRemove, Name: "Server"},
+	}
+	h := http.Header{"X-Forwarded-For": {"10.0.0.1"}, "Cookie": {"a=b"}, "Server": {"x"}}
+	applyHeaderRules(context.Background(), rules, HeaderRequest, h, "www.intranet.example.com:80", "192.0.2.1:5000")
+	want := http.Header{
+		"X-Forwarded-For": {"10.0.0.1", "192.0.2.1"},
+		"Via":             {"1.1 squiggly (www.intranet.example.com)"},
+		"X-Team":          {"infra"},
+		"Server":          {"x"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("request header = %v, want %v", h, want)
+	}
+	h = http.Header{}
+	applyHeaderRules(context.Background(), rules, HeaderRequest, h, "example.com", "192.0.2.1:5000")
+	if h.Get("X-Team") != "" {
+		t.Errorf("rule applied to a host that does not match: %v", h)
+	}
+}
+
+func TestHeaderRulesConnect(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+	upstream := listenLoopback(t)
+	agents := make(chan string, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		agents <- req.UserAgent()
+		_, _ = io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\n\r\n")
+	}()
+	d := &ProxyDialer{
+		Host:        proxyURLFor(upstream),
+		HeaderRules: []HeaderRule{{Direction: HeaderConnect, Action: HeaderSet, Name: "User-Agent", Value: "Mozilla/5.0"}},
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if ua := <-agents; ua != "Mozilla/5.0" {
+		t.Errorf("CONNECT User-Agent = %q", ua)
+	}
+}
+
+func TestHeaderRulesProxy(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+		w.Header().Set("Server", "origin")
+	}))
+	defer origin.Close()
+	s := New(HeaderRules(
+		HeaderRule{Direction: HeaderRequest, Action: HeaderSet, Name: "X-Forwarded-For", Value: "{client}"},
+		HeaderRule{Direction: HeaderResponse, Action: HeaderRemove, Name: "Server"},
+	))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	purl, _ := url.Parse(srv.URL)
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	resp, err := (&http.Transport{Proxy: http.ProxyURL(purl)}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if server := resp.Header.Get("Server"); server != "" {
+		t.Errorf("response Server = %q", server)
+	}
+	h := <-headers
+	if xff, _, _ := net.SplitHostPort(srv.Listener.Addr().String()); h.Get("X-Forwarded-For") != xff {
+		t.Errorf("X-Forwarded-For = %q, want %q", h.Get("X-Forwarded-For"), xff)
+	}
+	for _, name := range []string{"Proxy-Authorization", "Proxy-Connection"} {
+		if v := h.Get(name); v != "" {
+			t.Errorf("%s = %q was forwarded", name, v)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// UpstreamStatus describes the health of an upstream proxy, as observed by recent connections through it
+type UpstreamStatus struct {
+	Host        string    `json:"host"`
+	Healthy     bool      `json:"healthy"`
+	Successes   int64     `json:"successes"`
+	Failures    int64     `json:"failures"`
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// upstreamHealth records the outcome of connections to each upstream proxy
+type upstreamHealth struct {
+	mu        sync.Mutex
+	upstreams map[string]*UpstreamStatus
+}
+
+func (h *upstreamHealth) get(host string) *UpstreamStatus {
+	if h.upstreams == nil {
+		h.upstreams = make(map[string]*UpstreamStatus)
+	}
+	st, ok := h.upstreams[host]
+	if !ok {
+		st = &UpstreamStatus{Host: host}
+		h.upstreams[host] = st
+	}
+	return st
+}
+
+func (h *upstreamHealth) success(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.get(host)
+	st.Successes++
+	st.LastSuccess = time.Now()
+	st.Healthy = true
+}
+
+func (h *upstreamHealth) failure(host string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.get(host)
+	st.Failures++
+	st.LastFailure = time.Now()
+	st.LastError = err.Error()
+	st.Healthy = false
+}
+
+func (h *upstreamHealth) list() []UpstreamStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]UpstreamStatus, 0, len(h.upstreams))
+	for _, st := range h.upstreams {
+		list = append(list, *st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Host < list[j].Host
+	})
+	return list
+}
+
+// Upstreams returns the health of every upstream proxy the server has connected through
+func (s *Server) Upstreams() []UpstreamStatus {
+	return s.health.list()
+}
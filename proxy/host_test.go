@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestHost(t *testing.T) {
+	tests := []struct {
+		proxy string
+		want  string
+	}{
+		{proxy: "http://proxy.example.com", want: "proxy.example.com:80"},
+		{proxy: "https://proxy.example.com", want: "proxy.example.com:443"},
+		{proxy: "http://proxy.example.com:8080", want: "proxy.example.com:8080"},
+		{proxy: "http://[2001:db8::1]", want: "[2001:db8::1]:80"},
+		{proxy: "https://[2001:db8::1]", want: "[2001:db8::1]:443"},
+		{proxy: "http://[2001:db8::1]:8080", want: "[2001:db8::1]:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proxy, func(t *testing.T) {
+			u, err := url.Parse(tt.proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := host(u); got != tt.want {
+				t.Errorf("host(%q) = %q, want %q", tt.proxy, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetURL(t *testing.T) {
+	tests := []struct {
+		addr     string
+		hostname string
+		port     string
+	}{
+		{addr: "example.com:443", hostname: "example.com", port: "443"},
+		{addr: "[2001:db8::1]:443", hostname: "2001:db8::1", port: "443"},
+		{addr: "[fe80::1%eth0]:8080", hostname: "fe80::1%eth0", port: "8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, targetURL(tt.addr), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.URL.Hostname() != tt.hostname || req.URL.Port() != tt.port {
+				t.Errorf("got host %q port %q, want %q %q", req.URL.Hostname(), req.URL.Port(), tt.hostname, tt.port)
+			}
+		})
+	}
+}
+
+// listenIPv6 listens on the IPv6 loopback, or skips the test if IPv6 is not available
+func listenIPv6(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// serveEcho echoes back everything sent to connections accepted from l
+func serveEcho(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+// serveConnectProxy is a minimal upstream proxy that tunnels CONNECT requests,
+// sending the requested target of each to targets.
+func serveConnectProxy(l net.Listener, targets chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			targets <- req.Host
+			target, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+				return
+			}
+			defer target.Close()
+			_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+			go func() { _, _ = io.Copy(target, br) }()
+			_, _ = io.Copy(conn, target)
+		}()
+	}
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echo = %q, want %q", buf, "ping")
+	}
+}
+
+func TestProxyDialerIPv6(t *testing.T) {
+	echo := listenIPv6(t)
+	go serveEcho(echo)
+	upstream := listenIPv6(t)
+	targets := make(chan string, 1)
+	go serveConnectProxy(upstream, targets)
+
+	d := &ProxyDialer{Host: &url.URL{Scheme: "http", Host: upstream.Addr().String()}}
+	conn, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	if got := <-targets; got != echo.Addr().String() {
+		t.Errorf("CONNECT target = %q, want %q", got, echo.Addr().String())
+	}
+	assertEcho(t, conn)
+}
+
+func TestServerDialIPv6(t *testing.T) {
+	echo := listenIPv6(t)
+	go serveEcho(echo)
+	upstream := listenIPv6(t)
+	targets := make(chan string, 1)
+	go serveConnectProxy(upstream, targets)
+	purl := &url.URL{Scheme: "http", Host: upstream.Addr().String()}
+
+	t.Run("direct", func(t *testing.T) {
+		s := New()
+		conn, route, err := s.dialRoute(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("dialRoute: %v", err)
+		}
+		if route != routeDirect {
+			t.Errorf("route = %q, want %q", route, routeDirect)
+		}
+		assertEcho(t, conn)
+	})
+	t.Run("upstream", func(t *testing.T) {
+		s := New(Proxy(func(req *http.Request) (*url.URL, error) {
+			if req.URL.Hostname() != "::1" {
+				t.Errorf("proxy selected for host %q, want %q", req.URL.Hostname(), "::1")
+			}
+			return purl, nil
+		}))
+		conn, route, err := s.dialRoute(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("dialRoute: %v", err)
+		}
+		if route != purl.Host {
+			t.Errorf("route = %q, want %q", route, purl.Host)
+		}
+		if got := <-targets; got != echo.Addr().String() {
+			t.Errorf("CONNECT target = %q, want %q", got, echo.Addr().String())
+		}
+		assertEcho(t, conn)
+	})
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"crypto/tls"
+
+	"github.com/justenwalker/squiggly/logging"
+	"github.com/justenwalker/squiggly/mitm"
+	"gopkg.in/elazarl/goproxy.v1"
+)
+
+// onConnect decides whether a CONNECT request is intercepted.
+// Only hosts in the intercept list are decrypted; everything else is tunnelled untouched.
+func (s *Server) onConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	if !s.intercepts(host) {
+		return nil, ""
+	}
+	s.logger.Ctx(ctx.Req.Context()).Debug("intercepting tunnel", logging.F(logging.KeyClient, ctx.Req.RemoteAddr), logging.F(logging.KeyTarget, host))
+	return &goproxy.ConnectAction{
+		Action:    goproxy.ConnectMitm,
+		TLSConfig: s.interceptTLSConfig,
+	}, host
+}
+
+// intercepts reports whether tunnels to the host are decrypted
+func (s *Server) intercepts(host string) bool {
+	return s.issuer != nil && s.intercept.Match(host)
+}
+
+func (s *Server) interceptTLSConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	return s.issuer.TLSConfig(host), nil
+}
+
+// Intercept decrypts HTTPS traffic to the matching hosts using certificates minted by the issuer,
+// so that the requests and responses pass through the same hooks as plain HTTP traffic.
+func Intercept(issuer *mitm.Issuer, hosts []string) Option {
+	return func(s *Server) {
+		s.issuer = issuer
+		s.intercept = HostPatterns(hosts)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net"
+	"path"
+	"strings"
+)
+
+// HostPatterns is a list of host name patterns.
+// A pattern may be an exact host name ("api.example.com"), a glob ("*.example.com"),
+// or a domain with a leading dot (".example.com") which matches the domain and all of its subdomains.
+type HostPatterns []string
+
+// Match reports whether the host, with or without a port, matches any of the patterns
+func (p HostPatterns) Match(host string) bool {
+	return p.index(host) >= 0
+}
+
+// index returns the index of the first pattern matching the host, or -1
+func (p HostPatterns) index(host string) int {
+	if len(p) == 0 {
+		return -1
+	}
+	host = strings.ToLower(strings.TrimSuffix(hostname(host), "."))
+	for i, pattern := range p {
+		if matchHost(strings.ToLower(pattern), host) {
+			return i
+		}
+	}
+	return -1
+}
+
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, ".") {
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	}
+	ok, err := path.Match(pattern, host)
+	return err == nil && ok
+}
+
+// hostname strips the port, and the brackets around IPv6 literals, from a host
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import "testing"
+
+func TestHostPatternsMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "api.example.com", host: "api.example.com", want: true},
+		{pattern: "api.example.com", host: "api.example.com:443", want: true},
+		{pattern: "api.example.com", host: "API.Example.COM.", want: true},
+		{pattern: "API.example.com", host: "api.example.com", want: true},
+		{pattern: "api.example.com", host: "www.api.example.com", want: false},
+		{pattern: "*.example.com", host: "www.example.com", want: true},
+		{pattern: "*.example.com", host: "www.example.com:8080", want: true},
+		{pattern: "*.example.com", host: "example.com", want: false},
+		// globs are matched with path.Match, whose * also matches dots
+		{pattern: "*.example.com", host: "a.b.example.com", want: true},
+		{pattern: "api-?.example.com", host: "api-1.example.com", want: true},
+		{pattern: ".example.com", host: "example.com", want: true},
+		{pattern: ".example.com", host: "www.example.com", want: true},
+		{pattern: ".example.com", host: "a.b.example.com:443", want: true},
+		{pattern: ".example.com", host: "badexample.com", want: false},
+		{pattern: ".example.com", host: "example.com.evil.net", want: false},
+		{pattern: "10.1.2.3", host: "10.1.2.3:80", want: true},
+		{pattern: "::1", host: "[::1]:8080", want: true},
+		{pattern: "::1", host: "[::1]", want: true},
+		{pattern: "[", host: "[", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.host, func(t *testing.T) {
+			if got := (HostPatterns{tt.pattern}).Match(tt.host); got != tt.want {
+				t.Errorf("HostPatterns{%q}.Match(%q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostPatternsIndex(t *testing.T) {
+	p := HostPatterns{"api.example.com", ".example.com", "*.example.net"}
+	tests := []struct {
+		host string
+		want int
+	}{
+		{host: "api.example.com", want: 0},
+		{host: "www.example.com", want: 1},
+		{host: "www.example.net", want: 2},
+		{host: "example.org", want: -1},
+	}
+	for _, tt := range tests {
+		if got := p.index(tt.host); got != tt.want {
+			t.Errorf("index(%q) = %d, want %d", tt.host, got, tt.want)
+		}
+	}
+	if HostPatterns(nil).Match("example.com") {
+		t.Error("empty patterns matched")
+	}
+}
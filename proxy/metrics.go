@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	"github.com/justenwalker/squiggly/metrics"
+)
+
+// routeDirect is the route label used for direct connections
+const routeDirect = "DIRECT"
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		"squiggly_requests_total",
+		"Plain HTTP requests by route (DIRECT or upstream proxy host).",
+		"route",
+	)
+	tunnelsTotal = metrics.NewCounterVec(
+		"squiggly_tunnels_total",
+		"CONNECT, SOCKS and transparent tunnels by route (DIRECT or upstream proxy host).",
+		"route",
+	)
+	activeTunnels = metrics.NewGaugeVec(
+		"squiggly_active_tunnels",
+		"Tunnels currently open.",
+	).With()
+	dialDuration = metrics.NewHistogramVec(
+		"squiggly_dial_duration_seconds",
+		"Time to establish a connection by route, including the upstream CONNECT and authentication.",
+		nil,
+		"route",
+	)
+	proxyAuthRequired = metrics.NewCounterVec(
+		"squiggly_proxy_auth_required_total",
+		"407 Proxy Authentication Required responses received from upstream proxies.",
+		"upstream",
+	)
+	directFallbacks = metrics.NewCounterVec(
+		"squiggly_direct_fallbacks_total",
+		"Connections that fell back to DIRECT after the upstream proxy failed, according to the fallback policy.",
+		"upstream",
+	)
+	transferred = metrics.NewCounterVec(
+		"squiggly_transferred_bytes_total",
+		"Bytes sent by clients (in) and to clients (out), through plain HTTP requests and tunnels.",
+		"direction",
+	)
+	transferredIn  = transferred.With("in")
+	transferredOut = transferred.With("out")
+	throughput     = metrics.NewGaugeFuncVec(
+		"squiggly_throughput_bytes_per_second",
+		"Bytes per second sent by clients (in) and to clients (out), averaged over the last 5 seconds.",
+		"direction",
+	)
+	rateLimitWait = metrics.NewCounterVec(
+		"squiggly_rate_limit_wait_seconds_total",
+		"Time transfers were delayed by rate limits, by the limit that delayed them (global, client or host pattern).",
+		"limit",
+	)
+	raceWins = metrics.NewCounterVec(
+		"squiggly_race_wins_total",
+		"Raced connections by the route that connected first (DIRECT or upstream proxy host).",
+		"route",
+	)
+	blocked = metrics.NewCounterVec(
+		"squiggly_blocked_total",
+		"Plain HTTP requests and tunnels refused because their destination is on the blocklist.",
+		"kind",
+	)
+	blocklistDomains = metrics.NewGaugeVec(
+		"squiggly_blocklist_domains",
+		"Domains on the blocklist.",
+	).With()
+	cacheRequests = metrics.NewCounterVec(
+		"squiggly_cache_requests_total",
+		"Plain HTTP GET requests by cache result (HIT, MISS, REVALIDATED or BYPASS).",
+		"result",
+	)
+	cacheSize = metrics.NewGaugeVec(
+		"squiggly_cache_size_bytes",
+		"Size of the response bodies stored in the HTTP cache.",
+	).With()
+)
+
+// trackedConn decrements the active tunnel gauge when it is closed
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func newTrackedConn(conn net.Conn) *trackedConn {
+	activeTunnels.Inc()
+	return &trackedConn{Conn: conn}
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(activeTunnels.Dec)
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+func TestRequestRouteWithoutReevaluating(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+	upstream := listenLoopback(t)
+	go serveConnectProxy(upstream, make(chan string, 10))
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	accessLog, err := logging.OpenAccessLog(logPath, logging.AccessJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accessLog.Close()
+	var evaluations int32
+	s := New(
+		Proxies(func(req *http.Request) ([]*url.URL, error) {
+			atomic.AddInt32(&evaluations, 1)
+			return []*url.URL{proxyURLFor(upstream)}, nil
+		}),
+		AccessLog(accessLog),
+	)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	purl, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(purl)}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	// The second request reuses the connection to the upstream, so the proxies are only chosen once
+	if n := atomic.LoadInt32(&evaluations); n != 1 {
+		t.Errorf("proxies evaluated %d times for 2 requests, want 1", n)
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines int
+	for sc := bufio.NewScanner(f); sc.Scan(); lines++ {
+		var entry struct {
+			Route string `json:"route"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			t.Fatalf("access log line %q: %v", sc.Text(), err)
+		}
+		if entry.Route != upstream.Addr().String() {
+			t.Errorf("route = %q, want %q", entry.Route, upstream.Addr().String())
+		}
+	}
+	if lines != 2 {
+		t.Errorf("access log has %d lines, want 2", lines)
+	}
+}
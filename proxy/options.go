@@ -1,11 +1,13 @@
 package proxy
 
 import (
-	"github.com/justenwalker/squiggly/auth"
+	"crypto/tls"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 
+	"github.com/justenwalker/squiggly/auth"
 	"github.com/justenwalker/squiggly/logging"
 )
 
@@ -20,6 +22,15 @@ func Proxy(proxy func(req *http.Request) (*url.URL, error)) Option {
 	}
 }
 
+// Proxies is an option that controls which upstream proxies are used for each request, in order of preference.
+// A nil URL in the list indicates a direct connection. Later proxies are only tried when the Fallback policy
+// of the error returned by an earlier proxy is FallbackNext.
+func Proxies(proxies func(req *http.Request) ([]*url.URL, error)) Option {
+	return func(s *Server) {
+		s.proxiesFunc = proxies
+	}
+}
+
 // ProxyAuth is an option that sets the proxy basic authorization credentials
 func ProxyAuth(auth *auth.Auth) Option {
 	return func(s *Server) {
@@ -27,14 +38,58 @@ func ProxyAuth(auth *auth.Auth) Option {
 	}
 }
 
-// Log sets the logger on the server for debug purposes
-func Log(logger logging.Logger) Option {
+// Log sets the logger on the server.
+// The goproxy library logs its warnings at the warn level, and everything else at the trace level.
+func Log(logger *logging.EventLogger) Option {
 	return func(s *Server) {
 		s.logger = logger
-		s.server.Verbose = (logger != nil)
-		if logger != nil {
-			s.logWriter = logging.NewLogWriter(s.logger)
-			s.server.Logger = log.New(s.logWriter, "goproxy: ", 0)
+		if logger == nil {
+			return
+		}
+		level := logging.LevelWarn
+		s.server.Verbose = logger.Enabled(logging.LevelTrace)
+		if s.server.Verbose {
+			level = logging.LevelTrace
 		}
+		s.logWriter = logging.NewLogWriter(logger.With(logging.F("component", "goproxy")).At(level))
+		s.server.Logger = log.New(s.logWriter, "", 0)
+	}
+}
+
+// AllowClients restricts the proxy to clients whose address is in one of the networks.
+// An empty list allows every client not explicitly denied.
+func AllowClients(nets []*net.IPNet) Option {
+	return func(s *Server) {
+		s.allowClients = nets
+	}
+}
+
+// DenyClients refuses clients whose address is in one of the networks, even if they are allowed by AllowClients
+func DenyClients(nets []*net.IPNet) Option {
+	return func(s *Server) {
+		s.denyClients = nets
+	}
+}
+
+// ClientAuth requires clients to authenticate to the proxy with Basic credentials checked by the verifier
+func ClientAuth(verifier ClientVerifier) Option {
+	return func(s *Server) {
+		s.clientAuth = verifier
+	}
+}
+
+// ReturnRequestID adds the request ID to responses in the X-Squiggly-Request-Id header,
+// so that clients can quote it when reporting a problem
+func ReturnRequestID(enabled bool) Option {
+	return func(s *Server) {
+		s.requestIDHeader = enabled
+	}
+}
+
+// UpstreamTLS sets the TLS configuration used to connect to https upstream proxies,
+// such as the trusted CAs, server name and client certificate
+func UpstreamTLS(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.upstreamTLS = cfg
 	}
 }
@@ -2,31 +2,106 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/justenwalker/squiggly/auth"
 
 	"github.com/justenwalker/squiggly/logging"
+	"github.com/justenwalker/squiggly/mitm"
 	"gopkg.in/elazarl/goproxy.v1"
 )
 
 // Server is a proxy server
 type Server struct {
-	logger    logging.Logger
+	logger    *logging.EventLogger
 	logWriter *logging.LogWriter
-	proxyFunc func(req *http.Request) (*url.URL, error)
-	proxyAuth *auth.Auth
 	server    *goproxy.ProxyHttpServer
 	dialer    *net.Dialer
+	health    *upstreamHealth
+	// replaces is the server this one replaces, while the options are applied
+	replaces *Server
+	// active counts the requests and connections in progress, including intercepted tunnels
+	active inflight
+
+	accessLog       *logging.AccessLog
+	requestIDHeader bool
+
+	upstreamTLS *tls.Config
+	race        *racer
+	fallback    FallbackPolicy
+
+	timeouts     Timeouts
+	hostTimeouts []hostTimeouts
+	shaper       *shaper
+	cache        *ResponseCache
+	headerRules  []HeaderRule
+	blocklist    *Blocklist
+	blockPage    *BlockPage
+
+	// mu guards the settings that may be changed while the server is running
+	mu          sync.RWMutex
+	proxyFunc   func(req *http.Request) (*url.URL, error)
+	proxiesFunc func(req *http.Request) ([]*url.URL, error)
+	proxyAuth   *auth.Auth
+
+	allowClients []*net.IPNet
+	denyClients  []*net.IPNet
+	clientAuth   ClientVerifier
+
+	issuer    *mitm.Issuer
+	intercept HostPatterns
 }
 
 func (s *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	s.server.ServeHTTP(resp, req)
+	if !s.active.acquire() {
+		http.Error(resp, "proxy server has been replaced", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.active.release()
+	s.serveHTTP(resp, req)
+}
+
+func (s *Server) serveHTTP(resp http.ResponseWriter, req *http.Request) {
+	req = withRequestID(req)
+	if s.requestIDHeader {
+		resp.Header().Set(RequestIDHeader, logging.RequestID(req.Context()))
+	}
+	req, rec := withAccessRecord(req)
+	rec.flow = s.shaper.flow(req.Context(), req.RemoteAddr, requestHost(req))
+	if status := s.checkAccess(resp, req, rec); status != http.StatusOK {
+		rec.setStatus(status)
+		s.logAccess(rec)
+		return
+	}
+	if req.Method == http.MethodConnect {
+		// Tunnels are handled here, unless they are intercepted.
+		// The requests decrypted from intercepted tunnels are logged individually.
+		if s.intercepts(req.Host) {
+			// Blocked hosts are refused before the tunnel is decrypted
+			if err := s.checkBlocked(req.Context(), req.Host, "tunnel"); err != nil {
+				rec.setStatus(writeDialError(resp, req, err))
+				s.logAccess(rec)
+				return
+			}
+			// goproxy serves the decrypted requests after returning, until it closes the client connection
+			s.server.ServeHTTP(&trackingHijacker{ResponseWriter: resp, active: &s.active}, req)
+			return
+		}
+		s.serveConnect(resp, req, rec)
+		s.logAccess(rec)
+		return
+	}
+	s.server.ServeHTTP(&accessWriter{ResponseWriter: resp, rec: rec}, req)
+	s.logAccess(rec)
 }
 
 // Close the server down and flush logs
@@ -37,38 +112,130 @@ func (s *Server) Close() error {
 	return nil
 }
 
-func (s *Server) logf(msg string, v ...interface{}) {
-	if s.logger != nil {
-		s.logger.Log(fmt.Sprintf(msg, v...))
+func (s *Server) onRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	rec := accessRecordFrom(req.Context())
+	if rec == nil {
+		// Requests decrypted from an intercepted tunnel do not pass through ServeHTTP
+		req, rec = withAccessRecord(withRequestID(req))
+		rec.decrypted = true
+		rec.flow = s.shaper.flow(req.Context(), req.RemoteAddr, req.URL.Host)
+		ctx.Req = req
 	}
-}
-
-func (s *Server) log(v ...interface{}) {
-	if s.logger != nil {
-		s.logger.Log(fmt.Sprint(v...))
+	ctx.UserData = rec
+	if err := s.checkBlocked(req.Context(), req.URL.Host, "request"); err != nil {
+		return req, s.blockPage.response(req, err)
+	}
+	s.logger.Ctx(req.Context()).Debug("request",
+		logging.F(logging.KeyClient, req.RemoteAddr),
+		logging.F("method", req.Method),
+		logging.F(logging.KeyTarget, req.URL),
+	)
+	if req.Body != nil {
+		req.Body = &countingBody{ReadCloser: req.Body, n: &rec.bytesIn, flow: rec.flow, dir: directionIn}
 	}
+	// Proxy headers only apply to the hop from the client
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	applyHeaderRules(req.Context(), s.headerRules, HeaderRequest, req.Header, req.URL.Host, req.RemoteAddr)
+	// The route is known once the transport has a connection, dialed or reused, so no PAC is evaluated here
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if route, ok := connRoute(info.Conn); ok {
+				rec.setRoute(route)
+			}
+		},
+	}))
+	ctx.Req = req
+	var tr http.RoundTripper = s.server.Tr
+	if h := s.hostOverride(req.URL.Host); h != nil {
+		tr = h.transport
+	}
+	cache := s.cache
+	if rec.decrypted {
+		cache = nil
+	}
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		defer func() { requestsTotal.With(rec.route()).Inc() }()
+		if cache != nil {
+			return cache.roundTrip(req, tr, s.logger.Ctx(req.Context()))
+		}
+		return tr.RoundTrip(req)
+	})
+	return req, nil
 }
 
-func (s *Server) onRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-	s.logf("onRequest: %s", req.URL)
-	return req, nil
+// requestHost returns the destination host of a proxied request
+func requestHost(req *http.Request) string {
+	if req.Method == http.MethodConnect || req.URL.Host == "" {
+		return req.Host
+	}
+	return req.URL.Host
 }
 
 func (s *Server) onResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	logger := s.logger.Ctx(ctx.Req.Context())
+	if resp == nil && ctx.Error != nil {
+		logger.Warn("request failed",
+			logging.F(logging.KeyClient, ctx.Req.RemoteAddr),
+			logging.F(logging.KeyTarget, ctx.Req.URL),
+			logging.Err(ctx.Error),
+		)
+		// goproxy passes the error response through the response handlers again
+		return dialErrorResponse(ctx.Req, ctx.Error)
+	}
+	if resp != nil && s.requestIDHeader {
+		resp.Header.Set(RequestIDHeader, logging.RequestID(ctx.Req.Context()))
+	}
 	if resp != nil {
-		s.logf("onResponse: %s", resp.Status)
+		applyHeaderRules(ctx.Req.Context(), s.headerRules, HeaderResponse, resp.Header, ctx.Req.URL.Host, ctx.Req.RemoteAddr)
+		logger.Debug("response",
+			logging.F(logging.KeyClient, ctx.Req.RemoteAddr),
+			logging.F(logging.KeyTarget, ctx.Req.URL),
+			logging.F(logging.KeyStatus, resp.StatusCode),
+		)
+	}
+	// Decrypted requests are logged once the response body has been copied to the client.
+	// goproxy sends them chunked, so wrapping the body does not change the response.
+	rec, ok := ctx.UserData.(*accessRecord)
+	if !ok || !rec.decrypted || resp == nil {
+		return resp
 	}
-	if ctx.Error != nil {
-		s.logf("onResponse: ERROR:%#v", ctx.Error)
+	rec.setStatus(resp.StatusCode)
+	resp.Body = &countingBody{
+		ReadCloser: resp.Body,
+		n:          &rec.bytesOut,
+		done:       func() { s.logAccess(rec) },
+		flow:       rec.flow,
+		dir:        directionOut,
 	}
 	return resp
 }
 
+// SetProxy changes the function that selects the upstream proxy for new connections.
+// Existing connections are not affected.
+func (s *Server) SetProxy(proxy func(req *http.Request) (*url.URL, error)) {
+	s.mu.Lock()
+	s.proxyFunc = proxy
+	s.proxiesFunc = nil
+	s.mu.Unlock()
+}
+
+// SetProxyAuth changes the upstream proxy credentials used by new connections.
+// Existing connections are not affected.
+func (s *Server) SetProxyAuth(auth *auth.Auth) {
+	s.mu.Lock()
+	s.proxyAuth = auth
+	s.mu.Unlock()
+}
+
+func (s *Server) getProxyAuth() *auth.Auth {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.proxyAuth
+}
+
 func (s *Server) proxyHost(host string) (string, error) {
-	if s.proxyFunc == nil {
-		return host, nil
-	}
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/", host), nil)
+	req, err := http.NewRequest(http.MethodGet, targetURL(host), nil)
 	if err != nil {
 		return "", fmt.Errorf("host '%s' parse error : %v", host, err)
 	}
@@ -83,83 +250,273 @@ func (s *Server) proxyHost(host string) (string, error) {
 	return host, nil
 }
 
-func (s *Server) getProxyHost(host string) (*url.URL, error) {
-	if s.proxyFunc == nil {
-		return nil, nil
-	}
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/", host), nil)
+// getProxies returns the upstream proxies for a host:port dial address, in order of preference
+func (s *Server) getProxies(ctx context.Context, host string) ([]*url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL(host), nil)
 	if err != nil {
 		return nil, fmt.Errorf("host '%s' parse error : %v", host, err)
 	}
-	return s.proxy(req)
+	return s.proxies(req)
+}
+
+// targetURL returns the url used to select the proxy for a host:port dial address
+func targetURL(hostport string) string {
+	u := &url.URL{Scheme: "http", Host: hostport, Path: "/"}
+	return u.String()
 }
 
+// proxy returns the preferred upstream proxy for the request, or nil for a direct connection
 func (s *Server) proxy(req *http.Request) (*url.URL, error) {
-	if s.proxyFunc == nil {
+	proxies, err := s.proxies(req)
+	if err != nil || len(proxies) == 0 {
+		return nil, err
+	}
+	return proxies[0], nil
+}
+
+// proxies returns the upstream proxies for the request in order of preference.
+// A nil URL is a direct connection.
+func (s *Server) proxies(req *http.Request) ([]*url.URL, error) {
+	s.mu.RLock()
+	proxyFunc, proxiesFunc := s.proxyFunc, s.proxiesFunc
+	s.mu.RUnlock()
+	var proxies []*url.URL
+	switch {
+	case proxiesFunc != nil:
+		list, err := proxiesFunc(req)
+		if err != nil {
+			return nil, err
+		}
+		proxies = list
+	case proxyFunc != nil:
+		u, err := proxyFunc(req)
+		if err != nil {
+			return nil, err
+		}
+		proxies = []*url.URL{u}
+	default:
 		return nil, nil
 	}
-	u, err := s.proxyFunc(req)
-	if err == nil {
-		s.logf("PROXY SELECT: %v", u)
+	routes := make([]string, len(proxies))
+	for i, u := range proxies {
+		routes[i] = routeDirect
+		if u != nil {
+			routes[i] = u.Host
+		}
 	}
-	return u, err
+	s.logger.Ctx(req.Context()).Debug("proxy selected",
+		logging.F(logging.KeyTarget, req.URL.Host),
+		logging.F(logging.KeyRoute, strings.Join(routes, ";")),
+	)
+	return proxies, nil
 }
 
 // New creates a new proxy Server with the given options configured
 func New(opts ...Option) *Server {
 	srv := &Server{
-		server: goproxy.NewProxyHttpServer(),
+		server:   goproxy.NewProxyHttpServer(),
+		health:   &upstreamHealth{},
+		fallback: DefaultFallbackPolicy(),
+		timeouts: DefaultTimeouts(),
+		shaper:   newShaper(),
+		// The dial timeout of each destination is set on the context
 		dialer: &net.Dialer{
-			Timeout:   30 * time.Second,
 			KeepAlive: 30 * time.Second,
 		},
 	}
-	srv.server.Tr = &http.Transport{
-		DialContext:           srv.dialContext,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ResponseHeaderTimeout: 10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
 	srv.server.ConnectDial = srv.dial
 	for _, opt := range opts {
 		opt(srv)
 	}
-	// srv.server.OnRequest().HandleConnectFunc(srv.onConnect)
+	srv.inherit()
+	srv.initTimeouts()
+	srv.server.OnRequest().HandleConnectFunc(srv.onConnect)
 	srv.server.OnRequest().DoFunc(srv.onRequest)
 	srv.server.OnResponse().DoFunc(srv.onResponse)
 	return srv
 }
 
 func (s *Server) dial(network, addr string) (net.Conn, error) {
-	return s.dialContext(context.Background(), network, addr)
+	return s.dialTunnel(context.Background(), network, addr)
+}
+
+// dialTunnel dials the target of a CONNECT, SOCKS or transparent tunnel and tracks it in the metrics
+func (s *Server) dialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := s.checkBlocked(ctx, addr, "tunnel"); err != nil {
+		return nil, err
+	}
+	conn, route, err := s.dialRoute(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tunnelsTotal.With(route).Inc()
+	return newTrackedConn(conn), nil
 }
 
+// dialContext dials the connections of the transports, which remember their route for the requests reusing them
 func (s *Server) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	purl, err := s.getProxyHost(addr)
+	conn, route, err := s.dialRoute(ctx, network, addr)
 	if err != nil {
-		s.logf("dialer: getProxyHost ERROR: '%s'", err)
 		return nil, err
 	}
+	return &routeConn{Conn: conn, route: route}, nil
+}
+
+// routeConn is a connection dialed for plain or decrypted requests, and the route it was dialed through
+type routeConn struct {
+	net.Conn
+	route string
+}
+
+// connRoute returns the route of a connection returned by dialContext,
+// which the transport may have wrapped in a TLS connection
+func connRoute(conn net.Conn) (string, bool) {
+	if tc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tc.NetConn()
+	}
+	rc, ok := conn.(*routeConn)
+	if !ok {
+		return "", false
+	}
+	return rc.route, true
+}
+
+// dialRoute dials the address directly or through the upstream proxy chosen for it,
+// and returns the route taken: DIRECT or the upstream proxy host.
+func (s *Server) dialRoute(ctx context.Context, network, addr string) (net.Conn, string, error) {
+	logger := s.logger.Ctx(ctx)
+	proxies, err := s.getProxies(ctx, addr)
+	if err != nil {
+		logger.Error("proxy selection failed", logging.F(logging.KeyTarget, addr), logging.Err(err))
+		return nil, "", err
+	}
+	if len(proxies) == 0 {
+		proxies = []*url.URL{nil}
+	}
+	if purl := proxies[0]; s.race != nil && purl != nil && host(purl) != addr {
+		return s.dialRace(ctx, logger, network, addr, proxies)
+	}
+	return s.dialProxies(ctx, logger, network, addr, proxies)
+}
+
+// dialProxies dials the address through the first of the proxies, or directly if it is nil,
+// and follows the fallback policy if the proxy fails
+func (s *Server) dialProxies(ctx context.Context, logger *logging.EventLogger, network, addr string, proxies []*url.URL) (net.Conn, string, error) {
+	if len(proxies) == 0 {
+		return nil, "", fmt.Errorf("no route to '%s'", addr)
+	}
+	purl := proxies[0]
 	// Prevent upstream proxy from being re-directed
-	if purl == nil || purl.Host == addr {
-		s.logf("dialer: DIRECT -> ADDR '%s'", addr)
-		return s.dialer.DialContext(ctx, network, addr)
+	if purl == nil || host(purl) == addr {
+		return s.dialRouteDirect(ctx, logger, network, addr)
+	}
+	conn, err := s.dialUpstream(ctx, logger, network, addr, purl)
+	if err == nil {
+		accessRecordFrom(ctx).setRoute(purl.Host)
+		return conn, purl.Host, nil
+	}
+	if ctx.Err() != nil {
+		return nil, "", err
+	}
+	return s.fallbackAfter(ctx, logger, network, addr, purl, proxies[1:], err)
+}
+
+// fallbackAfter handles the failure of an upstream proxy according to the fallback policy:
+// it dials directly, tries the rest of the proxies, or returns the error
+func (s *Server) fallbackAfter(ctx context.Context, logger *logging.EventLogger, network, addr string, purl *url.URL, rest []*url.URL, err error) (net.Conn, string, error) {
+	fields := []logging.Field{
+		logging.F(logging.KeyUpstream, purl.Host),
+		logging.F(logging.KeyTarget, addr),
+		logging.F("reason", errorClass(err)),
+		logging.Err(err),
+	}
+	switch s.fallback.action(err) {
+	case FallbackDirect:
+		logger.Warn("upstream failed, dialing direct", fields...)
+		directFallbacks.With(purl.Host).Inc()
+		return s.dialRouteDirect(ctx, logger, network, addr)
+	case FallbackNext:
+		if len(rest) > 0 {
+			logger.Warn("upstream failed, trying the next proxy", fields...)
+			return s.dialProxies(ctx, logger, network, addr, rest)
+		}
 	}
-	s.logf("dialer: PROXY '%s' -> ADDR '%s'", purl.Host, addr)
+	accessRecordFrom(ctx).setRoute(purl.Host)
+	return nil, "", err
+}
+
+// dialRouteDirect connects directly to the address and records the route
+func (s *Server) dialRouteDirect(ctx context.Context, logger *logging.EventLogger, network, addr string) (net.Conn, string, error) {
+	conn, err := s.dialDirect(ctx, logger, network, addr)
+	accessRecordFrom(ctx).setRoute(routeDirect)
+	return conn, routeDirect, err
+}
+
+// dialDirect connects directly to the address
+func (s *Server) dialDirect(ctx context.Context, logger *logging.EventLogger, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := s.dialTCP(ctx, network, addr, s.timeoutsFor(addr).Dial)
+	s.logDial(logger, routeDirect, addr, start, err)
+	return conn, err
+}
+
+// dialTCP opens a TCP connection, giving up after the timeout
+func (s *Server) dialTCP(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	return s.dialer.DialContext(ctx, network, addr)
+}
+
+// dialUpstream connects to the address through the upstream proxy, and records the health of the proxy
+func (s *Server) dialUpstream(ctx context.Context, logger *logging.EventLogger, network, addr string, purl *url.URL) (net.Conn, error) {
+	start := time.Now()
+	accessRecordFrom(ctx).addUpstream(purl.Host)
+	t := s.timeoutsFor(addr)
 	dialer := &ProxyDialer{
-		Logger: s.logger,
-		Host:   purl,
-		Auth:   s.proxyAuth,
-		Dialer: s.dialer.DialContext,
+		Logger:    s.logger,
+		Host:      purl,
+		Auth:      s.getProxyAuth(),
+		TLSConfig: s.upstreamTLS,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.dialTCP(ctx, network, addr, t.Dial)
+		},
+		HandshakeTimeout: t.Handshake,
+		AuthTimeout:      t.Auth,
+		HeaderRules:      s.headerRules,
 	}
 	conn, err := dialer.DialContext(ctx, network, addr)
+	s.logDial(logger, purl.Host, addr, start, err)
 	if err != nil {
-		var operr *net.OpError
-		if errors.As(err, &operr) {
-			s.logf("dialer: tcp connection to '%s' failed with '%v'. Dialing DIRECT", purl.Host, operr)
-			return s.dialer.DialContext(ctx, network, addr)
+		// A dial cancelled by the caller says nothing about the health of the proxy
+		if ctx.Err() == nil {
+			s.health.failure(purl.Host, err)
 		}
 		return nil, err
 	}
+	s.health.success(purl.Host)
 	return conn, nil
 }
+
+// logDial records the outcome of a dial in the log and metrics
+func (s *Server) logDial(logger *logging.EventLogger, route string, addr string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	if errors.Is(err, context.Canceled) {
+		logger.Debug("dial cancelled", logging.F(logging.KeyRoute, route), logging.F(logging.KeyTarget, addr))
+		return
+	}
+	if err != nil {
+		logger.Warn("dial failed",
+			logging.F(logging.KeyRoute, route),
+			logging.F(logging.KeyTarget, addr),
+			logging.F(logging.KeyDuration, elapsed),
+			logging.Err(err),
+		)
+		return
+	}
+	dialDuration.With(route).Observe(elapsed.Seconds())
+	logger.Debug("dial",
+		logging.F(logging.KeyRoute, route),
+		logging.F(logging.KeyTarget, addr),
+		logging.F(logging.KeyDuration, elapsed),
+	)
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// racer races the upstream proxy against a direct connection, and remembers the winner for each address
+type racer struct {
+	delay    time.Duration
+	remember time.Duration
+
+	mu      sync.Mutex
+	winners map[string]raceWinner
+}
+
+type raceWinner struct {
+	route   string
+	expires time.Time
+}
+
+type raceResult struct {
+	conn  net.Conn
+	route string
+	err   error
+}
+
+func (r *racer) winner(addr string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.winners[addr]
+	if !ok {
+		return ""
+	}
+	if time.Now().After(w.expires) {
+		delete(r.winners, addr)
+		return ""
+	}
+	return w.route
+}
+
+func (r *racer) setWinner(addr, route string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.remember <= 0 {
+		return
+	}
+	r.winners[addr] = raceWinner{route: route, expires: time.Now().Add(r.remember)}
+}
+
+func (r *racer) forget(addr string) {
+	r.mu.Lock()
+	delete(r.winners, addr)
+	r.mu.Unlock()
+}
+
+// dialRace connects through the first upstream proxy and, after the race delay, directly.
+// The first connection established is used and the other attempt is cancelled.
+// If the proxy fails, the fallback policy decides whether the direct dial starts at once, the rest of the proxies
+// are tried instead, or the error is returned. If a previous race to the address has been won recently,
+// only the winning route is tried.
+func (s *Server) dialRace(ctx context.Context, logger *logging.EventLogger, network, addr string, proxies []*url.URL) (net.Conn, string, error) {
+	purl := proxies[0]
+	switch s.race.winner(addr) {
+	case routeDirect:
+		if conn, err := s.dialDirect(ctx, logger, network, addr); err == nil {
+			accessRecordFrom(ctx).setRoute(routeDirect)
+			return conn, routeDirect, nil
+		}
+		s.race.forget(addr)
+	case purl.Host:
+		conn, err := s.dialUpstream(ctx, logger, network, addr, purl)
+		if err == nil {
+			accessRecordFrom(ctx).setRoute(purl.Host)
+			return conn, purl.Host, nil
+		}
+		s.race.forget(addr)
+		if ctx.Err() != nil {
+			return nil, "", err
+		}
+		return s.fallbackAfter(ctx, logger, network, addr, purl, proxies[1:], err)
+	}
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan raceResult, 2)
+	go func() {
+		conn, err := s.dialUpstream(raceCtx, logger, network, addr, purl)
+		results <- raceResult{conn: conn, route: purl.Host, err: err}
+	}()
+	pending := 1
+	startDirect := func() {
+		pending++
+		go func() {
+			conn, err := s.dialDirect(raceCtx, logger, network, addr)
+			results <- raceResult{conn: conn, route: routeDirect, err: err}
+		}()
+	}
+	// stop cancels the attempts still pending, closing any that connect before they see the cancellation
+	stop := func() {
+		cancel()
+		go func(n int) {
+			for ; n > 0; n-- {
+				if lost := <-results; lost.conn != nil {
+					lost.conn.Close()
+				}
+			}
+		}(pending)
+	}
+	timer := time.NewTimer(s.race.delay)
+	defer timer.Stop()
+	stagger := timer.C
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-stagger:
+			stagger = nil
+			startDirect()
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				if r.route == routeDirect || ctx.Err() != nil {
+					continue
+				}
+				// A proxy that refused the connection or the credentials must not be bypassed by the direct dial
+				if s.fallback.action(r.err) != FallbackDirect {
+					stop()
+					return s.fallbackAfter(ctx, logger, network, addr, purl, proxies[1:], r.err)
+				}
+				// Do not wait out the delay once the proxy has failed
+				if stagger != nil {
+					stagger = nil
+					startDirect()
+				}
+				continue
+			}
+			stop()
+			logger.Debug("race won", logging.F(logging.KeyTarget, addr), logging.F(logging.KeyRoute, r.route))
+			raceWins.With(r.route).Inc()
+			s.race.setWinner(addr, r.route)
+			accessRecordFrom(ctx).setRoute(r.route)
+			return r.conn, r.route, nil
+		}
+	}
+	return nil, "", firstErr
+}
+
+// Race dials directly in parallel with the upstream proxy, similar to Happy Eyeballs.
+// The direct dial starts after delay, or as soon as the proxy fails with an error the fallback policy
+// connects directly for; other errors are handled by the policy as without racing. The route that connects first
+// is remembered for each address for the remember duration, and used without racing until it fails.
+func Race(delay, remember time.Duration) Option {
+	return func(s *Server) {
+		s.race = &racer{
+			delay:    delay,
+			remember: remember,
+			winners:  make(map[string]raceWinner),
+		}
+	}
+}
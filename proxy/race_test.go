@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listenLoopback listens on the IPv4 loopback
+func listenLoopback(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// serveBlackhole accepts connections in the background and never answers them.
+// The connections are closed when the test ends.
+func serveBlackhole(t *testing.T, l net.Listener) {
+	var (
+		mu     sync.Mutex
+		conns  []net.Conn
+		closed bool
+	)
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			if closed {
+				conn.Close()
+			}
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+}
+
+func TestDialRace(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+	addr := echo.Addr().String()
+
+	t.Run("direct wins when the proxy does not answer", func(t *testing.T) {
+		upstream := listenLoopback(t)
+		serveBlackhole(t, upstream)
+		purl := &url.URL{Scheme: "http", Host: upstream.Addr().String()}
+		s := New(
+			Proxy(func(req *http.Request) (*url.URL, error) { return purl, nil }),
+			Race(50*time.Millisecond, time.Minute),
+		)
+		start := time.Now()
+		conn, route, err := s.dialRoute(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("dialRoute: %v", err)
+		}
+		if route != routeDirect {
+			t.Errorf("route = %q, want %q", route, routeDirect)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("race took %v", elapsed)
+		}
+		assertEcho(t, conn)
+		if w := s.race.winner(addr); w != routeDirect {
+			t.Errorf("remembered winner = %q, want %q", w, routeDirect)
+		}
+	})
+	t.Run("proxy wins when it answers within the delay", func(t *testing.T) {
+		upstream := listenLoopback(t)
+		targets := make(chan string, 1)
+		go serveConnectProxy(upstream, targets)
+		purl := &url.URL{Scheme: "http", Host: upstream.Addr().String()}
+		s := New(
+			Proxy(func(req *http.Request) (*url.URL, error) { return purl, nil }),
+			Race(5*time.Second, time.Minute),
+		)
+		conn, route, err := s.dialRoute(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("dialRoute: %v", err)
+		}
+		if route != purl.Host {
+			t.Errorf("route = %q, want %q", route, purl.Host)
+		}
+		<-targets
+		assertEcho(t, conn)
+	})
+	t.Run("direct starts as soon as the proxy fails", func(t *testing.T) {
+		closed := listenLoopback(t)
+		purl := &url.URL{Scheme: "http", Host: closed.Addr().String()}
+		closed.Close()
+		s := New(
+			Proxy(func(req *http.Request) (*url.URL, error) { return purl, nil }),
+			Race(time.Minute, time.Minute),
+		)
+		start := time.Now()
+		conn, route, err := s.dialRoute(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("dialRoute: %v", err)
+		}
+		if route != routeDirect {
+			t.Errorf("route = %q, want %q", route, routeDirect)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("race took %v", elapsed)
+		}
+		assertEcho(t, conn)
+	})
+}
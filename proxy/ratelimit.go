@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit is a token bucket limit on the bytes sent in both directions
+type RateLimit struct {
+	// Rate in bytes per second
+	Rate int64
+	// Burst is the number of bytes that may be sent at once after a quiet period. Zero means one second of Rate.
+	Burst int64
+}
+
+// ParseRateLimit parses a rate limit in bytes per second, with an optional burst: RATE[:BURST].
+// Sizes may have a k, M or G suffix, which are powers of 1024, e.g. "10M" or "512k:4M"
+func ParseRateLimit(s string) (RateLimit, error) {
+	var l RateLimit
+	parts := strings.SplitN(s, ":", 2)
+	rate, err := ParseSize(parts[0])
+	if err != nil {
+		return l, fmt.Errorf("invalid rate limit '%s': %w", s, err)
+	}
+	l.Rate = rate
+	if len(parts) == 2 {
+		if l.Burst, err = ParseSize(parts[1]); err != nil {
+			return l, fmt.Errorf("invalid rate limit burst '%s': %w", s, err)
+		}
+	}
+	if l.Rate <= 0 {
+		return l, fmt.Errorf("invalid rate limit '%s': rate must be positive", s)
+	}
+	return l, nil
+}
+
+// ParseHostRateLimit parses the rate limit of destinations matching a host pattern: PATTERN=RATE[:BURST]
+func ParseHostRateLimit(s string) (HostPatterns, RateLimit, error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return nil, RateLimit{}, fmt.Errorf("invalid host rate limit '%s', expected PATTERN=RATE[:BURST]", s)
+	}
+	l, err := ParseRateLimit(s[i+1:])
+	if err != nil {
+		return nil, l, err
+	}
+	return HostPatterns{s[:i]}, l, nil
+}
+
+// ParseSize parses a number of bytes, with an optional k, M or G suffix, which are powers of 1024, e.g. "512k" or "1.5G"
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	lower := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(s), "ib"), "b")
+	switch {
+	case strings.HasSuffix(lower, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(lower, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(lower, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		lower = lower[:len(lower)-1]
+	}
+	n, err := strconv.ParseFloat(lower, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// bucket is a token bucket of bytes. Taking more tokens than are available puts it in debt,
+// which the taker pays off by waiting.
+type bucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(l RateLimit) *bucket {
+	if l.Rate <= 0 {
+		return nil
+	}
+	burst := l.Burst
+	if burst <= 0 {
+		burst = l.Rate
+	}
+	return &bucket{rate: float64(l.Rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take removes n tokens, and returns how long to wait until the bucket is out of debt
+func (b *bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// meterWindow is the number of seconds throughput is averaged over
+const meterWindow = 5
+
+// meter measures throughput over the last few seconds
+type meter struct {
+	mu    sync.Mutex
+	secs  [meterWindow + 1]int64
+	bytes [meterWindow + 1]int64
+}
+
+func (m *meter) add(n int) {
+	sec := time.Now().Unix()
+	i := sec % int64(len(m.secs))
+	m.mu.Lock()
+	if m.secs[i] != sec {
+		m.secs[i], m.bytes[i] = sec, 0
+	}
+	m.bytes[i] += int64(n)
+	m.mu.Unlock()
+}
+
+// rate returns the bytes per second over the last complete seconds
+func (m *meter) rate() float64 {
+	now := time.Now().Unix()
+	var total int64
+	m.mu.Lock()
+	for i, sec := range m.secs {
+		if sec < now && sec >= now-meterWindow {
+			total += m.bytes[i]
+		}
+	}
+	m.mu.Unlock()
+	return float64(total) / meterWindow
+}
+
+// Throughput is the data rate in bytes per second, averaged over the last few seconds
+type Throughput struct {
+	// In is sent by clients
+	In float64 `json:"in"`
+	// Out is sent to clients
+	Out float64 `json:"out"`
+}
+
+// ThroughputStatus is the current throughput of the proxy
+type ThroughputStatus struct {
+	Global Throughput `json:"global"`
+	// Clients is the throughput of each client IP with recent traffic
+	Clients map[string]Throughput `json:"clients,omitempty"`
+	// Hosts is the throughput of each host rate limit, by pattern
+	Hosts map[string]Throughput `json:"hosts,omitempty"`
+}
+
+// traffic limits and measures the traffic shared by a set of flows
+type traffic struct {
+	lastUsed int64
+	name     string
+	bucket   *bucket
+	in, out  meter
+}
+
+func newTraffic(name string, l RateLimit) *traffic {
+	return &traffic{name: name, bucket: newBucket(l), lastUsed: time.Now().UnixNano()}
+}
+
+func (t *traffic) throughput() Throughput {
+	return Throughput{In: t.in.rate(), Out: t.out.rate()}
+}
+
+// clientIdle is how long a client without traffic is remembered
+const clientIdle = 5 * time.Minute
+
+// shaper assigns the traffic of each request and tunnel to the global, client and host limits
+type shaper struct {
+	global *traffic
+	client RateLimit
+	hosts  []hostLimit
+
+	mu        sync.Mutex
+	clients   map[string]*traffic
+	lastSweep time.Time
+}
+
+type hostLimit struct {
+	hosts   HostPatterns
+	traffic *traffic
+}
+
+func newShaper() *shaper {
+	return &shaper{
+		global:    newTraffic("global", RateLimit{}),
+		clients:   make(map[string]*traffic),
+		lastSweep: time.Now(),
+	}
+}
+
+// flow returns the flow of a request or tunnel from the client address to the destination host
+func (s *shaper) flow(ctx context.Context, client, host string) *flow {
+	f := &flow{ctx: ctx, traffic: []*traffic{s.global, s.clientTraffic(hostname(client))}}
+	for _, h := range s.hosts {
+		if h.hosts.Match(host) {
+			f.traffic = append(f.traffic, h.traffic)
+			break
+		}
+	}
+	return f
+}
+
+func (s *shaper) clientTraffic(ip string) *traffic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		s.lastSweep = now
+		for k, t := range s.clients {
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&t.lastUsed))) > clientIdle {
+				delete(s.clients, k)
+			}
+		}
+	}
+	t, ok := s.clients[ip]
+	if !ok {
+		t = newTraffic("client", s.client)
+		s.clients[ip] = t
+	}
+	return t
+}
+
+func (s *shaper) throughput() ThroughputStatus {
+	st := ThroughputStatus{Global: s.global.throughput()}
+	s.mu.Lock()
+	for ip, t := range s.clients {
+		tp := t.throughput()
+		if tp.In == 0 && tp.Out == 0 {
+			continue
+		}
+		if st.Clients == nil {
+			st.Clients = make(map[string]Throughput)
+		}
+		st.Clients[ip] = tp
+	}
+	s.mu.Unlock()
+	for _, h := range s.hosts {
+		if st.Hosts == nil {
+			st.Hosts = make(map[string]Throughput)
+		}
+		st.Hosts[h.traffic.name] = h.traffic.throughput()
+	}
+	return st
+}
+
+// direction of the traffic of a flow
+type direction int
+
+const (
+	// directionIn is sent by the client
+	directionIn direction = iota
+	// directionOut is sent to the client
+	directionOut
+)
+
+// flow is the traffic of a single request or tunnel
+type flow struct {
+	ctx     context.Context
+	traffic []*traffic
+}
+
+// transfer records n bytes sent in the direction, and waits until every limit of the flow allows them
+func (f *flow) transfer(n int, dir direction) {
+	if f == nil || n <= 0 {
+		return
+	}
+	if dir == directionIn {
+		transferredIn.Add(float64(n))
+	} else {
+		transferredOut.Add(float64(n))
+	}
+	now := time.Now().UnixNano()
+	var wait time.Duration
+	var limitedBy string
+	for _, t := range f.traffic {
+		atomic.StoreInt64(&t.lastUsed, now)
+		if dir == directionIn {
+			t.in.add(n)
+		} else {
+			t.out.add(n)
+		}
+		if t.bucket == nil {
+			continue
+		}
+		if d := t.bucket.take(n); d > wait {
+			wait, limitedBy = d, t.name
+		}
+	}
+	if wait <= 0 {
+		return
+	}
+	rateLimitWait.With(limitedBy).Add(wait.Seconds())
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-f.ctx.Done():
+	}
+}
+
+// limitedConn limits and measures the traffic of a tunnel to its target
+type limitedConn struct {
+	net.Conn
+	flow *flow
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.flow.transfer(n, directionOut)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.flow.transfer(n, directionIn)
+	return n, err
+}
+
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// limitTunnel returns the target connection of a tunnel, limited by the rate limits of its flow
+func limitTunnel(target net.Conn, rec *accessRecord) net.Conn {
+	return &limitedConn{Conn: target, flow: rec.flow}
+}
+
+// Throughput returns the current throughput of the proxy, globally, for each client and each host rate limit
+func (s *Server) Throughput() ThroughputStatus {
+	return s.shaper.throughput()
+}
+
+// GlobalRateLimit limits the traffic of all clients together
+func GlobalRateLimit(l RateLimit) Option {
+	return func(s *Server) {
+		s.shaper.global.bucket = newBucket(l)
+	}
+}
+
+// ClientRateLimit limits the traffic of each client IP address
+func ClientRateLimit(l RateLimit) Option {
+	return func(s *Server) {
+		s.shaper.client = l
+	}
+}
+
+// HostRateLimit limits the traffic to all destinations matching the host patterns together.
+// The first matching HostRateLimit option is used.
+func HostRateLimit(hosts HostPatterns, l RateLimit) Option {
+	return func(s *Server) {
+		name := strings.Join(hosts, ",")
+		s.shaper.hosts = append(s.shaper.hosts, hostLimit{hosts: hosts, traffic: newTraffic(name, l)})
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want RateLimit
+		err  bool
+	}{
+		{in: "1000", want: RateLimit{Rate: 1000}},
+		{in: "10M", want: RateLimit{Rate: 10 << 20}},
+		{in: "512k:4MiB", want: RateLimit{Rate: 512 << 10, Burst: 4 << 20}},
+		{in: "1.5GB", want: RateLimit{Rate: 3 << 29}},
+		{in: "0", err: true},
+		{in: "fast", err: true},
+		{in: "10M:lots", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRateLimit(tt.in)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("ParseRateLimit(%q) = %+v", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRateLimit(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+	hosts, l, err := ParseHostRateLimit("*.docker.io=5M")
+	if err != nil || len(hosts) != 1 || hosts[0] != "*.docker.io" || l.Rate != 5<<20 {
+		t.Errorf("ParseHostRateLimit = %v, %+v, %v", hosts, l, err)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	b := newBucket(RateLimit{Rate: 1000, Burst: 500})
+	if d := b.take(500); d != 0 {
+		t.Errorf("take within burst waits %v", d)
+	}
+	if d := b.take(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("take in debt waits %v, want about 500ms", d)
+	}
+	if newBucket(RateLimit{}) != nil {
+		t.Error("bucket without a rate is not nil")
+	}
+}
+
+func TestLimitTunnel(t *testing.T) {
+	s := New(ClientRateLimit(RateLimit{Rate: 200 << 10, Burst: 20 << 10}))
+	client, clientPeer := net.Pipe()
+	target, targetPeer := net.Pipe()
+	rec := newAccessRecord(context.Background(), "192.0.2.1:1234", "CONNECT", "example.com:443", "HTTP/1.1")
+	rec.flow = s.shaper.flow(context.Background(), "192.0.2.1:1234", "example.com:443")
+	go tunnel(clientPeer, limitTunnel(targetPeer, rec), 0)
+
+	const size = 100 << 10
+	start := time.Now()
+	go func() {
+		_, _ = target.Write(make([]byte, size))
+		target.Close()
+	}()
+	n, err := io.Copy(io.Discard, client)
+	if err != nil || n != size {
+		t.Fatalf("copied %d bytes: %v", n, err)
+	}
+	// 20k burst, then 80k at 200k/s
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("transfer took %v, want about 400ms", elapsed)
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// Reloadable serves new requests and connections with the current Server, which can be replaced while it runs.
+// Requests and tunnels in progress finish on the Server they started on, with its settings.
+type Reloadable struct {
+	current atomic.Value
+}
+
+// NewReloadable serves with the server until it is replaced
+func NewReloadable(s *Server) *Reloadable {
+	r := &Reloadable{}
+	r.current.Store(s)
+	return r
+}
+
+// Server returns the current server
+func (r *Reloadable) Server() *Server {
+	return r.current.Load().(*Server)
+}
+
+// ReportThroughput reports the throughput of the current server as the squiggly_throughput_bytes_per_second gauge.
+// The gauge is process-wide, so it is called once, for the Reloadable that serves the listeners.
+func (r *Reloadable) ReportThroughput() {
+	throughput.Func(func() float64 { return r.Server().shaper.global.in.rate() }, "in")
+	throughput.Func(func() float64 { return r.Server().shaper.global.out.rate() }, "out")
+}
+
+// acquire returns the current server, with a request or connection counted as in progress on it.
+// A server retired after it was loaded has been swapped out, so the current server is loaded again.
+func (r *Reloadable) acquire() *Server {
+	for {
+		s := r.Server()
+		if s.active.acquire() {
+			return s
+		}
+	}
+}
+
+// Swap replaces the current server for new requests and connections, and returns the previous one.
+// The new server should be created with the Replaces option, so that it keeps what the previous one learned.
+func (r *Reloadable) Swap(s *Server) *Server {
+	prev := r.Server()
+	r.current.Store(s)
+	return prev
+}
+
+func (r *Reloadable) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	s := r.acquire()
+	defer s.active.release()
+	s.serveHTTP(resp, req)
+}
+
+// ServeSOCKS accepts SOCKS5 connections on the listener, and serves each with the server current when it is accepted
+func (r *Reloadable) ServeSOCKS(l net.Listener) error {
+	return acceptLoop(l, "socks", r.logger, func(conn net.Conn) {
+		s := r.acquire()
+		defer s.active.release()
+		s.serveSOCKSConn(conn)
+	})
+}
+
+// ServeTransparent accepts redirected connections on the listener, and serves each with the server current when it is accepted
+func (r *Reloadable) ServeTransparent(l net.Listener) error {
+	return acceptLoop(l, "transparent", r.logger, func(conn net.Conn) {
+		s := r.acquire()
+		defer s.active.release()
+		s.serveTransparentConn(l.Addr(), conn)
+	})
+}
+
+func (r *Reloadable) logger() *logging.EventLogger {
+	return r.Server().logger
+}
+
+// Replaces creates the server as the replacement of a running server. It keeps the upstream health
+// and the race winners of the previous server, so that a reload does not forget what was learned about the upstreams.
+func Replaces(prev *Server) Option {
+	return func(s *Server) {
+		s.health = prev.health
+		s.replaces = prev
+	}
+}
+
+// inherit copies the race winners of the replaced server, once the race option of the new server is set
+func (s *Server) inherit() {
+	prev := s.replaces
+	s.replaces = nil
+	if prev == nil || prev.race == nil || s.race == nil {
+		return
+	}
+	prev.race.mu.Lock()
+	defer prev.race.mu.Unlock()
+	for addr, w := range prev.race.winners {
+		s.race.winners[addr] = w
+	}
+}
+
+// Retire stops the server from taking new requests and connections, and returns a channel that is closed
+// once those in progress have finished, so that what they use can be closed. The server must have been swapped out
+// of its Reloadable first, which serves new requests with the current server instead.
+func (s *Server) Retire() <-chan struct{} {
+	return s.active.retire()
+}
+
+// inflight counts the requests and connections in progress on a server, until the server is retired and they have finished
+type inflight struct {
+	mu      sync.Mutex
+	n       int
+	retired bool
+	done    chan struct{}
+}
+
+// acquire counts a new request or connection, and reports false if the server has been retired
+func (a *inflight) acquire() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.retired {
+		return false
+	}
+	a.n++
+	return true
+}
+
+// hold counts another connection for a request already in progress, so it is counted even once the server is retired
+func (a *inflight) hold() {
+	a.mu.Lock()
+	a.n++
+	a.mu.Unlock()
+}
+
+// release ends a request or connection counted by acquire or hold
+func (a *inflight) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.n--
+	if a.retired && a.n == 0 {
+		close(a.done)
+	}
+}
+
+func (a *inflight) retire() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.retired {
+		return a.done
+	}
+	a.retired = true
+	a.done = make(chan struct{})
+	if a.n == 0 {
+		close(a.done)
+	}
+	return a.done
+}
+
+// trackingHijacker counts a hijacked connection as in progress until it is closed
+type trackingHijacker struct {
+	http.ResponseWriter
+	active *inflight
+}
+
+func (w *trackingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.active.hold()
+	return &hijackedConn{Conn: conn, active: w.active}, brw, nil
+}
+
+// hijackedConn ends its count when it is closed
+type hijackedConn struct {
+	net.Conn
+	active *inflight
+	once   sync.Once
+}
+
+func (c *hijackedConn) Close() error {
+	c.once.Do(c.active.release)
+	return c.Conn.Close()
+}
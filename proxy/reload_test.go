@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connectThrough opens a CONNECT tunnel to the target through the proxy, and returns the response status
+func connectThrough(t *testing.T, proxyAddr, target string) (net.Conn, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return conn, resp.StatusCode
+}
+
+func TestReloadable(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+	upstream := closedAddr(t)
+	policy := DefaultFallbackPolicy()
+	if err := policy.Set(ClassUnreachable, "direct"); err != nil {
+		t.Fatal(err)
+	}
+	prev := New(
+		Proxy(func(req *http.Request) (*url.URL, error) { return &url.URL{Scheme: "http", Host: upstream}, nil }),
+		Fallback(policy),
+	)
+	r := NewReloadable(prev)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	tunnel, status := connectThrough(t, srv.Listener.Addr().String(), echo.Addr().String())
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT = %d", status)
+	}
+
+	// New tunnels use the new server, which blocks the destination
+	b := &Blocklist{Sources: []string{writeBlocklist(t, "127.0.0.1\n")}}
+	if err := b.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	next := New(Block(b, nil), Replaces(prev))
+	if old := r.Swap(next); old != prev {
+		t.Errorf("Swap returned %p, want the previous server %p", old, prev)
+	}
+	conn, status := connectThrough(t, srv.Listener.Addr().String(), echo.Addr().String())
+	conn.Close()
+	if status != http.StatusForbidden {
+		t.Errorf("CONNECT after swap = %d, want %d", status, http.StatusForbidden)
+	}
+
+	// The tunnel opened before the swap keeps working
+	assertEcho(t, tunnel)
+
+	// The upstream health learned by the previous server is kept
+	if st := next.Upstreams(); len(st) != 1 || st[0].Host != upstream || st[0].Healthy {
+		t.Errorf("upstream health after swap = %+v", st)
+	}
+}
+
+func TestReplacesRaceWinners(t *testing.T) {
+	prev := New(Race(time.Second, time.Minute))
+	prev.race.setWinner("example.com:443", routeDirect)
+	next := New(Replaces(prev), Race(time.Second, time.Minute))
+	if w := next.race.winner("example.com:443"); w != routeDirect {
+		t.Errorf("race winner = %q, want %q", w, routeDirect)
+	}
+}
+
+func TestRetire(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+	prev := New()
+	r := NewReloadable(prev)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	tunnel, status := connectThrough(t, srv.Listener.Addr().String(), echo.Addr().String())
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT = %d", status)
+	}
+	r.Swap(New(Replaces(prev)))
+	drained := prev.Retire()
+	select {
+	case <-drained:
+		t.Fatal("drained with a tunnel open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A retired server takes no new requests
+	if prev.active.acquire() {
+		t.Error("retired server acquired a request")
+	}
+
+	// The tunnel still belongs to the previous server, which is drained once it is closed
+	assertEcho(t, tunnel)
+	tunnel.Close()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("not drained after the tunnel was closed")
+	}
+}
+
+func TestRetireWhileServing(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer origin.Close()
+	r := NewReloadable(New())
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+
+	stop := make(chan struct{})
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := client.Get(origin.URL)
+				if err != nil {
+					errs <- err
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					errs <- fmt.Errorf("status %d", resp.StatusCode)
+					return
+				}
+			}
+		}()
+	}
+
+	// Every request is served by a server that is not yet drained, so none fails while the servers are swapped
+	for i := 0; i < 50; i++ {
+		prev := r.Swap(New(Replaces(r.Server())))
+		select {
+		case <-prev.Retire():
+		case <-time.After(5 * time.Second):
+			t.Fatal("replaced server not drained")
+		}
+		if n := prev.active.n; n != 0 {
+			t.Fatalf("drained server has %d requests in progress", n)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReportThroughput(t *testing.T) {
+	prev := New()
+	r := NewReloadable(prev)
+	r.ReportThroughput()
+	next := New(Replaces(prev))
+	// A second in the past, so it counts towards the rate
+	sec := time.Now().Unix() - 1
+	next.shaper.global.in.secs[0], next.shaper.global.in.bytes[0] = sec, 5*1000
+	gauge := func() string {
+		var buf bytes.Buffer
+		if err := throughput.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	want := `squiggly_throughput_bytes_per_second{direction="in"} 1000`
+	if got := gauge(); strings.Contains(got, want) {
+		t.Fatalf("gauge reads a server that is not serving yet:\n%s", got)
+	}
+	r.Swap(next)
+	if got := gauge(); !strings.Contains(got, want) {
+		t.Errorf("gauge =\n%s\nwant %s", got, want)
+	}
+}
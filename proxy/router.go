@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/justenwalker/squiggly/logging"
+	"github.com/justenwalker/squiggly/pac"
+)
+
+// Mode selects how a Router chooses the upstream proxy
+type Mode string
+
+const (
+	// ModePAC routes requests according to a proxy auto config file
+	ModePAC Mode = "pac"
+	// ModeProxy routes every request through a single upstream proxy
+	ModeProxy Mode = "proxy"
+	// ModeEnv routes requests according to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	ModeEnv Mode = "env"
+	// ModeDirect connects directly to every destination
+	ModeDirect Mode = "direct"
+)
+
+// Router selects the upstream proxy for each request, and can be switched between modes while the server is running.
+// Its Proxy method is meant to be passed to the Proxy option.
+type Router struct {
+	// Logger is passed to the PAC files loaded by the router
+	Logger *logging.EventLogger
+	// PACDialTimeout and PACFetchTimeout are passed to the PAC files loaded by the router
+	PACDialTimeout  time.Duration
+	PACFetchTimeout time.Duration
+	// Bypass are the hosts connected to directly in every mode
+	Bypass HostPatterns
+
+	mu       sync.RWMutex
+	mode     Mode
+	pac      *pac.PAC
+	proxyURL *url.URL
+}
+
+// RouterStatus describes the current routing mode
+type RouterStatus struct {
+	Mode  Mode        `json:"mode"`
+	Proxy string      `json:"proxy,omitempty"`
+	PAC   *pac.Status `json:"pac,omitempty"`
+}
+
+// NewRouter creates a router in the direct mode
+func NewRouter() *Router {
+	return &Router{mode: ModeDirect}
+}
+
+// Proxy returns the upstream proxy for the request, or nil for a direct connection
+func (r *Router) Proxy(req *http.Request) (*url.URL, error) {
+	if r.Bypass.Match(req.URL.Host) {
+		return nil, nil
+	}
+	r.mu.RLock()
+	mode, p, purl := r.mode, r.pac, r.proxyURL
+	r.mu.RUnlock()
+	switch mode {
+	case ModePAC:
+		return p.Proxy(req)
+	case ModeProxy:
+		return purl, nil
+	case ModeEnv:
+		return http.ProxyFromEnvironment(req)
+	}
+	return nil, nil
+}
+
+// Proxies returns the upstream proxies for the request in order of preference, with a nil URL for a direct connection.
+// Only a PAC file can list more than one proxy.
+func (r *Router) Proxies(req *http.Request) ([]*url.URL, error) {
+	r.mu.RLock()
+	mode, p := r.mode, r.pac
+	r.mu.RUnlock()
+	if mode == ModePAC && !r.Bypass.Match(req.URL.Host) {
+		return p.Proxies(req)
+	}
+	u, err := r.Proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	return []*url.URL{u}, nil
+}
+
+// UsePAC switches to the PAC mode. If pacURL is empty, the previously configured PAC file is used.
+// A new PAC file is fetched before switching; the switch happens even if it can not be fetched yet.
+func (r *Router) UsePAC(pacURL string) error {
+	r.mu.RLock()
+	p := r.pac
+	r.mu.RUnlock()
+	var err error
+	if pacURL != "" && (p == nil || p.URL != pacURL) {
+		p = &pac.PAC{
+			URL:          pacURL,
+			Logger:       r.Logger,
+			DialTimeout:  r.PACDialTimeout,
+			FetchTimeout: r.PACFetchTimeout,
+		}
+		_, err = p.Refresh()
+	}
+	if p == nil {
+		return fmt.Errorf("no PAC url configured")
+	}
+	r.mu.Lock()
+	r.mode = ModePAC
+	r.pac = p
+	r.mu.Unlock()
+	return err
+}
+
+// UseProxy switches to a single upstream proxy. If proxyURL is empty, the previously configured proxy is used.
+func (r *Router) UseProxy(proxyURL string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	purl := r.proxyURL
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return fmt.Errorf("could not parse proxy url '%s': %w", proxyURL, err)
+		}
+		purl = u
+	}
+	if purl == nil {
+		return fmt.Errorf("no proxy url configured")
+	}
+	r.mode = ModeProxy
+	r.proxyURL = purl
+	return nil
+}
+
+// UseEnv switches to the proxy environment variables
+func (r *Router) UseEnv() {
+	r.mu.Lock()
+	r.mode = ModeEnv
+	r.mu.Unlock()
+}
+
+// UseDirect switches to direct connections
+func (r *Router) UseDirect() {
+	r.mu.Lock()
+	r.mode = ModeDirect
+	r.mu.Unlock()
+}
+
+// SetMode switches to the mode, using the arg as the PAC or proxy url where it applies
+func (r *Router) SetMode(mode Mode, arg string) error {
+	switch mode {
+	case ModePAC:
+		return r.UsePAC(arg)
+	case ModeProxy:
+		return r.UseProxy(arg)
+	case ModeEnv:
+		r.UseEnv()
+		return nil
+	case ModeDirect:
+		r.UseDirect()
+		return nil
+	}
+	return fmt.Errorf("unknown routing mode '%s'", mode)
+}
+
+// RefreshPAC fetches the PAC file again, even if the router is not currently in the PAC mode
+func (r *Router) RefreshPAC() error {
+	r.mu.RLock()
+	p := r.pac
+	r.mu.RUnlock()
+	if p == nil {
+		return fmt.Errorf("no PAC url configured")
+	}
+	_, err := p.Refresh()
+	return err
+}
+
+// PAC returns the configured PAC file, or nil if there is none
+func (r *Router) PAC() *pac.PAC {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pac
+}
+
+// Status returns the current routing mode
+func (r *Router) Status() RouterStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	st := RouterStatus{Mode: r.mode}
+	if r.proxyURL != nil {
+		// The URL may carry the proxy credentials, which must not show up in the admin API or the logs
+		st.Proxy = r.proxyURL.Redacted()
+	}
+	if r.pac != nil {
+		ps := r.pac.Status()
+		st.PAC = &ps
+	}
+	return st
+}
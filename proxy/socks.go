@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socks5Version = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	// username/password sub-negotiation (RFC 1929)
+	socksPasswordVersion = 0x01
+	socksPasswordSuccess = 0x00
+	socksPasswordFailure = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded           = 0x00
+	socksRepGeneralFailure      = 0x01
+	socksRepNotAllowed          = 0x02
+	socksRepNetworkUnreachable  = 0x03
+	socksRepHostUnreachable     = 0x04
+	socksRepConnectionRefused   = 0x05
+	socksRepCommandNotSupported = 0x07
+	socksRepAddrNotSupported    = 0x08
+)
+
+// socksHandshakeTimeout bounds how long a client may take to send its SOCKS greeting and request
+const socksHandshakeTimeout = 30 * time.Second
+
+type socksError struct {
+	rep byte
+	msg string
+}
+
+func (e *socksError) Error() string {
+	return e.msg
+}
+
+// ServeSOCKS accepts SOCKS5 connections on the listener and tunnels them
+// using the same routing and upstream proxy authentication as HTTP CONNECT requests.
+// Only the CONNECT command is supported. Clients are subject to the same access control as HTTP clients;
+// when client authentication is configured, they must use the username/password method.
+func (s *Server) ServeSOCKS(l net.Listener) error {
+	return acceptLoop(l, "socks", func() *logging.EventLogger { return s.logger }, func(conn net.Conn) {
+		if !s.active.acquire() {
+			conn.Close()
+			return
+		}
+		defer s.active.release()
+		s.serveSOCKSConn(conn)
+	})
+}
+
+// acceptLoop accepts connections on the listener and serves each of them in a new goroutine,
+// retrying accept errors that may go away with a growing delay
+func acceptLoop(l net.Listener, kind string, logger func() *logging.EventLogger, serve func(net.Conn)) error {
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if retryAccept(err) {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				logger().Warn(kind+" accept failed", logging.F("retry", tempDelay), logging.Err(err))
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go serve(conn)
+	}
+}
+
+// retryAccept reports whether an accept error may go away: a connection aborted before it was accepted,
+// running out of file descriptors, or a timeout. A closed listener is never retried.
+func retryAccept(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (s *Server) serveSOCKSConn(conn net.Conn) {
+	ctx := logging.WithRequestID(context.Background(), logging.NewRequestID())
+	logger := s.logger.Ctx(ctx).With(logging.F(logging.KeyClient, conn.RemoteAddr()))
+	if !s.allowClient(conn.RemoteAddr().String()) {
+		logger.Warn("client denied")
+		conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	addr, err := socksHandshake(conn, s.clientAuth)
+	if err != nil {
+		logger.Warn("socks handshake failed", logging.Err(err))
+		var serr *socksError
+		if errors.As(err, &serr) {
+			_ = socksReply(conn, serr.rep, nil)
+		}
+		conn.Close()
+		return
+	}
+	logger = logger.With(logging.F(logging.KeyTarget, addr))
+	logger.Debug("socks connect")
+	rec := newAccessRecord(ctx, conn.RemoteAddr().String(), http.MethodConnect, addr, "SOCKS5")
+	rec.flow = s.shaper.flow(ctx, conn.RemoteAddr().String(), addr)
+	defer s.logAccess(rec)
+	target, err := s.dialTunnel(withRecord(ctx, rec), "tcp", addr)
+	if err != nil {
+		logger.Warn("socks connect failed", logging.Err(err))
+		rec.setStatus(errorStatus(err))
+		_ = socksReply(conn, socksReplyCode(err), nil)
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, socksRepSucceeded, target.LocalAddr()); err != nil {
+		conn.Close()
+		target.Close()
+		return
+	}
+	rec.setStatus(http.StatusOK)
+	_ = conn.SetDeadline(time.Time{})
+	rec.bytesIn, rec.bytesOut = tunnel(conn, limitTunnel(target, rec), s.timeoutsFor(addr).Idle)
+}
+
+// socksHandshake negotiates the authentication method and reads the CONNECT request,
+// returning the requested target address as host:port.
+// If verifier is not nil, the client must authenticate with a username and password.
+func socksHandshake(rw io.ReadWriter, verifier ClientVerifier) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+	want := byte(socksAuthNone)
+	if verifier != nil {
+		want = socksAuthPassword
+	}
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	if _, err := rw.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	switch method {
+	case socksAuthNoAcceptable:
+		return "", fmt.Errorf("no acceptable authentication method offered")
+	case socksAuthPassword:
+		if err := socksPasswordAuth(rw, verifier); err != nil {
+			return "", err
+		}
+	}
+	var req [4]byte
+	if _, err := io.ReadFull(rw, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	host, err := socksReadAddr(rw, req[3])
+	if err != nil {
+		return "", err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(rw, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksCmdConnect {
+		return "", &socksError{rep: socksRepCommandNotSupported, msg: fmt.Sprintf("unsupported SOCKS command %d", req[1])}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksPasswordAuth performs the username/password sub-negotiation
+func socksPasswordAuth(rw io.ReadWriter, verifier ClientVerifier) error {
+	var ver [1]byte
+	if _, err := io.ReadFull(rw, ver[:]); err != nil {
+		return err
+	}
+	if ver[0] != socksPasswordVersion {
+		return fmt.Errorf("unsupported SOCKS username/password version %d", ver[0])
+	}
+	username, err := socksReadString(rw)
+	if err != nil {
+		return err
+	}
+	password, err := socksReadString(rw)
+	if err != nil {
+		return err
+	}
+	if !verifier.Verify(username, password) {
+		_, _ = rw.Write([]byte{socksPasswordVersion, socksPasswordFailure})
+		return fmt.Errorf("authentication failed for user '%s'", username)
+	}
+	_, err = rw.Write([]byte{socksPasswordVersion, socksPasswordSuccess})
+	return err
+}
+
+// socksReadString reads a string prefixed with a single length byte
+func socksReadString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func socksReadAddr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case socksAtypIPv4:
+		ip := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	case socksAtypIPv6:
+		ip := make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	case socksAtypDomain:
+		return socksReadString(r)
+	}
+	return "", &socksError{rep: socksRepAddrNotSupported, msg: fmt.Sprintf("unsupported SOCKS address type %d", atyp)}
+}
+
+// socksReply writes a reply with the bound address, or 0.0.0.0:0 if it is not known
+func socksReply(w io.Writer, rep byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		ip = tcp.IP
+		port = tcp.Port
+	}
+	buf := []byte{socks5Version, rep, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, socksAtypIPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, socksAtypIPv6)
+		buf = append(buf, ip.To16()...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+	_, err := w.Write(buf)
+	return err
+}
+
+// socksReplyCode maps a dial error to the closest SOCKS reply code
+func socksReplyCode(err error) byte {
+	var dnserr *net.DNSError
+	var nerr net.Error
+	var perr *ProxyError
+	var blocked *BlockedError
+	switch {
+	case errors.As(err, &blocked):
+		return socksRepNotAllowed
+	// Errors connecting to the upstream proxy say nothing about the destination
+	case errors.As(err, &perr):
+		switch errorClass(perr) {
+		case ClassRefused:
+			return socksRepConnectionRefused
+		case ClassHandshakeTimeout:
+			return socksRepHostUnreachable
+		}
+		return socksRepGeneralFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksRepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksRepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnserr):
+		return socksRepHostUnreachable
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return socksRepHostUnreachable
+	}
+	return socksRepGeneralFailure
+}
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// staticVerifier accepts a single username and password
+type staticVerifier struct {
+	username, password string
+}
+
+func (v staticVerifier) Verify(username, password string) bool {
+	return username == v.username && password == v.password
+}
+
+type handshakeResult struct {
+	addr string
+	err  error
+}
+
+// startSOCKSHandshake runs socksHandshake on one end of a pipe, and returns the client end
+func startSOCKSHandshake(t *testing.T, verifier ClientVerifier) (net.Conn, <-chan handshakeResult) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	result := make(chan handshakeResult, 1)
+	go func() {
+		addr, err := socksHandshake(server, verifier)
+		result <- handshakeResult{addr: addr, err: err}
+		server.Close()
+	}()
+	return client, result
+}
+
+// socksExchange writes the request and checks the response
+func socksExchange(t *testing.T, conn net.Conn, req, want []byte) {
+	t.Helper()
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("write %x: %v", req, err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read reply to %x: %v", req, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("reply to %x = %x, want %x", req, got, want)
+	}
+}
+
+func TestSOCKSHandshakeAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		addr []byte
+		want string
+	}{
+		{name: "ipv4", addr: []byte{socksAtypIPv4, 192, 0, 2, 1, 0x1f, 0x90}, want: "192.0.2.1:8080"},
+		{name: "ipv6", addr: append(append([]byte{socksAtypIPv6}, net.ParseIP("2001:db8::1")...), 0x01, 0xbb), want: "[2001:db8::1]:443"},
+		{name: "domain", addr: append(append([]byte{socksAtypDomain, 11}, "example.com"...), 0x00, 0x50), want: "example.com:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, result := startSOCKSHandshake(t, nil)
+			socksExchange(t, conn, []byte{socks5Version, 2, socksAuthPassword, socksAuthNone}, []byte{socks5Version, socksAuthNone})
+			if _, err := conn.Write(append([]byte{socks5Version, socksCmdConnect, 0x00}, tt.addr...)); err != nil {
+				t.Fatal(err)
+			}
+			r := <-result
+			if r.err != nil {
+				t.Fatalf("socksHandshake: %v", r.err)
+			}
+			if r.addr != tt.want {
+				t.Errorf("socksHandshake = %q, want %q", r.addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestSOCKSHandshakePassword(t *testing.T) {
+	verifier := staticVerifier{username: "alice", password: "secret"}
+	credentials := func(user, pass string) []byte {
+		b := []byte{socksPasswordVersion, byte(len(user))}
+		b = append(b, user...)
+		b = append(b, byte(len(pass)))
+		return append(b, pass...)
+	}
+	t.Run("accepted", func(t *testing.T) {
+		conn, result := startSOCKSHandshake(t, verifier)
+		socksExchange(t, conn, []byte{socks5Version, 2, socksAuthNone, socksAuthPassword}, []byte{socks5Version, socksAuthPassword})
+		socksExchange(t, conn, credentials("alice", "secret"), []byte{socksPasswordVersion, socksPasswordSuccess})
+		if _, err := conn.Write([]byte{socks5Version, socksCmdConnect, 0x00, socksAtypIPv4, 127, 0, 0, 1, 0x00, 0x16}); err != nil {
+			t.Fatal(err)
+		}
+		if r := <-result; r.err != nil || r.addr != "127.0.0.1:22" {
+			t.Errorf("socksHandshake = %q, %v", r.addr, r.err)
+		}
+	})
+	t.Run("wrong password", func(t *testing.T) {
+		conn, result := startSOCKSHandshake(t, verifier)
+		socksExchange(t, conn, []byte{socks5Version, 1, socksAuthPassword}, []byte{socks5Version, socksAuthPassword})
+		socksExchange(t, conn, credentials("alice", "wrong"), []byte{socksPasswordVersion, socksPasswordFailure})
+		if r := <-result; r.err == nil {
+			t.Errorf("socksHandshake = %q, want an error", r.addr)
+		}
+	})
+	t.Run("password not offered", func(t *testing.T) {
+		conn, result := startSOCKSHandshake(t, verifier)
+		socksExchange(t, conn, []byte{socks5Version, 1, socksAuthNone}, []byte{socks5Version, socksAuthNoAcceptable})
+		if r := <-result; r.err == nil {
+			t.Errorf("socksHandshake = %q, want an error", r.addr)
+		}
+	})
+	t.Run("no auth not offered", func(t *testing.T) {
+		conn, result := startSOCKSHandshake(t, nil)
+		socksExchange(t, conn, []byte{socks5Version, 1, socksAuthPassword}, []byte{socks5Version, socksAuthNoAcceptable})
+		if r := <-result; r.err == nil {
+			t.Errorf("socksHandshake = %q, want an error", r.addr)
+		}
+	})
+}
+
+func TestSOCKSHandshakeRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		req  []byte
+		rep  byte
+	}{
+		{name: "bind", req: []byte{socks5Version, 0x02, 0x00, socksAtypIPv4, 192, 0, 2, 1, 0x00, 0x50}, rep: socksRepCommandNotSupported},
+		{name: "udp associate", req: []byte{socks5Version, 0x03, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0x00, 0x00}, rep: socksRepCommandNotSupported},
+		{name: "address type", req: []byte{socks5Version, socksCmdConnect, 0x00, 0x05}, rep: socksRepAddrNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, result := startSOCKSHandshake(t, nil)
+			socksExchange(t, conn, []byte{socks5Version, 1, socksAuthNone}, []byte{socks5Version, socksAuthNone})
+			if _, err := conn.Write(tt.req); err != nil {
+				t.Fatal(err)
+			}
+			r := <-result
+			var serr *socksError
+			if !errors.As(r.err, &serr) {
+				t.Fatalf("socksHandshake = %q, %v, want a socksError", r.addr, r.err)
+			}
+			if serr.rep != tt.rep {
+				t.Errorf("reply code = %d, want %d", serr.rep, tt.rep)
+			}
+		})
+	}
+}
+
+func TestSOCKSHandshakeVersion(t *testing.T) {
+	conn, result := startSOCKSHandshake(t, nil)
+	if _, err := conn.Write([]byte{0x04, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-result; r.err == nil {
+		t.Errorf("socksHandshake accepted SOCKS4: %q", r.addr)
+	}
+}
+
+func TestSOCKSReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		rep   byte
+		bound net.Addr
+		want  []byte
+	}{
+		{name: "unknown", rep: socksRepGeneralFailure, want: []byte{5, socksRepGeneralFailure, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}},
+		{name: "ipv4", rep: socksRepSucceeded, bound: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8080}, want: []byte{5, 0, 0, socksAtypIPv4, 192, 0, 2, 1, 0x1f, 0x90}},
+		{name: "ipv6", rep: socksRepSucceeded, bound: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			want: append(append([]byte{5, 0, 0, socksAtypIPv6}, net.ParseIP("2001:db8::1")...), 0x01, 0xbb)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := socksReply(&buf, tt.rep, tt.bound); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.want) {
+				t.Errorf("socksReply = %x, want %x", buf.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSOCKSReplyCode(t *testing.T) {
+	dialErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{name: "blocked", err: &BlockedError{Host: "ads.example.com"}, want: socksRepNotAllowed},
+		{name: "proxy refused", err: &ProxyError{Proxy: "proxy:8080", Kind: &ErrProxyRefused{StatusCode: 403, Status: "403 Forbidden"}}, want: socksRepConnectionRefused},
+		{name: "proxy timeout", err: &ProxyError{Proxy: "proxy:8080", Kind: ErrHandshakeTimeout}, want: socksRepHostUnreachable},
+		{name: "proxy auth", err: &ProxyError{Proxy: "proxy:8080", Kind: ErrProxyAuthFailed}, want: socksRepGeneralFailure},
+		// a refused connection to the proxy says nothing about the destination
+		{name: "proxy unreachable", err: &ProxyError{Proxy: "proxy:8080", Kind: ErrProxyUnreachable, Err: dialErr(syscall.ECONNREFUSED)}, want: socksRepGeneralFailure},
+		{name: "connection refused", err: dialErr(syscall.ECONNREFUSED), want: socksRepConnectionRefused},
+		{name: "network unreachable", err: dialErr(syscall.ENETUNREACH), want: socksRepNetworkUnreachable},
+		{name: "host unreachable", err: dialErr(syscall.EHOSTUNREACH), want: socksRepHostUnreachable},
+		{name: "dns", err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nx.example.com"}}, want: socksRepHostUnreachable},
+		{name: "timeout", err: &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, want: socksRepHostUnreachable},
+		{name: "other", err: errors.New("boom"), want: socksRepGeneralFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := socksReplyCode(tt.err); got != tt.want {
+				t.Errorf("socksReplyCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAccept(t *testing.T) {
+	acceptErr := func(err error) error {
+		return &net.OpError{Op: "accept", Net: "tcp", Err: err}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection aborted", err: acceptErr(os.NewSyscallError("accept4", syscall.ECONNABORTED)), want: true},
+		{name: "too many open files", err: acceptErr(os.NewSyscallError("accept4", syscall.EMFILE)), want: true},
+		{name: "file table full", err: acceptErr(os.NewSyscallError("accept4", syscall.ENFILE)), want: true},
+		{name: "timeout", err: acceptErr(timeoutError{}), want: true},
+		{name: "closed", err: acceptErr(net.ErrClosed), want: false},
+		{name: "invalid", err: acceptErr(os.NewSyscallError("accept4", syscall.EINVAL)), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryAccept(tt.err); got != tt.want {
+				t.Errorf("retryAccept(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptLoopClosed(t *testing.T) {
+	l := listenLoopback(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- acceptLoop(l, "test", func() *logging.EventLogger { return nil }, func(conn net.Conn) { conn.Close() })
+	}()
+	l.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("acceptLoop() = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acceptLoop did not return after the listener was closed")
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeouts limits each phase of a proxied connection. A zero value means no limit.
+type Timeouts struct {
+	// Dial limits connecting to the destination or to the upstream proxy
+	Dial time.Duration
+	// Handshake limits the TLS handshake with an https upstream proxy together with its response to the CONNECT,
+	// and the TLS handshake with https destinations of plain and decrypted requests
+	Handshake time.Duration
+	// Auth limits the NTLM, Negotiate or Basic authentication handshake with the upstream proxy
+	Auth time.Duration
+	// ResponseHeader limits waiting for the response headers of plain and decrypted requests
+	ResponseHeader time.Duration
+	// Idle closes CONNECT, SOCKS and transparent tunnels without traffic in either direction for this long
+	Idle time.Duration
+}
+
+// DefaultTimeouts are the timeouts used when the Timeout option is not given
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Dial:           30 * time.Second,
+		Handshake:      10 * time.Second,
+		Auth:           30 * time.Second,
+		ResponseHeader: 10 * time.Second,
+	}
+}
+
+// Set the timeout of a phase: dial, handshake, auth, response-header or idle
+func (t *Timeouts) Set(phase string, d time.Duration) error {
+	switch strings.ToLower(phase) {
+	case "dial":
+		t.Dial = d
+	case "handshake":
+		t.Handshake = d
+	case "auth":
+		t.Auth = d
+	case "response-header":
+		t.ResponseHeader = d
+	case "idle":
+		t.Idle = d
+	default:
+		return fmt.Errorf("unknown timeout '%s', expected dial, handshake, auth, response-header or idle", phase)
+	}
+	return nil
+}
+
+// override returns the timeouts with the non-zero timeouts of o replacing its own
+func (t Timeouts) override(o Timeouts) Timeouts {
+	if o.Dial != 0 {
+		t.Dial = o.Dial
+	}
+	if o.Handshake != 0 {
+		t.Handshake = o.Handshake
+	}
+	if o.Auth != 0 {
+		t.Auth = o.Auth
+	}
+	if o.ResponseHeader != 0 {
+		t.ResponseHeader = o.ResponseHeader
+	}
+	if o.Idle != 0 {
+		t.Idle = o.Idle
+	}
+	return t
+}
+
+// ParseHostTimeouts parses the host timeouts of a destination, in the form
+// PATTERN:PHASE=DURATION[,PHASE=DURATION...], e.g. "*.artifacts.example.com:response-header=10m,idle=1h"
+func ParseHostTimeouts(s string) (HostPatterns, Timeouts, error) {
+	var t Timeouts
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return nil, t, fmt.Errorf("invalid host timeout '%s', expected PATTERN:PHASE=DURATION[,PHASE=DURATION...]", s)
+	}
+	for _, kv := range strings.Split(s[i+1:], ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, t, fmt.Errorf("invalid host timeout '%s': expected PHASE=DURATION, got '%s'", s, kv)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, t, fmt.Errorf("invalid host timeout '%s': %w", s, err)
+		}
+		if err := t.Set(strings.TrimSpace(parts[0]), d); err != nil {
+			return nil, t, err
+		}
+	}
+	return HostPatterns{s[:i]}, t, nil
+}
+
+// hostTimeouts overrides timeouts for the destinations matching the host patterns
+type hostTimeouts struct {
+	hosts     HostPatterns
+	timeouts  Timeouts
+	transport *http.Transport
+}
+
+// initTimeouts creates the transports with the timeouts, once all options are set
+func (s *Server) initTimeouts() {
+	s.server.Tr = s.newTransport(s.timeouts)
+	for i := range s.hostTimeouts {
+		h := &s.hostTimeouts[i]
+		h.timeouts = s.timeouts.override(h.timeouts)
+		h.transport = s.newTransport(h.timeouts)
+	}
+}
+
+// newTransport returns the transport for plain and decrypted requests with the timeouts
+func (s *Server) newTransport(t Timeouts) *http.Transport {
+	return &http.Transport{
+		DialContext:           s.dialContext,
+		TLSHandshakeTimeout:   t.Handshake,
+		ResponseHeaderTimeout: t.ResponseHeader,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// timeoutsFor returns the timeouts of a destination host, with or without a port
+func (s *Server) timeoutsFor(host string) Timeouts {
+	if h := s.hostOverride(host); h != nil {
+		return h.timeouts
+	}
+	return s.timeouts
+}
+
+// hostOverride returns the first host timeouts matching the host, or nil
+func (s *Server) hostOverride(host string) *hostTimeouts {
+	for i := range s.hostTimeouts {
+		if s.hostTimeouts[i].hosts.Match(host) {
+			return &s.hostTimeouts[i]
+		}
+	}
+	return nil
+}
+
+// withTimeout returns a context that is done after the timeout, or the context itself if the timeout is zero
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Timeout sets the timeouts of every connection.
+// Timeouts given with HostTimeout override them for matching destinations.
+func Timeout(t Timeouts) Option {
+	return func(s *Server) {
+		s.timeouts = t
+	}
+}
+
+// HostTimeout overrides the non-zero timeouts for destinations matching the host patterns,
+// such as long-polling or slow endpoints. The first matching HostTimeout option is used.
+func HostTimeout(hosts HostPatterns, t Timeouts) Option {
+	return func(s *Server) {
+		s.hostTimeouts = append(s.hostTimeouts, hostTimeouts{hosts: hosts, timeouts: t})
+	}
+}
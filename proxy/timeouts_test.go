@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseHostTimeouts(t *testing.T) {
+	tests := []struct {
+		in    string
+		hosts HostPatterns
+		want  Timeouts
+		err   bool
+	}{
+		{in: "*.example.com:response-header=10m,idle=1h", hosts: HostPatterns{"*.example.com"}, want: Timeouts{ResponseHeader: 10 * time.Minute, Idle: time.Hour}},
+		{in: ".example.com:dial=5s", hosts: HostPatterns{".example.com"}, want: Timeouts{Dial: 5 * time.Second}},
+		{in: "::1:handshake=1s", hosts: HostPatterns{"::1"}, want: Timeouts{Handshake: time.Second}},
+		{in: "example.com", err: true},
+		{in: ":idle=1h", err: true},
+		{in: "example.com:idle", err: true},
+		{in: "example.com:idle=forever", err: true},
+		{in: "example.com:connect=1s", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			hosts, got, err := ParseHostTimeouts(tt.in)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("ParseHostTimeouts(%q) succeeded", tt.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hosts) != 1 || hosts[0] != tt.hosts[0] {
+				t.Errorf("hosts = %v, want %v", hosts, tt.hosts)
+			}
+			if got != tt.want {
+				t.Errorf("timeouts = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostTimeout(t *testing.T) {
+	s := New(
+		HostTimeout(HostPatterns{".slow.example.com"}, Timeouts{ResponseHeader: time.Hour}),
+		Timeout(Timeouts{Dial: time.Second, ResponseHeader: time.Minute}),
+	)
+	if got := s.timeoutsFor("api.slow.example.com:443"); got != (Timeouts{Dial: time.Second, ResponseHeader: time.Hour}) {
+		t.Errorf("override = %+v", got)
+	}
+	if got := s.timeoutsFor("example.com:443"); got != (Timeouts{Dial: time.Second, ResponseHeader: time.Minute}) {
+		t.Errorf("default = %+v", got)
+	}
+	if tr := s.hostOverride("slow.example.com").transport; tr.ResponseHeaderTimeout != time.Hour {
+		t.Errorf("transport ResponseHeaderTimeout = %v", tr.ResponseHeaderTimeout)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+	blackhole := listenLoopback(t)
+	serveBlackhole(t, blackhole)
+	purl := proxyURLFor(blackhole)
+	s := New(
+		Proxy(func(req *http.Request) (*url.URL, error) { return purl, nil }),
+		Timeout(Timeouts{Handshake: 100 * time.Millisecond}),
+	)
+	start := time.Now()
+	_, _, err := s.dialRoute(context.Background(), "tcp", echo.Addr().String())
+	if class := errorClass(err); class != ClassHandshakeTimeout {
+		t.Errorf("class of %v = %q, want %q", err, class, ClassHandshakeTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("handshake took %v", elapsed)
+	}
+}
+
+func TestTunnelIdle(t *testing.T) {
+	client, clientPeer := net.Pipe()
+	target, targetPeer := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		tunnel(clientPeer, targetPeer, 100*time.Millisecond)
+		close(done)
+	}()
+	// Traffic in one direction keeps the tunnel open
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+	for i := 0; i < 5; i++ {
+		if _, err := target.Write([]byte("ping")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("tunnel closed while active")
+	default:
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle tunnel not closed")
+	}
+}
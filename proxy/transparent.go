@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// transparentSniffTimeout bounds how long a client may take to send its ClientHello or request headers
+const transparentSniffTimeout = 30 * time.Second
+
+// Destination ports whose clients speak first, with a ClientHello or request headers
+const (
+	sniffPortHTTP  = 80
+	sniffPortHTTPS = 443
+)
+
+// recordTypeHandshake is the TLS record content type of a ClientHello
+const recordTypeHandshake = 0x16
+
+var errSNIFound = errors.New("sni found")
+
+// ServeTransparent accepts connections redirected to the listener by iptables/nftables (REDIRECT or TPROXY)
+// and tunnels them to their original destination using the same routing and upstream proxy authentication
+// as HTTP CONNECT requests. For ports 80 and 443, the destination host name is taken from the TLS ClientHello SNI
+// or the HTTP Host header so that the PAC and upstream proxy see names rather than addresses.
+// Clients are subject to the same access control as HTTP clients, but since they can not authenticate,
+// every connection is refused when client authentication is configured.
+func (s *Server) ServeTransparent(l net.Listener) error {
+	return acceptLoop(l, "transparent", func() *logging.EventLogger { return s.logger }, func(conn net.Conn) {
+		if !s.active.acquire() {
+			conn.Close()
+			return
+		}
+		defer s.active.release()
+		s.serveTransparentConn(l.Addr(), conn)
+	})
+}
+
+func (s *Server) serveTransparentConn(laddr net.Addr, conn net.Conn) {
+	ctx := logging.WithRequestID(context.Background(), logging.NewRequestID())
+	logger := s.logger.Ctx(ctx).With(logging.F(logging.KeyClient, conn.RemoteAddr()))
+	if !s.allowClient(conn.RemoteAddr().String()) {
+		logger.Warn("client denied")
+		conn.Close()
+		return
+	}
+	// Redirected clients can not send credentials, so none are let through when client authentication is required
+	if s.clientAuth != nil {
+		logger.Warn("client denied, transparent clients can not authenticate")
+		conn.Close()
+		return
+	}
+	dst, err := originalDst(conn)
+	if err != nil {
+		logger.Warn("transparent original destination unknown", logging.Err(err))
+		conn.Close()
+		return
+	}
+	if isListenerAddr(laddr, dst) {
+		logger.Warn("transparent connection was not redirected; refusing to loop", logging.F(logging.KeyTarget, dst))
+		conn.Close()
+		return
+	}
+	// Other protocols, such as SSH or SMTP, wait for the server to speak first, so they are not sniffed
+	var name string
+	client := conn
+	if dst.Port == sniffPortHTTP || dst.Port == sniffPortHTTPS {
+		_ = conn.SetReadDeadline(time.Now().Add(transparentSniffTimeout))
+		name, client = sniffHost(conn)
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+	addr := dst.String()
+	if name != "" {
+		addr = net.JoinHostPort(name, strconv.Itoa(dst.Port))
+	}
+	logger = logger.With(logging.F(logging.KeyTarget, addr))
+	logger.Debug("transparent connect", logging.F("original", dst))
+	rec := newAccessRecord(ctx, conn.RemoteAddr().String(), http.MethodConnect, addr, "TRANSPARENT")
+	rec.flow = s.shaper.flow(ctx, conn.RemoteAddr().String(), addr)
+	defer s.logAccess(rec)
+	target, err := s.dialTunnel(withRecord(ctx, rec), "tcp", addr)
+	if err != nil {
+		logger.Warn("transparent connect failed", logging.Err(err))
+		rec.setStatus(errorStatus(err))
+		conn.Close()
+		return
+	}
+	rec.setStatus(http.StatusOK)
+	rec.bytesIn, rec.bytesOut = tunnel(client, limitTunnel(target, rec), s.timeoutsFor(addr).Idle)
+}
+
+// isListenerAddr reports whether the destination is the transparent listener itself,
+// which happens when a client connects to it directly instead of being redirected.
+func isListenerAddr(laddr net.Addr, dst *net.TCPAddr) bool {
+	l, ok := laddr.(*net.TCPAddr)
+	if !ok || l.Port != dst.Port {
+		return false
+	}
+	return l.IP.Equal(dst.IP) || (l.IP.IsUnspecified() && dst.IP.IsLoopback())
+}
+
+// sniffHost peeks at the first bytes sent by the client to find the host name it is connecting to.
+// The returned connection replays everything that was read while sniffing.
+// The name is empty if the protocol was not recognised.
+func sniffHost(conn net.Conn) (string, net.Conn) {
+	buf := &bytes.Buffer{}
+	br := bufio.NewReader(io.TeeReader(conn, buf))
+	var name string
+	if first, err := br.Peek(1); err == nil {
+		if first[0] == recordTypeHandshake {
+			name = sniffSNI(br)
+		} else {
+			name = sniffHTTPHost(br)
+		}
+	}
+	return name, &bufferedConn{Conn: conn, r: io.MultiReader(buf, conn)}
+}
+
+// sniffSNI reads a TLS ClientHello and returns the server name indication
+func sniffSNI(r io.Reader) string {
+	var sni string
+	cfg := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errSNIFound
+		},
+	}
+	_ = tls.Server(sniffConn{r: r}, cfg).Handshake()
+	return sni
+}
+
+// sniffHTTPHost reads an HTTP request header and returns the host it is addressed to
+func sniffHTTPHost(br *bufio.Reader) string {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return ""
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// sniffConn is a read-only connection used to parse a ClientHello without responding to it
+type sniffConn struct {
+	r io.Reader
+}
+
+func (c sniffConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c sniffConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c sniffConn) Close() error                       { return nil }
+func (c sniffConn) LocalAddr() net.Addr                { return nil }
+func (c sniffConn) RemoteAddr() net.Addr               { return nil }
+func (c sniffConn) SetDeadline(t time.Time) error      { return nil }
+func (c sniffConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c sniffConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST / IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// originalDst recovers the destination of a connection redirected by iptables/nftables.
+// Connections redirected with REDIRECT carry the original destination in the conntrack entry (SO_ORIGINAL_DST),
+// while connections accepted by a TPROXY listener are already bound to the original destination.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("transparent proxy requires a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	var dst *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			var info *syscall.IPv6MTUInfo
+			// IPv6MTUInfo starts with a sockaddr_in6, which is large enough to hold the result
+			info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if serr == nil {
+				ip := make(net.IP, net.IPv6len)
+				copy(ip, info.Addr.Addr[:])
+				dst = &net.TCPAddr{IP: ip, Port: ntohs(info.Addr.Port)}
+			}
+			return
+		}
+		var mreq *syscall.IPv6Mreq
+		// IPv6Mreq is large enough to hold a sockaddr_in
+		mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if serr == nil {
+			ip := net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7])
+			dst = &net.TCPAddr{IP: ip, Port: int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3])}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		// No conntrack entry; assume TPROXY where the socket is bound to the original destination
+		if local == nil {
+			return nil, serr
+		}
+		return local, nil
+	}
+	return dst, nil
+}
+
+// ntohs converts a port stored in network byte order in a raw sockaddr
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/justenwalker/squiggly/logging"
+)
+
+// recordConn records what the client writes, and fails every read so that the handshake stops after the ClientHello
+type recordConn struct {
+	sniffConn
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+func (c *recordConn) Read(p []byte) (int, error)  { return 0, errors.New("no server") }
+
+// clientHello returns the ClientHello a TLS client sends for the server name
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	conn := &recordConn{}
+	_ = tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: serverName == ""}).Handshake()
+	if conn.buf.Len() == 0 || conn.buf.Bytes()[0] != recordTypeHandshake {
+		t.Fatalf("no ClientHello recorded: %x", conn.buf.Bytes())
+	}
+	return conn.buf.Bytes()
+}
+
+func TestSniffSNI(t *testing.T) {
+	if got := sniffSNI(bytes.NewReader(clientHello(t, "www.example.com"))); got != "www.example.com" {
+		t.Errorf("sniffSNI = %q, want www.example.com", got)
+	}
+	if got := sniffSNI(bytes.NewReader(clientHello(t, ""))); got != "" {
+		t.Errorf("sniffSNI without server name = %q", got)
+	}
+	if got := sniffSNI(bytes.NewReader([]byte{recordTypeHandshake, 0x03, 0x01, 0x00})); got != "" {
+		t.Errorf("sniffSNI of a truncated record = %q", got)
+	}
+}
+
+func TestSniffHTTPHost(t *testing.T) {
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{req: "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", want: "www.example.com"},
+		{req: "GET /path HTTP/1.1\r\nHost: www.example.com:8080\r\nUser-Agent: test\r\n\r\n", want: "www.example.com"},
+		{req: "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", want: "2001:db8::1"},
+		{req: "GET / HTTP/1.0\r\n\r\n", want: ""},
+		{req: "SSH-2.0-OpenSSH_9.0\r\n", want: ""},
+	}
+	for _, tt := range tests {
+		if got := sniffHTTPHost(bufio.NewReader(bytes.NewReader([]byte(tt.req)))); got != tt.want {
+			t.Errorf("sniffHTTPHost(%q) = %q, want %q", tt.req, got, tt.want)
+		}
+	}
+}
+
+func TestSniffHostReplays(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "tls", data: clientHello(t, "api.example.com"), want: "api.example.com"},
+		{name: "http", data: []byte("POST /submit HTTP/1.1\r\nHost: api.example.com\r\nContent-Length: 4\r\n\r\nbody"), want: "api.example.com"},
+		{name: "unknown", data: []byte("\x00\x01binary"), want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(tt.data)
+				client.Close()
+			}()
+			_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			name, conn := sniffHost(server)
+			if name != tt.want {
+				t.Errorf("sniffHost = %q, want %q", name, tt.want)
+			}
+			got, err := ioutil.ReadAll(conn)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("replayed %q, want %q", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestTransparentRefusedWithClientAuth(t *testing.T) {
+	var out bytes.Buffer
+	s := &Server{
+		clientAuth: staticVerifier{username: "alice", password: "secret"},
+		logger:     logging.NewEventLogger(&out, logging.LevelWarn, nil),
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	s.serveTransparentConn(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8801}, server)
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection was not closed: %v", err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("transparent clients can not authenticate")) {
+		t.Errorf("log = %q", out.String())
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// tunnel copies data in both directions between the client and target until both sides are done,
+// or until no data was sent in either direction for the idle timeout, then closes both connections.
+// A zero idle timeout means no limit.
+// It returns the number of bytes sent by the client, and the number of bytes sent to the client.
+func tunnel(client, target net.Conn, idle time.Duration) (in, out int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	a := newActivity(idle)
+	go pipe(target, client, &in, a, &wg)
+	go pipe(client, target, &out, a, &wg)
+	wg.Wait()
+	client.Close()
+	target.Close()
+	return in, out
+}
+
+// pipe copies from src to dst and then half-closes dst so the other side sees EOF
+func pipe(dst, src net.Conn, n *int64, a *activity, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var r io.Reader = src
+	if a.idle > 0 {
+		r = &idleReader{conn: src, a: a}
+	}
+	*n, _ = io.Copy(dst, r)
+	if cw, ok := dst.(closeWriter); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	dst.Close()
+}
+
+// activity records when data was last sent in either direction of a tunnel
+type activity struct {
+	idle time.Duration
+	last int64
+}
+
+func newActivity(idle time.Duration) *activity {
+	return &activity{idle: idle, last: time.Now().UnixNano()}
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// expires returns when the tunnel becomes idle
+func (a *activity) expires() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.last)).Add(a.idle)
+}
+
+// idleReader reads from one side of a tunnel until the whole tunnel has been idle for the timeout.
+// Data flowing in the other direction keeps it open.
+type idleReader struct {
+	conn net.Conn
+	a    *activity
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	for {
+		_ = r.conn.SetReadDeadline(r.a.expires())
+		n, err := r.conn.Read(p)
+		if n > 0 {
+			r.a.touch()
+		}
+		if err != nil && isTimeout(err) && time.Now().Before(r.a.expires()) {
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
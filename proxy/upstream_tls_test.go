@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// tlsConnectProxy is an https upstream proxy that tunnels CONNECT requests,
+// and reports the SNI and client certificate of each TLS handshake
+type tlsConnectProxy struct {
+	*httptest.Server
+	hellos chan *tls.ClientHelloInfo
+	peers  chan int
+}
+
+func startTLSConnectProxy(t *testing.T, clientAuth tls.ClientAuthType) *tlsConnectProxy {
+	t.Helper()
+	p := &tlsConnectProxy{hellos: make(chan *tls.ClientHelloInfo, 1), peers: make(chan int, 1)}
+	p.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		p.peers <- len(req.TLS.PeerCertificates)
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() { _, _ = io.Copy(target, conn) }()
+		_, _ = io.Copy(conn, target)
+	}))
+	p.Server.TLS = &tls.Config{
+		ClientAuth: clientAuth,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			p.hellos <- hello
+			return nil, nil
+		},
+	}
+	p.Server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	p.Server.StartTLS()
+	t.Cleanup(p.Server.Close)
+	return p
+}
+
+func (p *tlsConnectProxy) url(host string) *url.URL {
+	_, port, _ := net.SplitHostPort(p.Listener.Addr().String())
+	return &url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)}
+}
+
+func (p *tlsConnectProxy) roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.Certificate())
+	return pool
+}
+
+// selfSignedCert creates a client certificate
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "squiggly client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestProxyDialerTLS(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+	client := selfSignedCert(t)
+	tests := []struct {
+		name       string
+		clientAuth tls.ClientAuthType
+		host       string
+		cfg        func(p *tlsConnectProxy) *tls.Config
+		sni        string
+		peers      int
+		fails      bool
+	}{
+		{name: "custom CA", host: "127.0.0.1",
+			cfg: func(p *tlsConnectProxy) *tls.Config { return &tls.Config{RootCAs: p.roots()} }},
+		{name: "host name as SNI", host: "localhost", sni: "localhost", fails: true,
+			cfg: func(p *tlsConnectProxy) *tls.Config { return &tls.Config{RootCAs: p.roots()} }},
+		{name: "server name override", host: "localhost", sni: "example.com",
+			cfg: func(p *tlsConnectProxy) *tls.Config {
+				return &tls.Config{RootCAs: p.roots(), ServerName: "example.com"}
+			}},
+		{name: "client certificate", host: "127.0.0.1", clientAuth: tls.RequireAnyClientCert, peers: 1,
+			cfg: func(p *tlsConnectProxy) *tls.Config {
+				return &tls.Config{RootCAs: p.roots(), Certificates: []tls.Certificate{client}}
+			}},
+		{name: "missing client certificate", host: "127.0.0.1", clientAuth: tls.RequireAnyClientCert, fails: true,
+			cfg: func(p *tlsConnectProxy) *tls.Config { return &tls.Config{RootCAs: p.roots()} }},
+		{name: "untrusted", host: "127.0.0.1", fails: true,
+			cfg: func(p *tlsConnectProxy) *tls.Config { return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTLSConnectProxy(t, tt.clientAuth)
+			d := &ProxyDialer{Host: p.url(tt.host), TLSConfig: tt.cfg(p), HandshakeTimeout: 5 * time.Second}
+			conn, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+			if hello := <-p.hellos; hello.ServerName != tt.sni {
+				t.Errorf("SNI = %q, want %q", hello.ServerName, tt.sni)
+			}
+			if tt.fails {
+				if err == nil {
+					conn.Close()
+					t.Fatal("DialContext succeeded")
+				}
+				var perr *ProxyError
+				if !errors.As(err, &perr) || !errors.Is(err, ErrProxyTLS) {
+					t.Errorf("error %v is not a TLS *ProxyError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DialContext: %v", err)
+			}
+			defer conn.Close()
+			if _, ok := conn.(*tls.Conn); !ok {
+				t.Errorf("tunnel is a %T, want it to run over TLS", conn)
+			}
+			if peers := <-p.peers; peers != tt.peers {
+				t.Errorf("proxy saw %d client certificates, want %d", peers, tt.peers)
+			}
+			assertEcho(t, conn)
+		})
+	}
+}
+
+func TestFallbackTLS(t *testing.T) {
+	echo := listenLoopback(t)
+	go serveEcho(echo)
+
+	tests := []struct {
+		name   string
+		policy FallbackPolicy
+		route  string
+	}{
+		{"untrusted proxy fails by default", nil, ""},
+		{"untrusted proxy may fall back direct", FallbackPolicy{ClassTLS: FallbackDirect}, routeDirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTLSConnectProxy(t, tls.NoClientCert)
+			s := New(
+				Proxies(func(req *http.Request) ([]*url.URL, error) { return []*url.URL{p.url("127.0.0.1")}, nil }),
+				Fallback(tt.policy),
+			)
+			conn, route, err := s.dialRoute(context.Background(), "tcp", echo.Addr().String())
+			if tt.route == "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("dialRoute succeeded through %s", route)
+				}
+				if class := errorClass(err); class != ClassTLS {
+					t.Errorf("class of %v = %q, want %q", err, class, ClassTLS)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialRoute: %v", err)
+			}
+			if route != tt.route {
+				t.Errorf("route = %q, want %q", route, tt.route)
+			}
+			assertEcho(t, conn)
+		})
+	}
+}
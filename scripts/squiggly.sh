@@ -14,8 +14,7 @@ SQUIGGLY_PROXY_USERNAME=${SQUIGGLY_PROXY_USERNAME:-"${USER}"}
 # 2. Use a single upstream proxy
 SQUIGGLY_FORWARD_PROXY="http://proxy.example.com:8080"
 
-## Where should squiggly store its support files
-SQUIGGLY_PIDFILE=$HOME/.squiggly
+## Where should squiggly write its log
 SQUIGGLY_LOGFILE=$HOME/squiggly.log
 
 ## Should the logs be verbose?
@@ -32,7 +31,7 @@ SQUIGGLY_VERBOSE=N
 SQUIGGLY_PROXY_ADDR="localhost:${SQUIGGLY_PROXY_PORT}"
 run_squiggly() {
   echo "Running Squiggly"
-  _SQUIGGLY_ARGS=(--address "${SQUIGGLY_PROXY_ADDR}")
+  _SQUIGGLY_ARGS=(--address "${SQUIGGLY_PROXY_ADDR}" --log-file "${SQUIGGLY_LOGFILE}")
   if [ -n "${SQUIGGLY_KRB5_REALM}" ]; then
     echo "- Realm: ${SQUIGGLY_KRB5_REALM}"
     _SQUIGGLY_ARGS+=(--realm "${SQUIGGLY_KRB5_REALM}")
@@ -55,10 +54,7 @@ run_squiggly() {
   if [ "${SQUIGGLY_VERBOSE}" = "Y" ]; then
     _SQUIGGLY_ARGS+=(--verbose)
   fi
-  squiggly proxy "${_SQUIGGLY_ARGS[@]}" > "${SQUIGGLY_LOGFILE}" 2>&1 &
-  echo "$!" > "${SQUIGGLY_PIDFILE}"
-  disown '%%'
-  echo "Squiggly Up ($PID): http://${SQUIGGLY_PROXY_ADDR}"
+  squiggly start "${_SQUIGGLY_ARGS[@]}" && echo "Squiggly Up: http://${SQUIGGLY_PROXY_ADDR}"
 }
 
 squiggly_auth() {
@@ -80,37 +76,21 @@ squiggly_krb5conf() {
 }
 
 squiggly_up() {
-  if [ -r "${SQUIGGLY_PIDFILE}" ]; then
-    PID=$(cat "${SQUIGGLY_PIDFILE}")
-    if ! ps -p "${PID}" > /dev/null 2>&1; then
-      run_squiggly
-    fi
-  else
+  if ! squiggly status > /dev/null 2>&1; then
     run_squiggly
   fi
 
-  # Set proxy environment variables
-  export HTTP_PROXY="http://${SQUIGGLY_PROXY_ADDR}"
-  export HTTPS_PROXY=${HTTP_PROXY}
-  export NO_PROXY="localhost,127.0.0.1,${HOST}"
-
-  export http_proxy=${HTTP_PROXY}
-  export https_proxy=${HTTP_PROXY}
-  export no_proxy=${NO_PROXY}
+  # Set proxy environment variables, leaving out the hosts the PAC file connects to directly
+  _SQUIGGLY_ENV_ARGS=(--address "${SQUIGGLY_PROXY_ADDR}")
+  if [ -n "${SQUIGGLY_FORWARD_PROXY}" ]; then
+    _SQUIGGLY_ENV_ARGS+=(--proxy "${SQUIGGLY_FORWARD_PROXY}")
+  elif [ -n "${SQUIGGLY_PAC_URL}" ]; then
+    _SQUIGGLY_ENV_ARGS+=(--pac "${SQUIGGLY_PAC_URL}")
+  fi
+  eval "$(squiggly env "${_SQUIGGLY_ENV_ARGS[@]}")"
 }
 
 squiggly_down() {
-  if [ -r "${SQUIGGLY_PIDFILE}" ]; then
-    PID=$(cat "${SQUIGGLY_PIDFILE}")
-    if ps -p "${PID}" > /dev/null 2>&1; then
-      echo "Stopping Squiggly ($PID)"
-      kill "${PID}"
-    fi
-  fi
-  unset HTTP_PROXY
-  unset HTTPS_PROXY
-  unset NO_PROXY
-  unset http_proxy
-  unset https_proxy
-  unset no_proxy
+  squiggly stop
+  eval "$(squiggly env --unset)"
 }